@@ -0,0 +1,75 @@
+package kvs
+
+import (
+	"gokvs/kvsAudit"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Actions that change a key, by the operation name they are audited as
+var auditedActions = map[actionType]string{
+	setActionType:       "set",
+	updateActionType:    "update",
+	deleteActionType:    "delete",
+	incrementActionType: "increment",
+	patchActionType:     "patch",
+}
+
+// The live value of id in ns, without touching or expiring its entry.
+func peekValue(ns *namespace, id string) interface{} {
+	key, err := uuid.Parse(id)
+	if err != nil {
+		return nil
+	}
+	if entry, ok := ns.entries[key]; ok && !entry.expiredAt(time.Now()) {
+		return entry.val
+	}
+	return nil
+}
+
+/*
+ *	Hands a change applied by action to kvsAudit. old is the value of the key
+ *	before the action. Failed actions, and deletes of missing keys, changed
+ *	nothing and are not recorded. Only called from the store goroutine, so
+ *	changes are recorded in the order they were made.
+ */
+func auditAction(ns *namespace, action Action, old interface{}, reply actionReply) {
+	operation, ok := auditedActions[action.actionType]
+	if !ok || reply.err != nil {
+		return
+	}
+	change := kvsAudit.Change{
+		Operation: operation,
+		Namespace: ns.name,
+		Key:       action.id,
+		Source:    action.source,
+		OldValue:  old,
+	}
+	switch action.actionType {
+	case setActionType:
+		change.Key, _ = reply.val.(string)
+		change.NewValue = action.val
+	case updateActionType:
+		change.NewValue = action.val
+	case deleteActionType:
+		if !reply.found {
+			return
+		}
+	case incrementActionType, patchActionType:
+		if reply.val == nil {
+			return
+		}
+		change.NewValue = reply.val
+	}
+	kvsAudit.Record(change)
+}
+
+// Records the drop of the namespace named by action, which removed all its keys.
+func auditNamespaceDrop(action Action) {
+	kvsAudit.Record(kvsAudit.Change{
+		Operation: "dropNamespace",
+		Namespace: action.id,
+		Source:    action.source,
+	})
+}
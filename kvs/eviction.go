@@ -0,0 +1,181 @@
+package kvs
+
+import (
+	"context"
+	"gokvs/kvsConfig"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+// Eviction policies, see kvsConfig.EvictionPolicies
+const (
+	rejectPolicy = "reject"
+	lruPolicy    = "lru"
+	lfuPolicy    = "lfu"
+	randomPolicy = "random"
+	ttlPolicy    = "ttl"
+)
+
+/*
+ *	Like Redis, victims are picked from a small sample of keys rather than by
+ *	keeping every key ordered, so LRU and LFU are approximate once the store
+ *	holds more than evictionSamples keys. Map iteration order is randomised,
+ *	which makes the sample random.
+ */
+const evictionSamples = 5
+
+const expirySweepInterval = time.Second
+
+type storeLimits struct {
+	maxKeys       int
+	maxBytes      int64
+	policy        string
+	maxValueBytes int64
+	maxKeyLength  int
+}
+
+/*
+ *	Applies the store limits to the default namespace. A store already over
+ *	lowered limits is trimmed on the next write.
+ */
+func applyLimits(cfg kvsConfig.StoreConfig) {
+	namespacesMutex.Lock()
+	defer namespacesMutex.Unlock()
+	defaultLimits = limitsOfConfig(kvsConfig.NamespaceConfig{
+		MaxKeys:        cfg.MaxKeys,
+		MaxBytes:       cfg.MaxBytes,
+		EvictionPolicy: cfg.EvictionPolicy,
+		MaxValueBytes:  cfg.MaxValueBytes,
+		MaxKeyLength:   cfg.MaxKeyLength,
+	})
+	if ns, ok := namespaces[DefaultNamespace]; ok {
+		ns.limits = defaultLimits
+	}
+}
+
+// The limits of the namespace addressed by ctx, none if it does not exist.
+func limitsOf(ctx context.Context) storeLimits {
+	namespacesMutex.RLock()
+	defer namespacesMutex.RUnlock()
+	if ns, ok := namespaces[NamespaceFrom(ctx)]; ok {
+		return ns.limits
+	}
+	return storeLimits{}
+}
+
+func (l storeLimits) checkKeyLength(id string) error {
+	if l.maxKeyLength > 0 && len(id) > l.maxKeyLength {
+		return ErrKeyTooLong
+	}
+	return nil
+}
+
+func (l storeLimits) checkValueSize(value interface{}) error {
+	if l.maxValueBytes > 0 && approximateSize(value) > l.maxValueBytes {
+		return ErrValueTooLarge
+	}
+	return nil
+}
+
+/*
+ *	Checked against the limits of the namespace addressed by ctx by the
+ *	accessors, before an action reaches the store goroutine. An empty id is
+ *	left to the accessors' own check.
+ */
+func CheckKeyLength(ctx context.Context, id string) error {
+	return limitsOf(ctx).checkKeyLength(id)
+}
+
+func CheckValueSize(ctx context.Context, value interface{}) error {
+	return limitsOf(ctx).checkValueSize(value)
+}
+
+func (l storeLimits) exceeded(keys int, bytes int64) bool {
+	return (l.maxKeys > 0 && keys > l.maxKeys) || (l.maxBytes > 0 && bytes > l.maxBytes)
+}
+
+/*
+ *	Makes room for writing entry under key in ns, evicting other keys if the
+ *	policy allows it. Returns ErrStoreFull when the write would still exceed
+ *	the limits. Only called from the store goroutine.
+ */
+func makeRoom(ns *namespace, key uuid.UUID, entry *storeEntry) error {
+	l := ns.currentLimits()
+	projected := func() (int, int64) {
+		keys, bytes := len(ns.entries)+1, atomic.LoadInt64(&ns.bytes)+entry.size
+		if old, ok := ns.entries[key]; ok {
+			keys--
+			bytes -= old.size
+		}
+		return keys, bytes
+	}
+	if l.maxBytes > 0 && entry.size > l.maxBytes {
+		return ErrStoreFull
+	}
+	for l.exceeded(projected()) {
+		if l.policy == rejectPolicy {
+			return ErrStoreFull
+		}
+		victim, ok := pickVictim(ns, l.policy, key)
+		if !ok {
+			return ErrStoreFull
+		}
+		removeEntry(ns, victim)
+		registerEviction(ns, l.policy)
+	}
+	return nil
+}
+
+func pickVictim(ns *namespace, policy string, protected uuid.UUID) (uuid.UUID, bool) {
+	var victim uuid.UUID
+	var best *storeEntry
+	sampled := 0
+	for key, entry := range ns.entries {
+		if key == protected {
+			continue
+		}
+		if policy == ttlPolicy && entry.expiresAt.IsZero() {
+			continue
+		}
+		if best == nil || betterVictim(policy, entry, best) {
+			victim, best = key, entry
+		}
+		sampled++
+		if policy == randomPolicy || sampled == evictionSamples {
+			break
+		}
+	}
+	return victim, best != nil
+}
+
+func betterVictim(policy string, candidate, current *storeEntry) bool {
+	switch policy {
+	case lruPolicy:
+		return candidate.lastAccess < current.lastAccess
+	case lfuPolicy:
+		if candidate.hits != current.hits {
+			return candidate.hits < current.hits
+		}
+		return candidate.lastAccess < current.lastAccess
+	case ttlPolicy:
+		return candidate.expiresAt.Before(current.expiresAt)
+	}
+	return false
+}
+
+// Removes every expired key in every namespace. Only called from the store goroutine.
+func sweepExpired(now time.Time) {
+	for _, ns := range namespaces {
+		if ns.expiringKeys == 0 {
+			continue
+		}
+		for key, entry := range ns.entries {
+			if entry.expiredAt(now) {
+				removeEntry(ns, key)
+				registerExpiry(ns)
+			}
+		}
+	}
+}
@@ -0,0 +1,396 @@
+package kvs
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gokvs/kvsConfig"
+	"gokvs/kvsDocument"
+	"gokvs/kvsMetrics"
+	"gokvs/kvsTracing"
+	"math"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+var ErrUnknownIndex = errors.New("Index does not exist.")
+var ErrInvalidIndexQuery = errors.New("Invalid index query.")
+
+/*
+ *	Secondary indexes map the scalar values a JSONPath selects from each stored
+ *	document to the ids holding them. A path selecting several values, like
+ *	$.tags[*], indexes the document under each of them. Only strings, numbers
+ *	and booleans are indexed, so nulls, objects, arrays and raw values are left
+ *	out.
+ *
+ *	Every namespace has its own copy of each declared index, owned by the store
+ *	goroutine and kept in step with the namespace by putEntry and removeEntry.
+ *	Values sort booleans first, then numbers, then strings; numbers are
+ *	compared as float64.
+ */
+const (
+	boolIndexKind = iota
+	numberIndexKind
+	stringIndexKind
+)
+
+type indexKey struct {
+	kind   int
+	number float64
+	text   string
+}
+
+func (a indexKey) less(b indexKey) bool {
+	if a.kind != b.kind {
+		return a.kind < b.kind
+	}
+	if a.kind == stringIndexKind {
+		return a.text < b.text
+	}
+	return a.number < b.number
+}
+
+func (k indexKey) value() interface{} {
+	switch k.kind {
+	case boolIndexKind:
+		return k.number == 1
+	case numberIndexKind:
+		return k.number
+	}
+	return k.text
+}
+
+// Returns the key value is indexed under, or false if it is not a scalar.
+func toIndexKey(value interface{}) (indexKey, bool) {
+	switch v := value.(type) {
+	case string:
+		return indexKey{kind: stringIndexKind, text: v}, true
+	case bool:
+		if v {
+			return indexKey{kind: boolIndexKind, number: 1}, true
+		}
+		return indexKey{kind: boolIndexKind}, true
+	}
+	if _, f, _, err := toNumber(value); err == nil {
+		return indexKey{kind: numberIndexKind, number: f}, true
+	}
+	return indexKey{}, false
+}
+
+// The smallest key of kind, so a search for it finds the first key of that kind.
+func firstIndexKey(kind int) indexKey {
+	return indexKey{kind: kind, number: math.Inf(-1)}
+}
+
+type index struct {
+	name string
+	path kvsDocument.Path
+	ids  map[indexKey]map[uuid.UUID]struct{}
+	keys []indexKey // Distinct keys in ids, sorted
+
+	entries int64 // Pairs of key and id, read atomically by the metrics
+}
+
+func newIndex(cfg kvsConfig.IndexConfig) *index {
+	path, _ := kvsDocument.ParsePath(cfg.Path) // Checked by kvsConfig.Validate
+	return &index{name: cfg.Name, path: path, ids: map[indexKey]map[uuid.UUID]struct{}{}}
+}
+
+// The distinct keys value is indexed under.
+func (ix *index) keysOf(value interface{}) []indexKey {
+	if _, ok := value.(Blob); ok {
+		return nil
+	}
+	var keys []indexKey
+	seen := map[indexKey]bool{}
+	for _, selected := range ix.path.Select(value) {
+		if key, ok := toIndexKey(selected); ok && !seen[key] {
+			seen[key] = true
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (ix *index) search(key indexKey) int {
+	return sort.Search(len(ix.keys), func(i int) bool { return !ix.keys[i].less(key) })
+}
+
+func (ix *index) add(id uuid.UUID, value interface{}) {
+	for _, key := range ix.keysOf(value) {
+		ids, ok := ix.ids[key]
+		if !ok {
+			ids = map[uuid.UUID]struct{}{}
+			ix.ids[key] = ids
+			i := ix.search(key)
+			ix.keys = append(ix.keys, indexKey{})
+			copy(ix.keys[i+1:], ix.keys[i:])
+			ix.keys[i] = key
+		}
+		ids[id] = struct{}{}
+		atomic.AddInt64(&ix.entries, 1)
+	}
+}
+
+func (ix *index) remove(id uuid.UUID, value interface{}) {
+	for _, key := range ix.keysOf(value) {
+		ids := ix.ids[key]
+		if _, ok := ids[id]; !ok {
+			continue
+		}
+		delete(ids, id)
+		atomic.AddInt64(&ix.entries, -1)
+		if len(ids) == 0 {
+			delete(ix.ids, key)
+			i := ix.search(key)
+			ix.keys = append(ix.keys[:i], ix.keys[i+1:]...)
+		}
+	}
+}
+
+// The declared indexes, built in every namespace
+var indexDefinitions []kvsConfig.IndexConfig
+var indexesMutex sync.RWMutex
+
+var _ = kvsMetrics.NewGaugeVecFunc(
+	"kvs_index_entries",
+	"Values indexed by each secondary index.",
+	func() []kvsMetrics.Sample {
+		samples := []kvsMetrics.Sample{}
+		for _, info := range Namespaces() {
+			for name, entries := range info.Indexes {
+				samples = append(samples, kvsMetrics.Sample{LabelValues: []string{info.Name, name}, Value: float64(entries)})
+			}
+		}
+		return samples
+	},
+	"namespace", "index",
+)
+
+/*
+ *	Changes the declared indexes. A running store rebuilds them in its
+ *	goroutine, otherwise Start builds them.
+ */
+func configureIndexes(definitions []kvsConfig.IndexConfig) {
+	indexesMutex.Lock()
+	if reflect.DeepEqual(definitions, indexDefinitions) {
+		indexesMutex.Unlock()
+		return
+	}
+	indexDefinitions = append([]kvsConfig.IndexConfig{}, definitions...)
+	indexesMutex.Unlock()
+	if atomic.LoadInt32(&running) == 1 {
+		doAction(context.Background(), Action{actionType: reindexActionType, val: definitions})
+	}
+}
+
+// Builds the declared indexes over every entry in ns.
+func buildIndexes(ns *namespace) []*index {
+	indexesMutex.RLock()
+	defer indexesMutex.RUnlock()
+	built := make([]*index, 0, len(indexDefinitions))
+	for _, definition := range indexDefinitions {
+		ix := newIndex(definition)
+		for id, entry := range ns.entries {
+			ix.add(id, entry.val)
+		}
+		built = append(built, ix)
+	}
+	return built
+}
+
+// Only called from the store goroutine.
+func rebuildIndexes() {
+	for _, ns := range namespaces {
+		built := buildIndexes(ns)
+		namespacesMutex.Lock()
+		ns.indexes = built
+		namespacesMutex.Unlock()
+	}
+}
+
+func indexEntry(ns *namespace, id uuid.UUID, value interface{}) {
+	for _, ix := range ns.indexes {
+		ix.add(id, value)
+	}
+}
+
+func unindexEntry(ns *namespace, id uuid.UUID, value interface{}) {
+	for _, ix := range ns.indexes {
+		ix.remove(id, value)
+	}
+}
+
+/*
+ *	Selects indexed values equal to Eq, or within the bounds given by Gt, Gte,
+ *	Lt and Lte. Range bounds only match values of their own kind, so
+ *	Gt: 5 never matches a string. With no conditions every indexed value
+ *	matches. Limit caps the number of matches, 0 means no limit.
+ */
+type IndexQuery struct {
+	Eq    interface{}
+	Gt    interface{}
+	Gte   interface{}
+	Lt    interface{}
+	Lte   interface{}
+	Limit int
+}
+
+type IndexMatch struct {
+	Id    string      `json:"id"`
+	Key   interface{} `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+type indexBound struct {
+	key       indexKey
+	inclusive bool
+	set       bool
+}
+
+func queryBound(value interface{}, inclusive bool) (indexBound, error) {
+	if value == nil {
+		return indexBound{}, nil
+	}
+	key, ok := toIndexKey(value)
+	if !ok {
+		return indexBound{}, ErrInvalidIndexQuery
+	}
+	return indexBound{key: key, inclusive: inclusive, set: true}, nil
+}
+
+// Returns the lower and upper bounds of query, either of which may be unset.
+func (query IndexQuery) bounds() (indexBound, indexBound, error) {
+	if query.Eq != nil {
+		if query.Gt != nil || query.Gte != nil || query.Lt != nil || query.Lte != nil {
+			return indexBound{}, indexBound{}, ErrInvalidIndexQuery
+		}
+		eq, err := queryBound(query.Eq, true)
+		return eq, eq, err
+	}
+	if (query.Gt != nil && query.Gte != nil) || (query.Lt != nil && query.Lte != nil) {
+		return indexBound{}, indexBound{}, ErrInvalidIndexQuery
+	}
+	lower, err := queryBound(query.Gt, false)
+	if err == nil && !lower.set {
+		lower, err = queryBound(query.Gte, true)
+	}
+	if err != nil {
+		return indexBound{}, indexBound{}, err
+	}
+	upper, err := queryBound(query.Lt, false)
+	if err == nil && !upper.set {
+		upper, err = queryBound(query.Lte, true)
+	}
+	if err != nil {
+		return indexBound{}, indexBound{}, err
+	}
+	if lower.set && upper.set && lower.key.kind != upper.key.kind {
+		return indexBound{}, indexBound{}, ErrInvalidIndexQuery
+	}
+	return lower, upper, nil
+}
+
+/*
+ *	Only called from the store goroutine. Matches are ordered by indexed
+ *	value, then id. Entries that have expired but not yet been swept are
+ *	skipped.
+ */
+func queryIndexKvs(ns *namespace, name string, query IndexQuery) ([]IndexMatch, error) {
+	var ix *index
+	for _, candidate := range ns.indexes {
+		if candidate.name == name {
+			ix = candidate
+		}
+	}
+	if ix == nil {
+		return nil, ErrUnknownIndex
+	}
+	lower, upper, err := query.bounds()
+	if err != nil {
+		return nil, err
+	}
+
+	start := 0
+	switch {
+	case lower.set:
+		start = ix.search(lower.key)
+		if !lower.inclusive {
+			for start < len(ix.keys) && ix.keys[start] == lower.key {
+				start++
+			}
+		}
+	case upper.set:
+		start = ix.search(firstIndexKey(upper.key.kind))
+	}
+	now := time.Now()
+	matches := []IndexMatch{}
+	for _, key := range ix.keys[start:] {
+		if lower.set && key.kind != lower.key.kind {
+			break
+		}
+		if upper.set && (key.kind != upper.key.kind || upper.key.less(key) || (!upper.inclusive && key == upper.key)) {
+			break
+		}
+		ids := make([]uuid.UUID, 0, len(ix.ids[key]))
+		for id := range ix.ids[key] {
+			if !ns.entries[id].expiredAt(now) {
+				ids = append(ids, id)
+			}
+		}
+		sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+		for _, id := range ids {
+			if query.Limit > 0 && len(matches) == query.Limit {
+				return matches, nil
+			}
+			matches = append(matches, IndexMatch{Id: id.String(), Key: key.value(), Value: ns.entries[id].val})
+		}
+	}
+	return matches, nil
+}
+
+func QueryIndex(name string, query IndexQuery) ([]IndexMatch, error) {
+	return QueryIndexContext(context.Background(), name, query)
+}
+
+// Returns the documents whose indexed values match query, fails with ErrUnknownIndex for an undeclared index.
+func QueryIndexContext(ctx context.Context, name string, query IndexQuery) ([]IndexMatch, error) {
+	ctx, span := startAccessorSpan(ctx, indexQueryActionType, "")
+	defer span.End()
+	span.SetAttributes(kvsTracing.Attribute{Key: "kvs.index", Value: name})
+	if query.Limit < 0 {
+		span.RecordError(ErrInvalidIndexQuery)
+		registerResult(indexQueryActionType, failureReason(ErrInvalidIndexQuery))
+		return nil, ErrInvalidIndexQuery
+	}
+	reply := doAction(ctx, Action{
+		actionType: indexQueryActionType,
+		id:         name,
+		val:        query,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(indexQueryActionType, failureReason(reply.err))
+		return nil, reply.err
+	}
+	registerResult(indexQueryActionType, "")
+	return reply.val.([]IndexMatch), nil
+}
+
+/*
+ *	Reads an index query bound from text: a JSON string, number or boolean, or
+ *	else the text itself. So 5 is a number, "5" a string and alice a string.
+ */
+func ParseIndexValue(text string) interface{} {
+	if value, err := kvsDocument.Decode([]byte(text)); err == nil {
+		if _, ok := toIndexKey(value); ok {
+			return value
+		}
+	}
+	return text
+}
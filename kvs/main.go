@@ -1,9 +1,17 @@
 package kvs
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
-	"expvar"
-	"log"
+	"gokvs/kvsAudit"
+	"gokvs/kvsConfig"
+	"gokvs/kvsDocument"
+	"gokvs/kvsLogger"
+	"gokvs/kvsTracing"
+	"math"
+	"sync/atomic"
+	"time"
 
 	uuid "github.com/google/uuid"
 )
@@ -13,138 +21,379 @@ const (
 	setActionType
 	updateActionType
 	deleteActionType
+	copyActionType
+	incrementActionType
+	patchActionType
+	indexQueryActionType
+	reindexActionType
+	scanActionType
+	defineNamespaceActionType
+	dropNamespaceActionType
 )
 
 type KvsStoreType map[uuid.UUID]interface{}
 
-var kvs KvsStoreType
-
 type actionType int
 
+var actionTypeNames = map[actionType]string{
+	getActionType:             "get",
+	setActionType:             "set",
+	updateActionType:          "update",
+	deleteActionType:          "delete",
+	copyActionType:            "copy",
+	incrementActionType:       "increment",
+	patchActionType:           "patch",
+	indexQueryActionType:      "index_query",
+	reindexActionType:         "reindex",
+	scanActionType:            "scan",
+	defineNamespaceActionType: "define_namespace",
+	dropNamespaceActionType:   "drop_namespace",
+}
+
+func (a actionType) String() string {
+	return actionTypeNames[a]
+}
+
 type Action struct {
 	actionType actionType
+	namespace  string          // Set by doAction from the context
+	source     kvsAudit.Source // Likewise, for the audit log
 	id         string
 	val        interface{}
+	ttl        time.Duration
+}
+
+/*
+ *	Sent back by the store goroutine for every action. found reports whether
+ *	the key existed before the action was applied.
+ */
+type actionReply struct {
+	val   interface{}
+	found bool
+	err   error
 }
 
 var actionChannel chan Action
-var replyChannel chan interface{}
-var resultsChannel chan kvsResult
+var replyChannel chan actionReply
+
+// 1 between Start and Stop
+var running int32
 
-type KvsMetricsStruct struct {
-	Size                 int
-	Operations           int
-	SuccessfulOperations int
+/*
+ *	Rough in-memory size of a key and a JSON decoded value. Only meant to track
+ *	how the store grows, not to match the allocator.
+ */
+const keySize = 16
+
+func approximateSize(value interface{}) int64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case string:
+		return int64(len(v))
+	case bool:
+		return 1
+	case json.Number:
+		return int64(len(v))
+	case Blob:
+		return int64(len(v.ContentType) + len(v.Data))
+	case []interface{}:
+		size := int64(0)
+		for _, item := range v {
+			size += approximateSize(item)
+		}
+		return size
+	case map[string]interface{}:
+		size := int64(0)
+		for key, item := range v {
+			size += int64(len(key)) + approximateSize(item)
+		}
+		return size
+	default:
+		return 8
+	}
 }
 
-var kvsSize int
-var kvsOps int
-var kvsSuccessfulOps int
+/*
+ *	A stored value with the bookkeeping used for size accounting, eviction and
+ *	expiry. lastAccess is a logical clock rather than a time, so ordering is
+ *	exact even for accesses within the same clock tick.
+ */
+type storeEntry struct {
+	val        interface{}
+	size       int64
+	lastAccess uint64
+	hits       uint64
+	expiresAt  time.Time // Zero if the key never expires
+}
 
-type kvsResult struct {
-	actionType actionType
-	success    bool
+func (e *storeEntry) expiredAt(now time.Time) bool {
+	return !e.expiresAt.IsZero() && !now.Before(e.expiresAt)
+}
+
+var accessClock uint64
+
+func newEntry(value interface{}, ttl time.Duration) *storeEntry {
+	entry := &storeEntry{val: value, size: keySize + approximateSize(value)}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl)
+	}
+	return entry
+}
+
+func touch(entry *storeEntry) {
+	accessClock++
+	entry.lastAccess = accessClock
+	entry.hits++
 }
 
 /*
- * Synchronous KVS Access methods
+ *	Entries only change through putEntry and removeEntry, which keep the
+ *	indexes and the size metrics of the namespace and the store in step with
+ *	its entries.
  */
-func getFromKvs(ketToFetch string) (interface{}, error) {
+func putEntry(ns *namespace, key uuid.UUID, entry *storeEntry) {
+	if _, ok := ns.entries[key]; ok {
+		removeEntry(ns, key)
+	}
+	touch(entry)
+	ns.entries[key] = entry
+	indexEntry(ns, key, entry.val)
+	if !entry.expiresAt.IsZero() {
+		ns.expiringKeys++
+	}
+	atomic.AddInt64(&ns.keys, 1)
+	atomic.AddInt64(&ns.bytes, entry.size)
+	atomic.AddInt64(&kvsSize, 1)
+	atomic.AddInt64(&kvsBytes, entry.size)
+}
+
+func removeEntry(ns *namespace, key uuid.UUID) {
+	entry := ns.entries[key]
+	delete(ns.entries, key)
+	unindexEntry(ns, key, entry.val)
+	if !entry.expiresAt.IsZero() {
+		ns.expiringKeys--
+	}
+	atomic.AddInt64(&ns.keys, -1)
+	atomic.AddInt64(&ns.bytes, -entry.size)
+	atomic.AddInt64(&kvsSize, -1)
+	atomic.AddInt64(&kvsBytes, -entry.size)
+}
+
+// Returns the live entry for key, removing it first if it has expired.
+func lookup(ns *namespace, key uuid.UUID) (*storeEntry, bool) {
+	entry, ok := ns.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if entry.expiredAt(time.Now()) {
+		removeEntry(ns, key)
+		registerExpiry(ns)
+		return nil, false
+	}
+	return entry, true
+}
+
+/*
+ * Synchronous KVS Access methods. Only called from the store goroutine.
+ */
+func getFromKvs(ns *namespace, ketToFetch string) (interface{}, bool, error) {
 	uuidToFetch, parseError := uuid.Parse(ketToFetch)
 	if parseError != nil {
-		return nil, parseError
+		return nil, false, parseError
 	}
-	if v, ok := kvs[uuidToFetch]; ok {
-		return v, nil
+	if entry, ok := lookup(ns, uuidToFetch); ok {
+		touch(entry)
+		return entry.val, true, nil
 	}
-	return nil, nil
+	return nil, false, nil
 }
-func setToKvs(value interface{}) string {
-	key := uuid.New()
 
-	kvs[key] = value
-
-	return key.String()
+func setToKvs(ns *namespace, value interface{}, ttl time.Duration) (string, error) {
+	key := uuid.New()
+	entry := newEntry(value, ttl)
+	if err := makeRoom(ns, key, entry); err != nil {
+		return "", err
+	}
+	putEntry(ns, key, entry)
+	return key.String(), nil
 }
 
-func updateKvs(keyToUpdate string, value interface{}) error {
+func updateKvs(ns *namespace, keyToUpdate string, value interface{}, ttl time.Duration) (bool, error) {
 	uuidToUpdate, parseError := uuid.Parse(keyToUpdate)
 	if parseError != nil {
-		return parseError
+		return false, parseError
 	}
-	kvs[uuidToUpdate] = value
-	return nil
+	_, found := lookup(ns, uuidToUpdate)
+	entry := newEntry(value, ttl)
+	if err := makeRoom(ns, uuidToUpdate, entry); err != nil {
+		return found, err
+	}
+	putEntry(ns, uuidToUpdate, entry)
+	return found, nil
 }
 
-func deleteFromKvs(keyToDelete string) error {
+func deleteFromKvs(ns *namespace, keyToDelete string) (bool, error) {
 	uuidToDelete, parseError := uuid.Parse(keyToDelete)
 	if parseError != nil {
-		return parseError
+		return false, parseError
 	}
-	if _, ok := kvs[uuidToDelete]; ok {
-		delete(kvs, uuidToDelete)
+	_, found := lookup(ns, uuidToDelete)
+	if found {
+		removeEntry(ns, uuidToDelete)
 	}
-	return nil
+	return found, nil
+}
+
+func copyKvs(ns *namespace) KvsStoreType {
+	now := time.Now()
+	storeCopy := make(KvsStoreType, len(ns.entries))
+	for k, entry := range ns.entries {
+		if !entry.expiredAt(now) {
+			storeCopy[k] = entry.val
+		}
+	}
+	return storeCopy
 }
 
 /*
- *	Channel monitor functions, to be run in own GoRoutines
+ *	Channel monitor function, to be run in own GoRoutine
  */
 func monitorStoreOperations(storeActionChannel <-chan Action) {
-	for action := range storeActionChannel {
+	sweepTicker := time.NewTicker(expirySweepInterval)
+	defer sweepTicker.Stop()
+	for {
+		var action Action
+		select {
+		case now := <-sweepTicker.C:
+			sweepExpired(now)
+			continue
+		case received, ok := <-storeActionChannel:
+			if !ok {
+				return
+			}
+			action = received
+		}
+		var reply actionReply
 		switch action.actionType {
-		case getActionType:
-			if val, err := getFromKvs(action.id); err == nil {
-				replyChannel <- val
-			} else {
-				replyChannel <- err
+		case reindexActionType:
+			rebuildIndexes()
+		case defineNamespaceActionType:
+			definition := action.val.(namespaceDefinition)
+			reply.err = defineNamespaceKvs(definition.cfg, definition.replace)
+		case dropNamespaceActionType:
+			reply.err = dropNamespaceKvs(action.id)
+			if reply.err == nil && kvsAudit.Enabled() {
+				auditNamespaceDrop(action)
 			}
-		case setActionType:
-			idToReturn := setToKvs(action.val)
-			replyChannel <- idToReturn
-		case updateActionType:
-			updateResult := updateKvs(action.id, action.val)
-			replyChannel <- updateResult
-		case deleteActionType:
-			deleteResult := deleteFromKvs(action.id)
-			replyChannel <- deleteResult
 		default:
-			log.Fatal("Unknown action type", action.actionType)
+			if ns, ok := namespaces[action.namespace]; ok {
+				var old interface{}
+				_, audited := auditedActions[action.actionType]
+				if audited && action.actionType != setActionType && kvsAudit.Enabled() {
+					old = peekValue(ns, action.id)
+				}
+				reply = namespaceAction(ns, action)
+				if audited && kvsAudit.Enabled() {
+					auditAction(ns, action, old, reply)
+				}
+			} else {
+				reply.err = ErrUnknownNamespace
+			}
 		}
+		replyChannel <- reply
 	}
 }
 
-func monitorResultsChannel(resultsChannel <-chan kvsResult) {
-	for result := range resultsChannel {
-		kvsOps += 1
-		if result.success == true {
-			kvsSuccessfulOps += 1
+// Applies an action to the keys of ns.
+func namespaceAction(ns *namespace, action Action) actionReply {
+	var reply actionReply
+	switch action.actionType {
+	case getActionType:
+		reply.val, reply.found, reply.err = getFromKvs(ns, action.id)
+	case setActionType:
+		reply.val, reply.err = setToKvs(ns, action.val, action.ttl)
+	case updateActionType:
+		reply.found, reply.err = updateKvs(ns, action.id, action.val, action.ttl)
+	case deleteActionType:
+		reply.found, reply.err = deleteFromKvs(ns, action.id)
+	case copyActionType:
+		reply.val = copyKvs(ns)
+	case incrementActionType:
+		reply.val, reply.found, reply.err = incrementKvs(ns, action.id, action.val.(json.Number))
+	case patchActionType:
+		reply.val, reply.found, reply.err = patchKvs(ns, action.id, action.val.(kvsDocument.Patch))
+	case indexQueryActionType:
+		reply.val, reply.err = queryIndexKvs(ns, action.id, action.val.(IndexQuery))
+	case scanActionType:
+		reply.val = scanKvs(ns, action.val.(scanRequest))
+	default:
+		kvsLogger.Fatal("Unknown action type", "actionType", action.actionType)
+	}
+	return reply
+}
 
-			switch {
-			case result.actionType == setActionType:
-				kvsSize += 1
-			case result.actionType == deleteActionType:
-				kvsSize -= 1
+/*
+ *	Hands action to the store goroutine and waits for its reply. The time spent
+ *	waiting for the store goroutine to pick the action up is traced separately
+ *	from the time it takes to apply it, and both go into the slow log.
+ */
+func doAction(ctx context.Context, action Action) actionReply {
+	action.namespace = NamespaceFrom(ctx)
+	action.source = kvsAudit.SourceFrom(ctx)
+	_, waitSpan := kvsTracing.StartSpan(ctx, "kvs.actionChannel wait", kvsTracing.KindInternal)
+	enqueued := time.Now()
+	actionChannel <- action
+	pickedUp := time.Now()
+	waitSpan.End()
+	reply := <-replyChannel
+
+	if action.actionType != copyActionType {
+		key := action.id
+		if action.actionType == setActionType {
+			key, _ = reply.val.(string)
+		}
+		valueSize := func() int64 {
+			if action.actionType == getActionType || action.actionType == patchActionType {
+				return approximateSize(reply.val)
 			}
+			return approximateSize(action.val)
 		}
+		recordSlowAction(action, key, valueSize, enqueued, pickedUp, time.Now())
 	}
+	return reply
 }
 
-func registerResult(actionType actionType, success bool) {
-	resultToRegister := kvsResult{
-		actionType: actionType,
-		success:    success,
+func startAccessorSpan(ctx context.Context, action actionType, id string) (context.Context, *kvsTracing.Span) {
+	ctx, span := kvsTracing.StartSpan(ctx, "kvs."+action.String(), kvsTracing.KindInternal,
+		kvsTracing.Attribute{Key: "kvs.op", Value: action.String()},
+		kvsTracing.Attribute{Key: "kvs.namespace", Value: NamespaceFrom(ctx)},
+	)
+	if id != "" {
+		span.SetAttributes(kvsTracing.Attribute{Key: "kvs.id", Value: id})
 	}
-	resultsChannel <- resultToRegister
+	return ctx, span
+}
+
+// Applies the store settings, at startup and on config reload.
+func ApplyConfig(cfg kvsConfig.StoreConfig) {
+	SetSlowLogThreshold(time.Duration(cfg.SlowLogThresholdMicros) * time.Microsecond)
+	resizeSlowLog(cfg.SlowLogSize)
+	applyLimits(cfg)
+	configureIndexes(cfg.Indexes)
+	configureNamespaces(cfg.Namespaces)
 }
 
-// Function to describe exported metrics.
-func KvsMetrics() interface{} {
-	return KvsMetricsStruct{
-		Size:                 kvsSize,
-		Operations:           kvsOps,
-		SuccessfulOperations: kvsSuccessfulOps,
+/*
+ *	Checks cfg, returning a function that applies it with ApplyConfig, so a
+ *	reload can check every package's settings before applying any.
+ */
+func PrepareConfig(cfg kvsConfig.StoreConfig) (func(), error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
 	}
+	return func() { ApplyConfig(cfg) }, nil
 }
 
 /*
@@ -152,31 +401,44 @@ func KvsMetrics() interface{} {
  *	Kvs is then ready to be used concurrently by calling Accessor methods below.
  */
 func Start(initState ...KvsStoreType) {
-	kvs = make(KvsStoreType)
 	actionChannel = make(chan Action)
-	replyChannel = make(chan interface{})
-	resultsChannel = make(chan kvsResult)
+	replyChannel = make(chan actionReply)
+	resetMetrics()
 
-	// Set initial state of store
+	namespacesMutex.Lock()
+	namespaces = map[string]*namespace{DefaultNamespace: newNamespace(DefaultNamespace, defaultLimits)}
+	for _, definition := range namespaceDefinitions {
+		namespaces[definition.Name] = newNamespace(definition.Name, limitsOfConfig(definition))
+	}
+	namespacesMutex.Unlock()
+
+	// Set initial state of the default namespace. It is not subject to the limits.
 	for _, state := range initState {
 		for k, v := range state {
-			kvs[k] = v
-			kvsSize++
+			putEntry(namespaces[DefaultNamespace], k, newEntry(v, 0))
 		}
 	}
-
-	// ExpVars
-	expvar.Publish("Kvs Metrics", expvar.Func(KvsMetrics))
+	resetSlowLog()
 
 	// init channel monitoring
 	go monitorStoreOperations(actionChannel)
-	go monitorResultsChannel(resultsChannel)
+	atomic.StoreInt32(&running, 1)
 }
 
 func Stop() {
+	atomic.StoreInt32(&running, 0)
 	close(actionChannel)
-	close(replyChannel)
-	close(resultsChannel)
+}
+
+/*
+ *	Used as a readiness check, fails unless the store has been started. The
+ *	store is in memory only, so there is no persisted data to wait for.
+ */
+func ReadinessCheck() error {
+	if atomic.LoadInt32(&running) != 1 {
+		return errors.New("Store is not started")
+	}
+	return nil
 }
 
 func IdIsValid(id string) (bool, error) {
@@ -187,81 +449,227 @@ func IdIsValid(id string) (bool, error) {
 	return true, nil
 }
 
+var errNoId = errors.New("No id provided.")
+var errNilValue = errors.New("Nil value given. Value will not be stored.")
+
+// Returned by writes that would exceed the store limits and could not evict enough.
+var ErrStoreFull = errors.New("Store is full. Value will not be stored.")
+
+var ErrValueTooLarge = errors.New("Value is too large. Value will not be stored.")
+var ErrKeyTooLong = errors.New("Id is too long.")
+var ErrInvalidTTL = errors.New("Invalid ttl, expected a positive number of seconds no longer than 292 years.")
+
+// Picks the failure reason for an error returned by the store goroutine.
+func failureReason(err error) string {
+	if err == nil {
+		return ""
+	}
+	if errors.Is(err, ErrPatchFailed) {
+		return patchFailedReason
+	}
+	switch err {
+	case ErrStoreFull:
+		return storeFullReason
+	case ErrValueTooLarge:
+		return valueTooLargeReason
+	case ErrKeyTooLong:
+		return keyTooLongReason
+	case ErrNotNumeric:
+		return notNumericReason
+	case ErrOverflow:
+		return overflowReason
+	case kvsDocument.ErrNotDocument:
+		return notDocumentReason
+	case errNilValue:
+		return nilValueReason
+	case ErrUnknownIndex:
+		return unknownIndexReason
+	case ErrInvalidIndexQuery:
+		return invalidQueryReason
+	case ErrInvalidCursor:
+		return invalidCursorReason
+	case ErrUnknownNamespace:
+		return unknownNsReason
+	}
+	return invalidIdReason
+}
+
 func Get(id string) (interface{}, error) {
+	return GetContext(context.Background(), id)
+}
+
+func GetContext(ctx context.Context, id string) (interface{}, error) {
+	ctx, span := startAccessorSpan(ctx, getActionType, id)
+	defer span.End()
 	if id == "" {
-		registerResult(getActionType, false)
-		return "", errors.New("No id provided.")
+		span.RecordError(errNoId)
+		registerResult(getActionType, missingIdReason)
+		return "", errNoId
+	}
+	if err := CheckKeyLength(ctx, id); err != nil {
+		span.RecordError(err)
+		registerResult(getActionType, failureReason(err))
+		return nil, err
 	}
-	action := Action{
+	reply := doAction(ctx, Action{
 		actionType: getActionType,
 		id:         id,
 		val:        nil,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(getActionType, failureReason(reply.err))
+		return nil, reply.err
 	}
-	actionChannel <- action
-	val := <-replyChannel
-	registerResult(getActionType, true)
-	return val, nil
+	span.SetAttributes(kvsTracing.Attribute{Key: "kvs.found", Value: reply.found})
+	if !reply.found {
+		registerResult(getActionType, notFoundReason)
+		return nil, nil
+	}
+	registerResult(getActionType, "")
+	return reply.val, nil
 }
 
 func Set(value interface{}) (string, error) {
+	return SetContext(context.Background(), value)
+}
+
+func SetContext(ctx context.Context, value interface{}) (string, error) {
+	return SetWithTTLContext(ctx, value, 0)
+}
+
+/*
+ *	Converts a ttl in seconds, as the transports receive it, to a duration.
+ *	Values that are not positive, not finite, shorter than a nanosecond or
+ *	longer than a time.Duration can hold return ErrInvalidTTL.
+ */
+func TTLFromSeconds(seconds float64) (time.Duration, error) {
+	nanoseconds := seconds * float64(time.Second)
+	// Also false for NaN; float64(math.MaxInt64) is 2^63, the first value that overflows
+	if !(nanoseconds >= 1 && nanoseconds < float64(math.MaxInt64)) {
+		return 0, ErrInvalidTTL
+	}
+	return time.Duration(nanoseconds), nil
+}
+
+// Stores value under a new id, expiring after ttl. A ttl of 0 never expires.
+func SetWithTTLContext(ctx context.Context, value interface{}, ttl time.Duration) (string, error) {
+	ctx, span := startAccessorSpan(ctx, setActionType, "")
+	defer span.End()
 	if value == nil {
-		registerResult(setActionType, false)
-		return "", errors.New("Nil value given. Value will not be stored.")
+		span.RecordError(errNilValue)
+		registerResult(setActionType, nilValueReason)
+		return "", errNilValue
+	}
+	if err := CheckValueSize(ctx, value); err != nil {
+		span.RecordError(err)
+		registerResult(setActionType, failureReason(err))
+		return "", err
 	}
-	action := Action{
+	reply := doAction(ctx, Action{
 		actionType: setActionType,
 		id:         "",
 		val:        value,
+		ttl:        ttl,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(setActionType, failureReason(reply.err))
+		return "", reply.err
 	}
-	actionChannel <- action
-	id := <-replyChannel
-	registerResult(setActionType, true)
-	return id.(string), nil
+	span.SetAttributes(kvsTracing.Attribute{Key: "kvs.id", Value: reply.val})
+	registerResult(setActionType, "")
+	return reply.val.(string), nil
 }
 
 func Update(id string, value interface{}) error {
+	return UpdateContext(context.Background(), id, value)
+}
+
+func UpdateContext(ctx context.Context, id string, value interface{}) error {
+	return UpdateWithTTLContext(ctx, id, value, 0)
+}
+
+// Replaces the value and the expiry of id. A ttl of 0 never expires.
+func UpdateWithTTLContext(ctx context.Context, id string, value interface{}, ttl time.Duration) error {
+	ctx, span := startAccessorSpan(ctx, updateActionType, id)
+	defer span.End()
 	if id == "" {
-		registerResult(updateActionType, false)
-		return errors.New("No id provided.")
+		span.RecordError(errNoId)
+		registerResult(updateActionType, missingIdReason)
+		return errNoId
+	}
+	if err := CheckKeyLength(ctx, id); err != nil {
+		span.RecordError(err)
+		registerResult(updateActionType, failureReason(err))
+		return err
 	}
 	if value == nil {
-		return errors.New("Nil value given. Value will not be stored.")
+		span.RecordError(errNilValue)
+		registerResult(updateActionType, nilValueReason)
+		return errNilValue
+	}
+	if err := CheckValueSize(ctx, value); err != nil {
+		span.RecordError(err)
+		registerResult(updateActionType, failureReason(err))
+		return err
 	}
-	action := Action{
+	reply := doAction(ctx, Action{
 		actionType: updateActionType,
 		id:         id,
 		val:        value,
+		ttl:        ttl,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(updateActionType, failureReason(reply.err))
+		return reply.err
 	}
-	actionChannel <- action
-	if err := <-replyChannel; err != nil {
-		return err.(error)
-	}
-	registerResult(updateActionType, true)
+	registerResult(updateActionType, "")
 	return nil
 }
 
 func Delete(id string) error {
+	return DeleteContext(context.Background(), id)
+}
+
+func DeleteContext(ctx context.Context, id string) error {
+	ctx, span := startAccessorSpan(ctx, deleteActionType, id)
+	defer span.End()
 	if id == "" {
-		registerResult(deleteActionType, false)
-		return errors.New("No id provided.")
+		span.RecordError(errNoId)
+		registerResult(deleteActionType, missingIdReason)
+		return errNoId
 	}
-	action := Action{
+	if err := CheckKeyLength(ctx, id); err != nil {
+		span.RecordError(err)
+		registerResult(deleteActionType, failureReason(err))
+		return err
+	}
+	reply := doAction(ctx, Action{
 		actionType: deleteActionType,
 		id:         id,
 		val:        nil,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(deleteActionType, failureReason(reply.err))
+		return reply.err
 	}
-
-	actionChannel <- action
-	if err := <-replyChannel; err != nil {
-		return err.(error)
+	span.SetAttributes(kvsTracing.Attribute{Key: "kvs.found", Value: reply.found})
+	if !reply.found {
+		registerResult(deleteActionType, notFoundReason)
+		return nil
 	}
-	registerResult(deleteActionType, true)
+	registerResult(deleteActionType, "")
 	return nil
 }
 
 /*
- *	Exports a copy of the current KVS. This is used for testing
+ *	Exports a copy of the current KVS, taken by the store goroutine. This is used
+ *	for testing
  */
 func GetStoreCopy() KvsStoreType {
-	return kvs
+	reply := doAction(context.Background(), Action{actionType: copyActionType})
+	return reply.val.(KvsStoreType)
 }
@@ -1,7 +1,19 @@
 package kvs
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"gokvs/kvsAudit"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsDocument"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -37,8 +49,8 @@ func TestSet(t *testing.T) {
 	if parseError != nil {
 		t.Errorf("Unparsable id returned, returns parse error %v", parseError)
 	}
-	if kvs[idAsUUID] != testValue {
-		t.Errorf("Expected %v in kvs, got %v", testValue, kvs[idAsUUID])
+	if GetStoreCopy()[idAsUUID] != testValue {
+		t.Errorf("Expected %v in kvs, got %v", testValue, GetStoreCopy()[idAsUUID])
 	}
 }
 
@@ -54,8 +66,8 @@ func TestUpdate(t *testing.T) {
 	if err != nil {
 		t.Errorf("Update returned err %v\n", err)
 	}
-	if kvs[uuidToUpdate] != expectedVal {
-		t.Errorf("Expected %v in kvs, got %v", expectedVal, kvs[uuidToUpdate])
+	if GetStoreCopy()[uuidToUpdate] != expectedVal {
+		t.Errorf("Expected %v in kvs, got %v", expectedVal, GetStoreCopy()[uuidToUpdate])
 	}
 }
 
@@ -71,10 +83,114 @@ func TestDelete(t *testing.T) {
 	if err != nil {
 		t.Errorf("Delete returned err %v\n", err)
 	}
-	if v, ok := kvs[uuidToDelete]; ok {
+	if v, ok := GetStoreCopy()[uuidToDelete]; ok {
 		t.Errorf("Expected value to be deleted, got %v", v)
 	}
 }
+
+func TestMetricsAccuracy(t *testing.T) {
+	existingKey := uuid.New()
+	Start(KvsStoreType{existingKey: "initial"})
+	defer Stop()
+
+	assertMetric := func(name string, got, want int) {
+		t.Helper()
+		if got != want {
+			t.Errorf("Expected %s to be %d, got %d", name, want, got)
+		}
+	}
+
+	Delete(uuid.New().String())
+	assertMetric("size after deleting a missing key", KvsMetrics().(KvsMetricsStruct).Size, 1)
+
+	Update(uuid.New().String(), "created by update")
+	assertMetric("size after updating a new key", KvsMetrics().(KvsMetricsStruct).Size, 2)
+
+	Update(existingKey.String(), "updated")
+	assertMetric("size after updating an existing key", KvsMetrics().(KvsMetricsStruct).Size, 2)
+
+	Delete(existingKey.String())
+	assertMetric("size after deleting an existing key", KvsMetrics().(KvsMetricsStruct).Size, 1)
+
+	Get("")
+	Get("not-a-uuid")
+	Get(uuid.New().String())
+	Set(nil)
+	Update(uuid.New().String(), nil)
+
+	metrics := KvsMetrics().(KvsMetricsStruct)
+	assertMetric("operations", metrics.Operations, 9)
+	assertMetric("successful operations", metrics.SuccessfulOperations, 3)
+	assertMetric("missing_id failures", metrics.FailedOperations[missingIdReason], 1)
+	assertMetric("invalid_id failures", metrics.FailedOperations[invalidIdReason], 1)
+	assertMetric("nil_value failures", metrics.FailedOperations[nilValueReason], 2)
+	assertMetric("not_found failures", metrics.FailedOperations[notFoundReason], 2)
+}
+
+func TestGetInvalidId(t *testing.T) {
+	Start()
+	defer Stop()
+
+	v, err := Get("not-a-uuid")
+	if err == nil {
+		t.Errorf("Expected an error for an invalid id, got value %v", v)
+	}
+}
+
+// Run with -race to check that the metrics can be read while the store is in use.
+func TestConcurrentMetrics(t *testing.T) {
+	Start()
+	defer Stop()
+
+	const workers = 8
+	const opsPerWorker = 50
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				KvsMetrics()
+				GetStoreCopy()
+			}
+		}
+	}()
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < opsPerWorker; i++ {
+				id, _ := Set(fmt.Sprintf("worker %d value %d", w, i))
+				Update(id, i)
+				Get(id)
+				if i%2 == 0 {
+					Delete(id)
+					Delete(id)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(done)
+
+	metrics := KvsMetrics().(KvsMetricsStruct)
+	expectedSize := workers * opsPerWorker / 2
+	if metrics.Size != expectedSize || len(GetStoreCopy()) != expectedSize {
+		t.Errorf("Expected size %d, metrics report %d and store holds %d", expectedSize, metrics.Size, len(GetStoreCopy()))
+	}
+	expectedOps := workers * (opsPerWorker*3 + opsPerWorker)
+	if metrics.Operations != expectedOps {
+		t.Errorf("Expected %d operations, got %d", expectedOps, metrics.Operations)
+	}
+	if metrics.FailedOperations[notFoundReason] != workers*opsPerWorker/2 {
+		t.Errorf("Expected every second delete to miss, got %d not_found failures", metrics.FailedOperations[notFoundReason])
+	}
+}
+
 func BenchmarkKvs(b *testing.B) {
 	Start()
 	defer Stop()
@@ -140,3 +256,554 @@ func BenchmarkKvsParallel(b *testing.B) {
 
 	fmt.Printf("%d tests of %d passed\n", passCount, testCount)
 }
+
+func TestSlowLog(t *testing.T) {
+	Start()
+	defer Stop()
+	defer ApplyConfig(kvsConfig.StoreConfig{SlowLogThresholdMicros: 0, SlowLogSize: defaultSlowLogSize})
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		Set("value")
+		if got := SlowLog(); len(got) != 0 {
+			t.Errorf("Expected empty slow log, got %v", got)
+		}
+	})
+
+	t.Run("Records operations over the threshold", func(t *testing.T) {
+		SetSlowLogThreshold(time.Nanosecond)
+		id, _ := Set("value")
+		Get(id)
+
+		got := SlowLog()
+		if len(got) != 2 {
+			t.Fatalf("Expected 2 entries, got %v", got)
+		}
+		if got[0].Op != "get" || got[1].Op != "set" {
+			t.Errorf("Expected newest first, got %v", got)
+		}
+		for _, entry := range got {
+			if entry.Key != id || entry.ValueSize != 5 || entry.QueueWait+entry.Execution <= 0 {
+				t.Errorf("Unexpected entry %+v", entry)
+			}
+		}
+	})
+
+	t.Run("Keeps the newest entries", func(t *testing.T) {
+		ApplyConfig(kvsConfig.StoreConfig{SlowLogThresholdMicros: 0, SlowLogSize: 3})
+		SetSlowLogThreshold(time.Nanosecond)
+		lastId := SlowLog()[0].Id
+		for i := 0; i < 5; i++ {
+			Set(i)
+		}
+		got := SlowLog()
+		if len(got) != 3 || got[0].Id != lastId+5 || got[2].Id != lastId+3 {
+			t.Errorf("Expected the 3 newest entries, got %v", got)
+		}
+	})
+}
+
+func TestEviction(t *testing.T) {
+	defer applyLimits(kvsConfig.StoreConfig{})
+
+	fill := func(policy string, maxKeys int) []string {
+		Start()
+		applyLimits(kvsConfig.StoreConfig{MaxKeys: maxKeys, EvictionPolicy: policy})
+		ids := []string{}
+		for i := 0; i < maxKeys; i++ {
+			id, err := Set(i)
+			if err != nil {
+				t.Fatalf("Set returned err %v", err)
+			}
+			ids = append(ids, id)
+		}
+		return ids
+	}
+	assertStored := func(id string, want bool) {
+		t.Helper()
+		v, _ := Get(id)
+		if (v != nil) != want {
+			t.Errorf("Expected %s stored to be %v", id, want)
+		}
+	}
+
+	t.Run("Reject", func(t *testing.T) {
+		ids := fill("reject", 2)
+		defer Stop()
+		if _, err := Set("one too many"); err != ErrStoreFull {
+			t.Errorf("Expected ErrStoreFull, got %v", err)
+		}
+		if err := Update(ids[0], "replacing is fine"); err != nil {
+			t.Errorf("Expected update of an existing key to fit, got %v", err)
+		}
+		metrics := KvsMetrics().(KvsMetricsStruct)
+		if metrics.Size != 2 || metrics.FailedOperations[storeFullReason] != 1 {
+			t.Errorf("Unexpected metrics %+v", metrics)
+		}
+	})
+
+	t.Run("LRU", func(t *testing.T) {
+		ids := fill("lru", 3)
+		defer Stop()
+		Get(ids[0])
+		Set("evicts the least recently used")
+		assertStored(ids[0], true)
+		assertStored(ids[1], false)
+		if got := KvsMetrics().(KvsMetricsStruct).Evictions; got != 1 {
+			t.Errorf("Expected 1 eviction, got %d", got)
+		}
+	})
+
+	t.Run("LFU", func(t *testing.T) {
+		ids := fill("lfu", 3)
+		defer Stop()
+		Get(ids[0])
+		Get(ids[2])
+		Set("evicts the least frequently used")
+		assertStored(ids[1], false)
+		assertStored(ids[0], true)
+		assertStored(ids[2], true)
+	})
+
+	t.Run("Random", func(t *testing.T) {
+		fill("random", 3)
+		defer Stop()
+		id, err := Set("evicts any other key")
+		if err != nil || len(GetStoreCopy()) != 3 {
+			t.Errorf("Expected a key to be evicted, got err %v and %d keys", err, len(GetStoreCopy()))
+		}
+		assertStored(id, true)
+	})
+
+	t.Run("TTL", func(t *testing.T) {
+		Start()
+		defer Stop()
+		applyLimits(kvsConfig.StoreConfig{MaxKeys: 3, EvictionPolicy: "ttl"})
+		persistent, _ := Set("never expires")
+		later, _ := SetWithTTLContext(context.Background(), "later", time.Hour)
+		sooner, _ := SetWithTTLContext(context.Background(), "sooner", time.Minute)
+		Set("evicts the key expiring first")
+		assertStored(sooner, false)
+		assertStored(later, true)
+		assertStored(persistent, true)
+
+		Set("evicts the remaining expiring key")
+		if _, err := Set("nothing left to evict"); err != ErrStoreFull {
+			t.Errorf("Expected ErrStoreFull once no key has a ttl, got %v", err)
+		}
+	})
+
+	t.Run("Max bytes", func(t *testing.T) {
+		Start()
+		defer Stop()
+		applyLimits(kvsConfig.StoreConfig{MaxBytes: 3 * (keySize + 10), EvictionPolicy: "lru"})
+		for i := 0; i < 5; i++ {
+			Set("ten bytes!")
+		}
+		if got := KvsMetrics().(KvsMetricsStruct); got.Size != 3 || got.Bytes != 3*(keySize+10) {
+			t.Errorf("Expected 3 keys within the byte limit, got %+v", got)
+		}
+		if _, err := Set(strings.Repeat("x", 100)); err != ErrStoreFull {
+			t.Errorf("Expected a value over the byte limit to be rejected, got %v", err)
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	Start()
+	defer Stop()
+
+	id, _ := SetWithTTLContext(context.Background(), "short lived", 20*time.Millisecond)
+	kept, _ := Set("kept")
+	if v, _ := Get(id); v != "short lived" {
+		t.Errorf("Expected value before expiry, got %v", v)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if v, _ := Get(id); v != nil {
+		t.Errorf("Expected expired key to be gone, got %v", v)
+	}
+
+	UpdateWithTTLContext(context.Background(), kept, "swept", 20*time.Millisecond)
+	time.Sleep(expirySweepInterval + 100*time.Millisecond)
+	metrics := KvsMetrics().(KvsMetricsStruct)
+	if metrics.Size != 0 || metrics.Expired != 2 {
+		t.Errorf("Expected the sweep to remove the expired key, got %+v", metrics)
+	}
+}
+
+func TestTTLFromSeconds(t *testing.T) {
+	for seconds, want := range map[float64]time.Duration{
+		1.5:        1500 * time.Millisecond,
+		1e-9:       time.Nanosecond,
+		9223372036: 9223372036 * time.Second,
+	} {
+		if ttl, err := TTLFromSeconds(seconds); err != nil || ttl != want {
+			t.Errorf("Expected %v seconds to be %v, got %v, %v", seconds, want, ttl, err)
+		}
+	}
+	for _, seconds := range []float64{0, -1, 1e-12, 9223372037, 1e300, math.Inf(1), math.Inf(-1), math.NaN()} {
+		if ttl, err := TTLFromSeconds(seconds); err != ErrInvalidTTL {
+			t.Errorf("Expected %v seconds to be rejected, got %v, %v", seconds, ttl, err)
+		}
+	}
+}
+
+func TestSizeLimits(t *testing.T) {
+	Start()
+	defer Stop()
+	applyLimits(kvsConfig.StoreConfig{MaxValueBytes: 10, MaxKeyLength: 36})
+	defer applyLimits(kvsConfig.StoreConfig{})
+
+	id, err := Set("ten bytes!")
+	if err != nil {
+		t.Errorf("Expected a value at the limit to be stored, got %v", err)
+	}
+	if _, err := Set("eleven byte"); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge, got %v", err)
+	}
+	if err := Update(id, []interface{}{"six by", "six by"}); err != ErrValueTooLarge {
+		t.Errorf("Expected ErrValueTooLarge on update, got %v", err)
+	}
+	if _, err := Get(id + "0"); err != ErrKeyTooLong {
+		t.Errorf("Expected ErrKeyTooLong, got %v", err)
+	}
+	metrics := KvsMetrics().(KvsMetricsStruct)
+	if metrics.FailedOperations[valueTooLargeReason] != 2 || metrics.FailedOperations[keyTooLongReason] != 1 {
+		t.Errorf("Unexpected failures %v", metrics.FailedOperations)
+	}
+}
+
+func TestIncrement(t *testing.T) {
+	Start()
+	defer Stop()
+
+	t.Run("Concurrent increments are not lost", func(t *testing.T) {
+		id := uuid.New().String()
+		var wg sync.WaitGroup
+		for w := 0; w < 8; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; i < 100; i++ {
+					Increment(id, 2)
+					Decrement(id, 1)
+				}
+			}()
+		}
+		wg.Wait()
+		if v, _ := Get(id); v != json.Number("800") {
+			t.Errorf("Expected 800, got %v", v)
+		}
+	})
+
+	t.Run("Adds to stored numbers", func(t *testing.T) {
+		for _, test := range []struct {
+			stored interface{}
+			delta  json.Number
+			want   json.Number
+		}{
+			{3.0, "2", "5"},
+			{json.Number("1234567890123456789"), "1", "1234567890123456790"},
+			{json.Number("1.5"), "1", "2.5"},
+			{7, "-0.5", "6.5"},
+		} {
+			id, _ := Set(test.stored)
+			got, err := IncrementContext(context.Background(), id, test.delta)
+			if err != nil || got != test.want {
+				t.Errorf("Expected %v + %v = %v, got %v, %v", test.stored, test.delta, test.want, got, err)
+			}
+		}
+	})
+
+	t.Run("Fails on non-numeric values", func(t *testing.T) {
+		id, _ := Set("not a number")
+		if _, err := Increment(id, 1); err != ErrNotNumeric {
+			t.Errorf("Expected ErrNotNumeric, got %v", err)
+		}
+		if v, _ := Get(id); v != "not a number" {
+			t.Errorf("Expected value to be unchanged, got %v", v)
+		}
+		if _, err := IncrementContext(context.Background(), id, "one"); err != ErrNotNumeric {
+			t.Errorf("Expected ErrNotNumeric for a non-numeric delta, got %v", err)
+		}
+	})
+
+	t.Run("Fails on overflow", func(t *testing.T) {
+		id, _ := Set(json.Number("9223372036854775807"))
+		if _, err := Increment(id, 1); err != ErrOverflow {
+			t.Errorf("Expected ErrOverflow, got %v", err)
+		}
+	})
+}
+
+func TestPatch(t *testing.T) {
+	Start()
+	defer Stop()
+
+	id, _ := Set(map[string]interface{}{"name": "kvs", "tags": []interface{}{"a"}})
+	patch, _ := kvsDocument.ParseJsonPatch([]byte(`[{"op":"add","path":"/tags/-","value":"b"},{"op":"remove","path":"/name"}]`))
+	got, err := Patch(id, patch)
+	if err != nil {
+		t.Fatalf("Patch returned err %v", err)
+	}
+	want := map[string]interface{}{"tags": []interface{}{"a", "b"}}
+	if stored, _ := Get(id); !kvsDocument.Equal(got, want) || !kvsDocument.Equal(stored, want) {
+		t.Errorf("Expected %v, patch returned %v and store holds %v", want, got, stored)
+	}
+
+	failing, _ := kvsDocument.ParseJsonPatch([]byte(`[{"op":"add","path":"/x","value":1},{"op":"test","path":"/tags/0","value":"z"}]`))
+	if _, err := Patch(id, failing); !errors.Is(err, ErrPatchFailed) {
+		t.Errorf("Expected ErrPatchFailed, got %v", err)
+	}
+	if stored, _ := Get(id); !kvsDocument.Equal(stored, want) {
+		t.Errorf("Expected a failed patch to leave %v, got %v", want, stored)
+	}
+
+	if v, err := Patch(uuid.New().String(), kvsDocument.NewMergePatch(map[string]interface{}{})); v != nil || err != nil {
+		t.Errorf("Expected nil for a missing key, got %v, %v", v, err)
+	}
+	blobId, _ := Set(Blob{ContentType: "text/plain", Data: []byte("raw")})
+	if _, err := Patch(blobId, kvsDocument.NewMergePatch(map[string]interface{}{})); err != kvsDocument.ErrNotDocument {
+		t.Errorf("Expected ErrNotDocument, got %v", err)
+	}
+}
+
+func TestIndexes(t *testing.T) {
+	defer configureIndexes(nil)
+	alice := uuid.New()
+	configureIndexes([]kvsConfig.IndexConfig{{Name: "email", Path: "$.email"}})
+	Start(KvsStoreType{alice: map[string]interface{}{"email": "alice@example.com", "age": json.Number("30")}})
+	defer Stop()
+
+	ids := func(matches []IndexMatch, err error) string {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("QueryIndex returned err %v", err)
+		}
+		found := []string{}
+		for _, match := range matches {
+			found = append(found, match.Id)
+		}
+		return strings.Join(found, ",")
+	}
+
+	// Built from the initial state on Start
+	if got := ids(QueryIndex("email", IndexQuery{Eq: "alice@example.com"})); got != alice.String() {
+		t.Errorf("Expected alice, got %q", got)
+	}
+	bob, _ := Set(map[string]interface{}{"email": "bob@example.com", "age": 25})
+	if got := ids(QueryIndex("email", IndexQuery{Eq: "bob@example.com"})); got != bob {
+		t.Errorf("Expected bob after Set, got %q", got)
+	}
+	Update(bob, map[string]interface{}{"email": "robert@example.com"})
+	if got := ids(QueryIndex("email", IndexQuery{Eq: "bob@example.com"})); got != "" {
+		t.Errorf("Expected no match for the old email after Update, got %q", got)
+	}
+	if got := ids(QueryIndex("email", IndexQuery{Gte: "b", Lt: "s"})); got != bob {
+		t.Errorf("Expected bob in range, got %q", got)
+	}
+	Delete(bob)
+	if got := ids(QueryIndex("email", IndexQuery{})); got != alice.String() {
+		t.Errorf("Expected only alice after Delete, got %q", got)
+	}
+	if indexes := Namespaces()[0].Indexes; indexes["email"] != 1 {
+		t.Errorf("Expected 1 entry in the email index, got %v", indexes)
+	}
+
+	// Reconfiguring rebuilds the indexes over the stored values
+	configureIndexes([]kvsConfig.IndexConfig{{Name: "age", Path: "$.age"}, {Name: "tags", Path: "$.tags[*]"}})
+	carol, _ := Set(map[string]interface{}{"age": 41.5, "tags": []interface{}{"a", "b", "a"}})
+	dave, _ := Set(map[string]interface{}{"age": "unknown", "tags": []interface{}{"b"}})
+	if _, err := QueryIndex("email", IndexQuery{}); err != ErrUnknownIndex {
+		t.Errorf("Expected ErrUnknownIndex for a removed index, got %v", err)
+	}
+	if got := ids(QueryIndex("age", IndexQuery{Gt: json.Number("30")})); got != carol {
+		t.Errorf("Expected carol older than 30, got %q", got)
+	}
+	if got := ids(QueryIndex("age", IndexQuery{Lte: json.Number("30")})); got != alice.String() {
+		t.Errorf("Expected alice at most 30, got %q", got)
+	}
+	if got := ids(QueryIndex("age", IndexQuery{Eq: "unknown"})); got != dave {
+		t.Errorf("Expected dave with a string age, got %q", got)
+	}
+	matches, _ := QueryIndex("tags", IndexQuery{Eq: "b", Limit: 1})
+	if len(matches) != 1 {
+		t.Errorf("Expected limit to cap matches, got %v", matches)
+	}
+	if indexes := Namespaces()[0].Indexes; indexes["tags"] != 3 {
+		t.Errorf("Expected 3 entries in the tags index, got %v", indexes)
+	}
+	if _, err := QueryIndex("age", IndexQuery{Eq: 1, Gt: 0}); err != ErrInvalidIndexQuery {
+		t.Errorf("Expected ErrInvalidIndexQuery mixing eq and a range, got %v", err)
+	}
+	if _, err := QueryIndex("age", IndexQuery{Gt: 0, Lt: "z"}); err != ErrInvalidIndexQuery {
+		t.Errorf("Expected ErrInvalidIndexQuery for bounds of different kinds, got %v", err)
+	}
+}
+
+func TestScan(t *testing.T) {
+	Start()
+	defer Stop()
+	for i := 0; i < 25; i++ {
+		Set(map[string]interface{}{"n": i})
+	}
+	Set(Blob{ContentType: "text/plain", Data: []byte("raw")})
+
+	// Paging through everything visits each value once, in id order
+	seen := map[string]bool{}
+	cursor, last, pages := "", "", 0
+	for {
+		page, err := Scan(nil, cursor, 10)
+		if err != nil {
+			t.Fatalf("Scan returned err %v", err)
+		}
+		pages++
+		for _, item := range page.Items {
+			if seen[item.Id] || item.Id <= last {
+				t.Errorf("Expected ids in increasing order without repeats, got %s after %s", item.Id, last)
+			}
+			seen[item.Id] = true
+			last = item.Id
+		}
+		if cursor = page.Cursor; cursor == "" {
+			break
+		}
+	}
+	if len(seen) != 26 || pages != 3 {
+		t.Errorf("Expected 26 values in 3 pages, got %d in %d", len(seen), pages)
+	}
+
+	filter, _ := kvsDocument.ParseFilter("n >= 20")
+	page, _ := Scan(filter, "", 0)
+	if len(page.Items) != 5 || page.Cursor != "" {
+		t.Errorf("Expected 5 matches on a single page, got %+v", page)
+	}
+	if _, err := Scan(nil, "not-a-uuid", 10); err != ErrInvalidCursor {
+		t.Errorf("Expected ErrInvalidCursor, got %v", err)
+	}
+
+	for i := 0; i < MaxScanLimit; i++ {
+		Set(i)
+	}
+	if page, _ := Scan(nil, "", MaxScanLimit+1); len(page.Items) != MaxScanLimit || page.Cursor == "" {
+		t.Errorf("Expected a limit above MaxScanLimit to return %d items and a cursor, got %d", MaxScanLimit, len(page.Items))
+	}
+}
+
+func TestNamespaces(t *testing.T) {
+	defer configureNamespaces(nil)
+	configureNamespaces([]kvsConfig.NamespaceConfig{{Name: "tenant-a", MaxKeys: 1}})
+	Start()
+	defer Stop()
+	tenantA := WithNamespace(context.Background(), "tenant-a")
+
+	// The same id can hold different values in different namespaces
+	id, _ := Set("default value")
+	if err := UpdateContext(tenantA, id, "tenant value"); err != nil {
+		t.Fatalf("Update returned err %v", err)
+	}
+	if v, _ := Get(id); v != "default value" {
+		t.Errorf("Expected the default namespace untouched, got %v", v)
+	}
+	if v, _ := GetContext(tenantA, id); v != "tenant value" {
+		t.Errorf("Expected the tenant value, got %v", v)
+	}
+
+	// Limits are per namespace
+	if _, err := SetContext(tenantA, "one too many"); err != ErrStoreFull {
+		t.Errorf("Expected ErrStoreFull in tenant-a, got %v", err)
+	}
+	if _, err := Set("plenty of room"); err != nil {
+		t.Errorf("Expected room in the default namespace, got %v", err)
+	}
+
+	missing := WithNamespace(context.Background(), "missing")
+	if _, err := GetContext(missing, id); err != ErrUnknownNamespace {
+		t.Errorf("Expected ErrUnknownNamespace, got %v", err)
+	}
+	if err := CreateNamespace(context.Background(), kvsConfig.NamespaceConfig{Name: "tenant-a"}); err != ErrNamespaceExists {
+		t.Errorf("Expected ErrNamespaceExists, got %v", err)
+	}
+	if err := CreateNamespace(context.Background(), kvsConfig.NamespaceConfig{Name: "bad name"}); !errors.Is(err, ErrInvalidNamespace) {
+		t.Errorf("Expected ErrInvalidNamespace, got %v", err)
+	}
+	if err := CreateNamespace(context.Background(), kvsConfig.NamespaceConfig{Name: "missing"}); err != nil {
+		t.Fatalf("CreateNamespace returned err %v", err)
+	}
+	if v, err := GetContext(missing, id); v != nil || err != nil {
+		t.Errorf("Expected an empty namespace, got %v, %v", v, err)
+	}
+
+	infos := Namespaces()
+	if len(infos) != 3 || infos[0].Name != DefaultNamespace || infos[0].Keys != 2 || infos[2].Name != "tenant-a" || infos[2].MaxKeys != 1 {
+		t.Errorf("Unexpected namespaces %+v", infos)
+	}
+
+	// Dropping a namespace removes its values
+	if err := DropNamespace(context.Background(), "tenant-a"); err != nil {
+		t.Fatalf("DropNamespace returned err %v", err)
+	}
+	if _, err := GetContext(tenantA, id); err != ErrUnknownNamespace {
+		t.Errorf("Expected ErrUnknownNamespace after drop, got %v", err)
+	}
+	if size := KvsMetrics().(KvsMetricsStruct).Size; size != 2 {
+		t.Errorf("Expected the dropped keys to leave the store size, got %d", size)
+	}
+	if err := DropNamespace(context.Background(), DefaultNamespace); err != ErrDefaultNamespace {
+		t.Errorf("Expected ErrDefaultNamespace, got %v", err)
+	}
+	if err := DropNamespace(context.Background(), "tenant-a"); err != ErrUnknownNamespace {
+		t.Errorf("Expected ErrUnknownNamespace dropping twice, got %v", err)
+	}
+}
+
+func TestAudit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	if err := kvsAudit.Start(kvsConfig.AuditConfig{Path: path}); err != nil {
+		t.Fatalf("Audit Start returned err %v", err)
+	}
+	Start()
+	ctx := kvsAudit.WithSource(context.Background(), "tcp", "192.0.2.1:1000")
+	ctx = kvsAuth.WithIdentity(ctx, kvsAuth.Identity{Name: "alice"})
+
+	id, _ := SetContext(ctx, "v1")
+	UpdateContext(ctx, id, "v2")
+	Get(id)
+	DeleteContext(ctx, id)
+	DeleteContext(ctx, id)
+	counter := uuid.New().String()
+	IncrementContext(ctx, counter, "5")
+	CreateNamespace(ctx, kvsConfig.NamespaceConfig{Name: "scratch"})
+	SetContext(WithNamespace(ctx, "scratch"), "doomed")
+	DropNamespace(ctx, "scratch")
+	Stop()
+	kvsAudit.Close()
+
+	file, _ := os.Open(path)
+	defer file.Close()
+	if last, err := kvsAudit.Verify(file); err != nil || last.Seq != 6 {
+		t.Fatalf("Expected 6 intact entries, got %+v, %v", last, err)
+	}
+	file.Seek(0, 0)
+	decoder := json.NewDecoder(file)
+	var entries []kvsAudit.Entry
+	for decoder.More() {
+		var entry kvsAudit.Entry
+		decoder.Decode(&entry)
+		entries = append(entries, entry)
+	}
+	for i, expected := range []struct{ op, key string }{{"set", id}, {"update", id}, {"delete", id}, {"increment", counter}} {
+		entry := entries[i]
+		if entry.Operation != expected.op || entry.Key != expected.key || entry.Namespace != DefaultNamespace {
+			t.Errorf("Expected %s of %s, got %+v", expected.op, expected.key, entry)
+		}
+		if entry.Identity != "alice" || entry.Transport != "tcp" || entry.RemoteAddr != "192.0.2.1:1000" {
+			t.Errorf("Expected the source of the change, got %+v", entry)
+		}
+	}
+	if drop := entries[5]; drop.Operation != "dropNamespace" || drop.Namespace != "scratch" || drop.Key != "" || drop.Identity != "alice" {
+		t.Errorf("Expected the namespace drop to be recorded with its source, got %+v", drop)
+	}
+	if entries[0].OldHash != "" || entries[1].OldHash != entries[0].NewHash || entries[2].OldHash != entries[1].NewHash || entries[2].NewHash != "" {
+		t.Errorf("Expected each old hash to match the previous new hash, got %+v", entries[:3])
+	}
+}
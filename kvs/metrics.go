@@ -0,0 +1,168 @@
+package kvs
+
+import (
+	"expvar"
+	"gokvs/kvsMetrics"
+	"sync"
+	"sync/atomic"
+)
+
+// Reasons an operation is counted as failed
+const (
+	missingIdReason     = "missing_id"
+	invalidIdReason     = "invalid_id"
+	nilValueReason      = "nil_value"
+	notFoundReason      = "not_found"
+	storeFullReason     = "store_full"
+	valueTooLargeReason = "value_too_large"
+	keyTooLongReason    = "key_too_long"
+	notNumericReason    = "not_numeric"
+	overflowReason      = "overflow"
+	patchFailedReason   = "patch_failed"
+	notDocumentReason   = "not_document"
+	unknownIndexReason  = "unknown_index"
+	invalidQueryReason  = "invalid_query"
+	invalidCursorReason = "invalid_cursor"
+	unknownNsReason     = "unknown_namespace"
+)
+
+var failureReasons = []string{
+	missingIdReason, invalidIdReason, nilValueReason, notFoundReason,
+	storeFullReason, valueTooLargeReason, keyTooLongReason, notNumericReason, overflowReason,
+	patchFailedReason, notDocumentReason, unknownIndexReason, invalidQueryReason,
+	invalidCursorReason, unknownNsReason,
+}
+
+type KvsMetricsStruct struct {
+	Size                 int
+	Bytes                int64
+	Operations           int
+	SuccessfulOperations int
+	FailedOperations     map[string]int
+	Evictions            int
+	Expired              int
+}
+
+/*
+ *	All counters are atomics so they can be read from any goroutine. kvsSize and
+ *	kvsBytes total every namespace and are only written by the store goroutine,
+ *	straight after it mutates a namespace; the operation counters are written
+ *	by the callers of the accessors.
+ */
+var kvsSize int64
+var kvsBytes int64
+var kvsOps int64
+var kvsSuccessfulOps int64
+var kvsFailedOps = map[string]*int64{}
+var kvsEvictions int64
+var kvsExpired int64
+
+var publishExpvar sync.Once
+
+var storeFailedOperations = kvsMetrics.NewCounterVec(
+	"kvs_store_failed_operations_total",
+	"Store operations that failed, by operation and reason.",
+	"op", "reason",
+)
+
+var storeEvictions = kvsMetrics.NewCounterVec(
+	"kvs_store_evictions_total",
+	"Keys evicted to stay within the store limits, by namespace and eviction policy.",
+	"namespace", "policy",
+)
+
+var storeExpired = kvsMetrics.NewCounterVec(
+	"kvs_store_expired_total",
+	"Keys removed because their ttl ran out, by namespace.",
+	"namespace",
+)
+
+var _ = kvsMetrics.NewGaugeVecFunc(
+	"kvs_store_keys",
+	"Keys currently in the store, by namespace.",
+	func() []kvsMetrics.Sample {
+		return namespaceSamples(func(info NamespaceInfo) int64 { return info.Keys })
+	},
+	"namespace",
+)
+
+var _ = kvsMetrics.NewGaugeVecFunc(
+	"kvs_store_bytes",
+	"Approximate size of the keys and values in the store, in bytes, by namespace.",
+	func() []kvsMetrics.Sample {
+		return namespaceSamples(func(info NamespaceInfo) int64 { return info.Bytes })
+	},
+	"namespace",
+)
+
+func namespaceSamples(value func(NamespaceInfo) int64) []kvsMetrics.Sample {
+	infos := Namespaces()
+	samples := make([]kvsMetrics.Sample, 0, len(infos))
+	for _, info := range infos {
+		samples = append(samples, kvsMetrics.Sample{LabelValues: []string{info.Name}, Value: float64(value(info))})
+	}
+	return samples
+}
+
+func init() {
+	for _, reason := range failureReasons {
+		kvsFailedOps[reason] = new(int64)
+	}
+}
+
+func resetMetrics() {
+	atomic.StoreInt64(&kvsSize, 0)
+	atomic.StoreInt64(&kvsBytes, 0)
+	atomic.StoreInt64(&kvsEvictions, 0)
+	atomic.StoreInt64(&kvsExpired, 0)
+	atomic.StoreInt64(&kvsOps, 0)
+	atomic.StoreInt64(&kvsSuccessfulOps, 0)
+	for _, counter := range kvsFailedOps {
+		atomic.StoreInt64(counter, 0)
+	}
+
+	// ExpVars. Start may be called more than once, e.g. in tests.
+	publishExpvar.Do(func() {
+		expvar.Publish("Kvs Metrics", expvar.Func(KvsMetrics))
+	})
+}
+
+// Counts an operation as successful, or as failed for reason when it is not empty.
+func registerResult(actionType actionType, reason string) {
+	atomic.AddInt64(&kvsOps, 1)
+	if reason == "" {
+		atomic.AddInt64(&kvsSuccessfulOps, 1)
+		return
+	}
+	atomic.AddInt64(kvsFailedOps[reason], 1)
+	storeFailedOperations.Inc(actionType.String(), reason)
+}
+
+func registerEviction(ns *namespace, policy string) {
+	atomic.AddInt64(&ns.evictions, 1)
+	atomic.AddInt64(&kvsEvictions, 1)
+	storeEvictions.Inc(ns.name, policy)
+}
+
+func registerExpiry(ns *namespace) {
+	atomic.AddInt64(&ns.expired, 1)
+	atomic.AddInt64(&kvsExpired, 1)
+	storeExpired.Inc(ns.name)
+}
+
+// Function to describe exported metrics.
+func KvsMetrics() interface{} {
+	failed := make(map[string]int, len(kvsFailedOps))
+	for reason, counter := range kvsFailedOps {
+		failed[reason] = int(atomic.LoadInt64(counter))
+	}
+	return KvsMetricsStruct{
+		Size:                 int(atomic.LoadInt64(&kvsSize)),
+		Bytes:                atomic.LoadInt64(&kvsBytes),
+		Operations:           int(atomic.LoadInt64(&kvsOps)),
+		SuccessfulOperations: int(atomic.LoadInt64(&kvsSuccessfulOps)),
+		FailedOperations:     failed,
+		Evictions:            int(atomic.LoadInt64(&kvsEvictions)),
+		Expired:              int(atomic.LoadInt64(&kvsExpired)),
+	}
+}
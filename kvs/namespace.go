@@ -0,0 +1,214 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gokvs/kvsConfig"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	uuid "github.com/google/uuid"
+)
+
+const DefaultNamespace = kvsConfig.DefaultNamespace
+
+var ErrUnknownNamespace = errors.New("Namespace does not exist.")
+var ErrNamespaceExists = errors.New("Namespace already exists.")
+var ErrInvalidNamespace = errors.New("Invalid namespace")
+var ErrDefaultNamespace = errors.New("The default namespace cannot be dropped.")
+
+/*
+ *	A separate keyspace with its own limits, indexes and metrics. Every
+ *	namespace lives in the one store goroutine, which alone touches entries
+ *	and expiringKeys. The counters are atomics so metrics can read them.
+ */
+type namespace struct {
+	name         string
+	entries      map[uuid.UUID]*storeEntry
+	expiringKeys int // Keys with an expiry, so the sweep can skip namespaces with none
+	limits       storeLimits
+	indexes      []*index
+
+	keys      int64
+	bytes     int64
+	evictions int64
+	expired   int64
+}
+
+/*
+ *	namespaces, and the indexes of each namespace, are only replaced by Start
+ *	and by the store goroutine, under namespacesMutex so metrics and the
+ *	accessors can read them; the store goroutine reads them without the lock.
+ *	Limits can be changed from any goroutine, so they are always read under
+ *	the lock.
+ */
+var namespaces = map[string]*namespace{}
+var namespacesMutex sync.RWMutex
+
+// Applied to the default namespace, and namespaces declared in the config
+var defaultLimits = storeLimits{policy: rejectPolicy}
+var namespaceDefinitions []kvsConfig.NamespaceConfig
+
+func newNamespace(name string, limits storeLimits) *namespace {
+	ns := &namespace{name: name, entries: map[uuid.UUID]*storeEntry{}, limits: limits}
+	ns.indexes = buildIndexes(ns)
+	return ns
+}
+
+func limitsOfConfig(cfg kvsConfig.NamespaceConfig) storeLimits {
+	limits := storeLimits{
+		maxKeys:       cfg.MaxKeys,
+		maxBytes:      cfg.MaxBytes,
+		policy:        cfg.EvictionPolicy,
+		maxValueBytes: cfg.MaxValueBytes,
+		maxKeyLength:  cfg.MaxKeyLength,
+	}
+	if limits.policy == "" {
+		limits.policy = rejectPolicy
+	}
+	return limits
+}
+
+func (l storeLimits) config(name string) kvsConfig.NamespaceConfig {
+	return kvsConfig.NamespaceConfig{
+		Name:           name,
+		MaxKeys:        l.maxKeys,
+		MaxBytes:       l.maxBytes,
+		EvictionPolicy: l.policy,
+		MaxValueBytes:  l.maxValueBytes,
+		MaxKeyLength:   l.maxKeyLength,
+	}
+}
+
+func (ns *namespace) currentLimits() storeLimits {
+	namespacesMutex.RLock()
+	defer namespacesMutex.RUnlock()
+	return ns.limits
+}
+
+type namespaceContextKey struct{}
+
+// Returns a copy of ctx addressing the namespace name. An empty name is the default namespace.
+func WithNamespace(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, namespaceContextKey{}, name)
+}
+
+// The namespace operations with ctx apply to, DefaultNamespace unless set by WithNamespace.
+func NamespaceFrom(ctx context.Context) string {
+	if name, ok := ctx.Value(namespaceContextKey{}).(string); ok && name != "" {
+		return name
+	}
+	return DefaultNamespace
+}
+
+/*
+ *	Only called from the store goroutine. Creates the namespace, or with
+ *	replace changes the limits of an existing one.
+ */
+func defineNamespaceKvs(cfg kvsConfig.NamespaceConfig, replace bool) error {
+	namespacesMutex.Lock()
+	defer namespacesMutex.Unlock()
+	if ns, ok := namespaces[cfg.Name]; ok {
+		if !replace {
+			return ErrNamespaceExists
+		}
+		ns.limits = limitsOfConfig(cfg)
+		return nil
+	}
+	namespaces[cfg.Name] = newNamespace(cfg.Name, limitsOfConfig(cfg))
+	return nil
+}
+
+// Only called from the store goroutine.
+func dropNamespaceKvs(name string) error {
+	if name == DefaultNamespace {
+		return ErrDefaultNamespace
+	}
+	namespacesMutex.Lock()
+	defer namespacesMutex.Unlock()
+	ns, ok := namespaces[name]
+	if !ok {
+		return ErrUnknownNamespace
+	}
+	delete(namespaces, name)
+	atomic.AddInt64(&kvsSize, -atomic.LoadInt64(&ns.keys))
+	atomic.AddInt64(&kvsBytes, -atomic.LoadInt64(&ns.bytes))
+	return nil
+}
+
+/*
+ *	Creates the namespaces declared in the config and updates the limits of
+ *	those that exist. Namespaces missing from definitions are kept, so a
+ *	config change never drops data.
+ */
+func configureNamespaces(definitions []kvsConfig.NamespaceConfig) {
+	namespacesMutex.Lock()
+	namespaceDefinitions = append([]kvsConfig.NamespaceConfig{}, definitions...)
+	namespacesMutex.Unlock()
+	if atomic.LoadInt32(&running) != 1 {
+		return
+	}
+	for _, definition := range definitions {
+		doAction(context.Background(), Action{actionType: defineNamespaceActionType, val: namespaceDefinition{definition, true}})
+	}
+}
+
+// Carried by a defineNamespaceActionType
+type namespaceDefinition struct {
+	cfg     kvsConfig.NamespaceConfig
+	replace bool
+}
+
+// Creates an empty namespace. Fails with ErrNamespaceExists if it already exists.
+func CreateNamespace(ctx context.Context, cfg kvsConfig.NamespaceConfig) error {
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidNamespace, err)
+	}
+	return doAction(ctx, Action{actionType: defineNamespaceActionType, val: namespaceDefinition{cfg, false}}).err
+}
+
+// Drops a namespace and everything stored in it.
+func DropNamespace(ctx context.Context, name string) error {
+	return doAction(ctx, Action{actionType: dropNamespaceActionType, id: name}).err
+}
+
+func HasNamespace(name string) bool {
+	namespacesMutex.RLock()
+	defer namespacesMutex.RUnlock()
+	_, ok := namespaces[name]
+	return ok
+}
+
+type NamespaceInfo struct {
+	kvsConfig.NamespaceConfig
+	Keys      int64            `json:"keys"`
+	Bytes     int64            `json:"bytes"`
+	Evictions int64            `json:"evictions"`
+	Expired   int64            `json:"expired"`
+	Indexes   map[string]int64 `json:"indexes"` // Values in each index
+}
+
+// Lists the namespaces, sorted by name.
+func Namespaces() []NamespaceInfo {
+	namespacesMutex.RLock()
+	defer namespacesMutex.RUnlock()
+	infos := make([]NamespaceInfo, 0, len(namespaces))
+	for _, ns := range namespaces {
+		info := NamespaceInfo{
+			NamespaceConfig: ns.limits.config(ns.name),
+			Keys:            atomic.LoadInt64(&ns.keys),
+			Bytes:           atomic.LoadInt64(&ns.bytes),
+			Evictions:       atomic.LoadInt64(&ns.evictions),
+			Expired:         atomic.LoadInt64(&ns.expired),
+			Indexes:         make(map[string]int64, len(ns.indexes)),
+		}
+		for _, ix := range ns.indexes {
+			info.Indexes[ix.name] = atomic.LoadInt64(&ix.entries)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
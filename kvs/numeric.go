@@ -0,0 +1,152 @@
+package kvs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"gokvs/kvsTracing"
+	"math"
+	"strconv"
+
+	uuid "github.com/google/uuid"
+)
+
+var ErrNotNumeric = errors.New("Value is not a number.")
+var ErrOverflow = errors.New("Increment would overflow.")
+
+// Integral floats within this bound are added as integers
+const maxSafeInteger = 1 << 53
+
+/*
+ *	Reads a stored value or a delta as a number. Integers, including floats
+ *	with no fractional part, are reported with isInt so they can be added
+ *	exactly.
+ */
+func toNumber(value interface{}) (i int64, f float64, isInt bool, err error) {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i, float64(i), true, nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return 0, 0, false, ErrNotNumeric
+		}
+		return 0, f, false, nil
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) <= maxSafeInteger {
+			return int64(v), v, true, nil
+		}
+		return 0, v, false, nil
+	case int:
+		return int64(v), float64(v), true, nil
+	case int64:
+		return v, float64(v), true, nil
+	case int32:
+		return int64(v), float64(v), true, nil
+	}
+	return 0, 0, false, ErrNotNumeric
+}
+
+// Adds delta to current. Results are json.Numbers so they round-trip exactly.
+func addNumbers(current, delta interface{}) (json.Number, error) {
+	currentInt, currentFloat, currentIsInt, err := toNumber(current)
+	if err != nil {
+		return "", err
+	}
+	deltaInt, deltaFloat, deltaIsInt, err := toNumber(delta)
+	if err != nil {
+		return "", err
+	}
+	if currentIsInt && deltaIsInt {
+		sum := currentInt + deltaInt
+		if (deltaInt > 0 && sum < currentInt) || (deltaInt < 0 && sum > currentInt) {
+			return "", ErrOverflow
+		}
+		return json.Number(strconv.FormatInt(sum, 10)), nil
+	}
+	sum := currentFloat + deltaFloat
+	if math.IsInf(sum, 0) || math.IsNaN(sum) {
+		return "", ErrOverflow
+	}
+	return json.Number(strconv.FormatFloat(sum, 'g', -1, 64)), nil
+}
+
+/*
+ *	Only called from the store goroutine, so the read and the write cannot
+ *	interleave with other writers. A missing key is created holding delta.
+ *	The expiry of an existing key is kept.
+ */
+func incrementKvs(ns *namespace, keyToIncrement string, delta json.Number) (json.Number, bool, error) {
+	uuidToIncrement, parseError := uuid.Parse(keyToIncrement)
+	if parseError != nil {
+		return "", false, parseError
+	}
+	old, found := lookup(ns, uuidToIncrement)
+	var current interface{} = json.Number("0")
+	if found {
+		current = old.val
+	}
+	sum, err := addNumbers(current, delta)
+	if err != nil {
+		return "", found, err
+	}
+	entry := newEntry(sum, 0)
+	if found {
+		entry.expiresAt = old.expiresAt
+		entry.hits = old.hits
+	}
+	if err := makeRoom(ns, uuidToIncrement, entry); err != nil {
+		return "", found, err
+	}
+	putEntry(ns, uuidToIncrement, entry)
+	return sum, found, nil
+}
+
+func Increment(id string, delta int64) (json.Number, error) {
+	return IncrementContext(context.Background(), id, json.Number(strconv.FormatInt(delta, 10)))
+}
+
+func Decrement(id string, delta int64) (json.Number, error) {
+	if delta == math.MinInt64 {
+		return "", ErrOverflow
+	}
+	return Increment(id, -delta)
+}
+
+/*
+ *	Adds delta, an integer or a float, to the number stored under id and
+ *	returns the result. Fails with ErrNotNumeric if either is not a number.
+ */
+func IncrementContext(ctx context.Context, id string, delta json.Number) (json.Number, error) {
+	ctx, span := startAccessorSpan(ctx, incrementActionType, id)
+	defer span.End()
+	if id == "" {
+		span.RecordError(errNoId)
+		registerResult(incrementActionType, missingIdReason)
+		return "", errNoId
+	}
+	if err := CheckKeyLength(ctx, id); err != nil {
+		span.RecordError(err)
+		registerResult(incrementActionType, failureReason(err))
+		return "", err
+	}
+	if _, _, _, err := toNumber(delta); err != nil {
+		span.RecordError(err)
+		registerResult(incrementActionType, failureReason(err))
+		return "", err
+	}
+	reply := doAction(ctx, Action{
+		actionType: incrementActionType,
+		id:         id,
+		val:        delta,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(incrementActionType, failureReason(reply.err))
+		return "", reply.err
+	}
+	span.SetAttributes(kvsTracing.Attribute{Key: "kvs.found", Value: reply.found})
+	registerResult(incrementActionType, "")
+	return reply.val.(json.Number), nil
+}
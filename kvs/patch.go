@@ -0,0 +1,90 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"gokvs/kvsDocument"
+	"gokvs/kvsTracing"
+
+	uuid "github.com/google/uuid"
+)
+
+var ErrPatchFailed = errors.New("Patch could not be applied")
+
+/*
+ *	Only called from the store goroutine, so no write can land between reading
+ *	the document and storing the patched copy. The expiry of the key is kept.
+ */
+func patchKvs(ns *namespace, keyToPatch string, patch kvsDocument.Patch) (interface{}, bool, error) {
+	uuidToPatch, parseError := uuid.Parse(keyToPatch)
+	if parseError != nil {
+		return nil, false, parseError
+	}
+	old, found := lookup(ns, uuidToPatch)
+	if !found {
+		return nil, false, nil
+	}
+	if _, ok := old.val.(Blob); ok {
+		return nil, true, kvsDocument.ErrNotDocument
+	}
+	patched, err := patch.Apply(old.val)
+	if err != nil {
+		return nil, true, fmt.Errorf("%w: %v", ErrPatchFailed, err)
+	}
+	if patched == nil {
+		return nil, true, errNilValue
+	}
+	if err := ns.currentLimits().checkValueSize(patched); err != nil {
+		return nil, true, err
+	}
+	entry := newEntry(patched, 0)
+	entry.expiresAt = old.expiresAt
+	entry.hits = old.hits
+	if err := makeRoom(ns, uuidToPatch, entry); err != nil {
+		return nil, true, err
+	}
+	putEntry(ns, uuidToPatch, entry)
+	return patched, true, nil
+}
+
+func Patch(id string, patch kvsDocument.Patch) (interface{}, error) {
+	return PatchContext(context.Background(), id, patch)
+}
+
+/*
+ *	Applies patch to the JSON document stored under id and returns the patched
+ *	document, or nil if id does not exist. A patch that cannot be applied fails
+ *	with an error wrapping ErrPatchFailed and leaves the document unchanged.
+ */
+func PatchContext(ctx context.Context, id string, patch kvsDocument.Patch) (interface{}, error) {
+	ctx, span := startAccessorSpan(ctx, patchActionType, id)
+	defer span.End()
+	if id == "" {
+		span.RecordError(errNoId)
+		registerResult(patchActionType, missingIdReason)
+		return nil, errNoId
+	}
+	if err := CheckKeyLength(ctx, id); err != nil {
+		span.RecordError(err)
+		registerResult(patchActionType, failureReason(err))
+		return nil, err
+	}
+	reply := doAction(ctx, Action{
+		actionType: patchActionType,
+		id:         id,
+		val:        patch,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(patchActionType, failureReason(reply.err))
+		return nil, reply.err
+	}
+	span.SetAttributes(kvsTracing.Attribute{Key: "kvs.found", Value: reply.found})
+	if !reply.found {
+		registerResult(patchActionType, notFoundReason)
+		return nil, nil
+	}
+	registerResult(patchActionType, "")
+	return reply.val, nil
+}
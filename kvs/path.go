@@ -0,0 +1,38 @@
+package kvs
+
+import (
+	"context"
+	"errors"
+	"gokvs/kvsDocument"
+)
+
+var ErrPathNotFound = errors.New("Path does not exist in value.")
+
+func GetPath(id string, path kvsDocument.Path) (interface{}, bool, error) {
+	return GetPathContext(context.Background(), id, path)
+}
+
+/*
+ *	Returns the part of the JSON document stored under id selected by path,
+ *	and whether id exists. A definite path returns the single value it names,
+ *	or ErrPathNotFound; any other path returns the list of matches. Stored
+ *	values are never modified in place, so the selection runs outside the
+ *	store goroutine.
+ */
+func GetPathContext(ctx context.Context, id string, path kvsDocument.Path) (interface{}, bool, error) {
+	val, err := GetContext(ctx, id)
+	if err != nil || val == nil {
+		return nil, false, err
+	}
+	if _, ok := val.(Blob); ok {
+		return nil, true, kvsDocument.ErrNotDocument
+	}
+	matches := path.Select(val)
+	if !path.Definite() {
+		return matches, true, nil
+	}
+	if len(matches) == 0 {
+		return nil, true, ErrPathNotFound
+	}
+	return matches[0], true, nil
+}
@@ -0,0 +1,143 @@
+package kvs
+
+import (
+	"bytes"
+	"container/heap"
+	"context"
+	"errors"
+	"gokvs/kvsDocument"
+	"sort"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor.")
+
+const DefaultScanLimit = 100
+
+/*
+ *	Largest page Scan returns. A page is built whole in the store goroutine,
+ *	which blocks every other operation while it walks the namespace, so pages
+ *	are kept small.
+ */
+const MaxScanLimit = 1000
+
+type ScanItem struct {
+	Id    string      `json:"id"`
+	Value interface{} `json:"value"`
+}
+
+/*
+ *	A page of values in id order. Cursor is the last id on the page, passed
+ *	back to Scan to continue after it, and empty on the last page.
+ */
+type ScanPage struct {
+	Items  []ScanItem `json:"items"`
+	Cursor string     `json:"cursor,omitempty"`
+}
+
+type scanRequest struct {
+	filter kvsDocument.Filter
+	after  *uuid.UUID
+	limit  int
+}
+
+// A max-heap of ids, so the largest can be dropped once there are enough.
+type idHeap []uuid.UUID
+
+func (h idHeap) Len() int            { return len(h) }
+func (h idHeap) Less(i, j int) bool  { return bytes.Compare(h[i][:], h[j][:]) > 0 }
+func (h idHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *idHeap) Push(x interface{}) { *h = append(*h, x.(uuid.UUID)) }
+func (h *idHeap) Pop() interface{} {
+	old := *h
+	id := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return id
+}
+
+/*
+ *	Only called from the store goroutine. Every entry is visited, but only the
+ *	ids of the limit+1 smallest matches after the cursor are held, so a page
+ *	costs memory in proportion to its size rather than to the store. Raw
+ *	values only match when there is no filter.
+ */
+func scanKvs(ns *namespace, request scanRequest) ScanPage {
+	now := time.Now()
+	matches := &idHeap{}
+	for id, entry := range ns.entries {
+		if request.after != nil && bytes.Compare(id[:], request.after[:]) <= 0 {
+			continue
+		}
+		if entry.expiredAt(now) {
+			continue
+		}
+		if request.filter != nil {
+			if _, ok := entry.val.(Blob); ok || !request.filter.Match(entry.val) {
+				continue
+			}
+		}
+		heap.Push(matches, id)
+		if matches.Len() > request.limit+1 {
+			heap.Pop(matches)
+		}
+	}
+
+	ids := *matches
+	sort.Slice(ids, func(i, j int) bool { return bytes.Compare(ids[i][:], ids[j][:]) < 0 })
+	page := ScanPage{Items: make([]ScanItem, 0, len(ids))}
+	if len(ids) > request.limit {
+		ids = ids[:request.limit]
+		page.Cursor = ids[len(ids)-1].String()
+	}
+	for _, id := range ids {
+		page.Items = append(page.Items, ScanItem{Id: id.String(), Value: ns.entries[id].val})
+	}
+	return page
+}
+
+func Scan(filter kvsDocument.Filter, cursor string, limit int) (ScanPage, error) {
+	return ScanContext(context.Background(), filter, cursor, limit)
+}
+
+/*
+ *	Returns up to limit values matching filter, which may be nil to match
+ *	everything, with ids after cursor. An empty cursor starts from the
+ *	beginning, a limit of 0 or less means DefaultScanLimit and one above
+ *	MaxScanLimit means MaxScanLimit. Pages are not
+ *	a snapshot: values written between pages show up if their id is after
+ *	the cursor.
+ */
+func ScanContext(ctx context.Context, filter kvsDocument.Filter, cursor string, limit int) (ScanPage, error) {
+	ctx, span := startAccessorSpan(ctx, scanActionType, "")
+	defer span.End()
+	request := scanRequest{filter: filter, limit: limit}
+	if request.limit <= 0 {
+		request.limit = DefaultScanLimit
+	}
+	if request.limit > MaxScanLimit {
+		request.limit = MaxScanLimit
+	}
+	if cursor != "" {
+		after, err := uuid.Parse(cursor)
+		if err != nil {
+			span.RecordError(ErrInvalidCursor)
+			registerResult(scanActionType, failureReason(ErrInvalidCursor))
+			return ScanPage{}, ErrInvalidCursor
+		}
+		request.after = &after
+	}
+	reply := doAction(ctx, Action{
+		actionType: scanActionType,
+		id:         cursor,
+		val:        request,
+	})
+	if reply.err != nil {
+		span.RecordError(reply.err)
+		registerResult(scanActionType, failureReason(reply.err))
+		return ScanPage{}, reply.err
+	}
+	registerResult(scanActionType, "")
+	return reply.val.(ScanPage), nil
+}
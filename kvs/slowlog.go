@@ -0,0 +1,112 @@
+package kvs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+ *	Operations taking longer than the threshold, from being queued on
+ *	actionChannel to the store goroutine's reply, are kept in a ring buffer.
+ *	QueueWait is the time spent waiting for the store goroutine to pick the
+ *	action up and Execution the time from then until the reply.
+ */
+type SlowLogEntry struct {
+	Id        int64         `json:"id"`
+	Time      time.Time     `json:"time"`
+	Op        string        `json:"op"`
+	Key       string        `json:"key"`
+	ValueSize int64         `json:"valueSize"`
+	QueueWait time.Duration `json:"queueWaitNs"`
+	Execution time.Duration `json:"executionNs"`
+}
+
+const defaultSlowLogSize = 128
+
+// In nanoseconds, 0 disables the slow log
+var slowLogThreshold int64
+
+var slowLogMutex sync.Mutex
+var slowLogRing = make([]SlowLogEntry, defaultSlowLogSize)
+var slowLogNext int
+var slowLogCount int
+var slowLogLastId int64
+
+func SetSlowLogThreshold(threshold time.Duration) {
+	atomic.StoreInt64(&slowLogThreshold, int64(threshold))
+}
+
+// Changes the capacity of the ring, keeping the newest entries that still fit.
+func resizeSlowLog(size int) {
+	if size <= 0 {
+		return
+	}
+	slowLogMutex.Lock()
+	defer slowLogMutex.Unlock()
+	if size == len(slowLogRing) {
+		return
+	}
+	entries := slowLogEntries()
+	if len(entries) > size {
+		entries = entries[:size]
+	}
+	slowLogRing = make([]SlowLogEntry, size)
+	slowLogCount = len(entries)
+	slowLogNext = slowLogCount % size
+	for i, entry := range entries {
+		slowLogRing[slowLogCount-1-i] = entry
+	}
+}
+
+func resetSlowLog() {
+	slowLogMutex.Lock()
+	defer slowLogMutex.Unlock()
+	slowLogNext = 0
+	slowLogCount = 0
+}
+
+/*
+ *	Records action if it was slower than the threshold. valueSize is only
+ *	called for slow actions, it walks the whole value.
+ */
+func recordSlowAction(action Action, key string, valueSize func() int64, enqueued, pickedUp, replied time.Time) {
+	threshold := atomic.LoadInt64(&slowLogThreshold)
+	if threshold <= 0 || replied.Sub(enqueued) < time.Duration(threshold) {
+		return
+	}
+	entry := SlowLogEntry{
+		Time:      enqueued,
+		Op:        action.actionType.String(),
+		Key:       key,
+		ValueSize: valueSize(),
+		QueueWait: pickedUp.Sub(enqueued),
+		Execution: replied.Sub(pickedUp),
+	}
+
+	slowLogMutex.Lock()
+	defer slowLogMutex.Unlock()
+	slowLogLastId++
+	entry.Id = slowLogLastId
+	slowLogRing[slowLogNext] = entry
+	slowLogNext = (slowLogNext + 1) % len(slowLogRing)
+	if slowLogCount < len(slowLogRing) {
+		slowLogCount++
+	}
+}
+
+// Must be called with slowLogMutex held. Newest first.
+func slowLogEntries() []SlowLogEntry {
+	entries := make([]SlowLogEntry, 0, slowLogCount)
+	for i := 1; i <= slowLogCount; i++ {
+		entries = append(entries, slowLogRing[(slowLogNext-i+len(slowLogRing))%len(slowLogRing)])
+	}
+	return entries
+}
+
+// Returns the recorded slow operations, newest first.
+func SlowLog() []SlowLogEntry {
+	slowLogMutex.Lock()
+	defer slowLogMutex.Unlock()
+	return slowLogEntries()
+}
@@ -0,0 +1,32 @@
+package kvs
+
+import "mime"
+
+const JsonContentType = "application/json"
+const DefaultBinaryContentType = "application/octet-stream"
+
+/*
+ *	Raw bytes stored with their content type, returned to clients verbatim.
+ *	Any other value is a decoded JSON value of type JsonContentType.
+ */
+type Blob struct {
+	ContentType string
+	Data        []byte
+}
+
+// Returns the content type a stored value is served as.
+func ContentTypeOf(value interface{}) string {
+	if blob, ok := value.(Blob); ok {
+		return blob.ContentType
+	}
+	return JsonContentType
+}
+
+// Reports whether contentType, which may carry parameters, names JSON. Empty counts as JSON.
+func IsJsonContentType(contentType string) bool {
+	if contentType == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == JsonContentType
+}
@@ -0,0 +1,232 @@
+package kvsAdminServer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"gokvs/kvs"
+	"gokvs/kvsAudit"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsLogger"
+	"gokvs/kvsTcpServer"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Returned by /store
+type StoreStats struct {
+	Store      interface{} `json:"store"`
+	Goroutines int         `json:"goroutines"`
+	HeapAlloc  uint64      `json:"heapAllocBytes"`
+	HeapInuse  uint64      `json:"heapInuseBytes"`
+	NumGC      uint32      `json:"numGC"`
+}
+
+func writeJson(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(value); err != nil {
+		kvsLogger.Error("Admin encoding error", "err", err)
+	}
+}
+
+/*
+ *	When kvsAuth requires it, refuses requests without a valid API key or
+ *	token in "Authorization: Bearer ..." with 401, as the HTTP server does.
+ */
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := kvsAudit.WithSource(req.Context(), "admin", req.RemoteAddr)
+		if kvsAuth.Required() {
+			identity, err := kvsAuth.Authenticate(kvsAuth.BearerCredential(req.Header.Get("Authorization")))
+			if err != nil {
+				kvsLogger.Warn("Admin authentication failed", "remoteAddr", req.RemoteAddr, "err", err)
+				kvsAuth.RegisterFailure("admin", err)
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gokvs"`)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+			ctx = kvsAuth.WithIdentity(ctx, identity)
+			ctx = kvsLogger.NewContext(ctx, kvsLogger.FromContext(ctx).With("identity", identity.Name))
+		}
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+/*
+ *	Checks that the request's identity holds the admin permission in
+ *	namespace, "*" for endpoints covering every namespace, answering 403
+ *	otherwise.
+ */
+func authorizedAdmin(w http.ResponseWriter, req *http.Request, namespace string) bool {
+	err := kvsAuth.Authorize(req.Context(), kvsAuth.Request{Permission: kvsAuth.AdminPermission, Namespace: namespace})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Serves handler to identities with the admin permission in every namespace.
+func adminOnly(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if authorizedAdmin(w, req, "*") {
+			handler.ServeHTTP(w, req)
+		}
+	})
+}
+
+func configHandler(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, kvsConfig.Current().Redacted())
+}
+
+func connectionsHandler(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, kvsTcpServer.Connections())
+}
+
+func storeHandler(w http.ResponseWriter, req *http.Request) {
+	var memStats runtime.MemStats
+	runtime.ReadMemStats(&memStats)
+	writeJson(w, StoreStats{
+		Store:      kvs.KvsMetrics(),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  memStats.HeapAlloc,
+		HeapInuse:  memStats.HeapInuse,
+		NumGC:      memStats.NumGC,
+	})
+}
+
+// Slow store operations, newest first
+func slowLogHandler(w http.ResponseWriter, req *http.Request) {
+	writeJson(w, kvs.SlowLog())
+}
+
+/*
+ *	GET /namespaces lists the namespaces, POST /namespaces creates one from a
+ *	NamespaceConfig body and DELETE /namespaces/{name} drops one with all its
+ *	keys. Nothing is persisted, so namespaces created here are gone after a
+ *	restart unless they are also in store.namespaces.
+ */
+func namespacesHandler(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(strings.TrimPrefix(req.URL.Path, "/namespaces"), "/")
+	switch {
+	case req.Method == http.MethodGet && name == "":
+		if !authorizedAdmin(w, req, "*") {
+			return
+		}
+		writeJson(w, kvs.Namespaces())
+	case req.Method == http.MethodPost && name == "":
+		var cfg kvsConfig.NamespaceConfig
+		if err := json.NewDecoder(req.Body).Decode(&cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if !authorizedAdmin(w, req, cfg.Name) {
+			return
+		}
+		err := kvs.CreateNamespace(req.Context(), cfg)
+		switch {
+		case errors.Is(err, kvs.ErrInvalidNamespace):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case err == kvs.ErrNamespaceExists:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		kvsLogger.FromContext(req.Context()).Info("Namespace created", "namespace", cfg.Name)
+		w.WriteHeader(http.StatusCreated)
+	case req.Method == http.MethodDelete && name != "":
+		if !authorizedAdmin(w, req, name) {
+			return
+		}
+		switch err := kvs.DropNamespace(req.Context(), name); err {
+		case nil:
+		case kvs.ErrUnknownNamespace:
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case kvs.ErrDefaultNamespace:
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		kvsLogger.FromContext(req.Context()).Info("Namespace dropped", "namespace", name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not supported", http.StatusMethodNotAllowed)
+	}
+}
+
+/*
+ *	Operator endpoints served on their own listener, bound to localhost by
+ *	default so profiles and config never reach the public port:
+ *		/debug/pprof/	- net/http/pprof profiles
+ *		/debug/vars		- expvar variables
+ *		/config			- the running config, with secrets redacted
+ *		/connections	- open TCP connections
+ *		/store			- store and runtime statistics
+ *		/slowlog		- slow store operations, newest first
+ *		/namespaces		- namespaces with their limits and usage
+ */
+func newHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/pprof/", adminOnly(http.HandlerFunc(pprof.Index)))
+	mux.Handle("/debug/pprof/cmdline", adminOnly(http.HandlerFunc(pprof.Cmdline)))
+	mux.Handle("/debug/pprof/profile", adminOnly(http.HandlerFunc(pprof.Profile)))
+	mux.Handle("/debug/pprof/symbol", adminOnly(http.HandlerFunc(pprof.Symbol)))
+	mux.Handle("/debug/pprof/trace", adminOnly(http.HandlerFunc(pprof.Trace)))
+	mux.Handle("/debug/vars", adminOnly(expvar.Handler()))
+	mux.Handle("/config", adminOnly(http.HandlerFunc(configHandler)))
+	mux.Handle("/connections", adminOnly(http.HandlerFunc(connectionsHandler)))
+	mux.Handle("/store", adminOnly(http.HandlerFunc(storeHandler)))
+	mux.Handle("/slowlog", adminOnly(http.HandlerFunc(slowLogHandler)))
+	// Namespaces are authorised per namespace by the handler
+	mux.HandleFunc("/namespaces", namespacesHandler)
+	mux.HandleFunc("/namespaces/", namespacesHandler)
+	return authMiddleware(mux)
+}
+
+func StartAdminServer(rootCtx context.Context, rootWg *sync.WaitGroup, cfg kvsConfig.AdminConfig) {
+	if cfg.Address == "" {
+		kvsLogger.Info("Admin Server disabled")
+		return
+	}
+	rootWg.Add(1)
+	srv := &http.Server{
+		Addr:    cfg.Address,
+		Handler: newHandler(),
+	}
+
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			kvsLogger.Fatal("Admin Server listen failed", "err", err)
+		}
+	}()
+
+	kvsLogger.Info("Admin Server started", "address", cfg.Address)
+
+	<-rootCtx.Done()
+
+	kvsLogger.Info("Admin Server stopping...")
+	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := srv.Shutdown(ctxShutDown); err != nil {
+		kvsLogger.Error("Admin Server Shutdown failed", "err", err)
+	}
+
+	kvsLogger.Info("Admin Server exited properly")
+
+	rootWg.Done()
+}
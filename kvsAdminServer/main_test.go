@@ -0,0 +1,145 @@
+package kvsAdminServer
+
+import (
+	"encoding/json"
+	"gokvs/kvs"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsTcpServer"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	uuid "github.com/google/uuid"
+)
+
+func TestEndpoints(t *testing.T) {
+	kvs.Start(kvs.KvsStoreType{uuid.New(): "value"})
+	defer kvs.Stop()
+	cfg := kvsConfig.Default()
+	cfg.Http.Port = 9090
+	kvsConfig.SetCurrent(cfg)
+	handler := newHandler()
+
+	get := func(path string) *httptest.ResponseRecorder {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+		if response.Code != http.StatusOK {
+			t.Fatalf("Expected 200 from %s, got %d", path, response.Code)
+		}
+		return response
+	}
+
+	t.Run("Config", func(t *testing.T) {
+		var got kvsConfig.Config
+		json.NewDecoder(get("/config").Body).Decode(&got)
+		if got.Http.Port != 9090 {
+			t.Errorf("Expected running config, got %+v", got)
+		}
+	})
+
+	t.Run("Store", func(t *testing.T) {
+		var got struct {
+			Store kvs.KvsMetricsStruct `json:"store"`
+		}
+		json.NewDecoder(get("/store").Body).Decode(&got)
+		if got.Store.Size != 1 {
+			t.Errorf("Expected 1 key, got %+v", got.Store)
+		}
+	})
+
+	t.Run("Connections", func(t *testing.T) {
+		var got []kvsTcpServer.ConnectionInfo
+		if err := json.NewDecoder(get("/connections").Body).Decode(&got); err != nil {
+			t.Errorf("Connections decoding error %v", err)
+		}
+	})
+
+	t.Run("Pprof and expvar", func(t *testing.T) {
+		get("/debug/pprof/")
+		get("/debug/pprof/goroutine?debug=1")
+		get("/debug/vars")
+	})
+
+	t.Run("Slow log", func(t *testing.T) {
+		var got []kvs.SlowLogEntry
+		if err := json.NewDecoder(get("/slowlog").Body).Decode(&got); err != nil {
+			t.Errorf("Slow log decoding error %v", err)
+		}
+	})
+
+	t.Run("Namespaces", func(t *testing.T) {
+		do := func(method, path, body string) int {
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, httptest.NewRequest(method, path, strings.NewReader(body)))
+			return response.Code
+		}
+		if code := do(http.MethodPost, "/namespaces", `{"name": "tenant-a", "maxKeys": 10}`); code != http.StatusCreated {
+			t.Errorf("Expected 201 creating a namespace, got %d", code)
+		}
+		if code := do(http.MethodPost, "/namespaces", `{"name": "tenant-a"}`); code != http.StatusConflict {
+			t.Errorf("Expected 409 creating it again, got %d", code)
+		}
+		if code := do(http.MethodPost, "/namespaces", `{"name": "tenant b"}`); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for an invalid name, got %d", code)
+		}
+		var got []kvs.NamespaceInfo
+		json.NewDecoder(get("/namespaces").Body).Decode(&got)
+		if len(got) != 2 || got[0].Name != kvs.DefaultNamespace || got[0].Keys != 1 || got[1].Name != "tenant-a" || got[1].MaxKeys != 10 {
+			t.Errorf("Unexpected namespaces %+v", got)
+		}
+		if code := do(http.MethodDelete, "/namespaces/tenant-a", ""); code != http.StatusNoContent {
+			t.Errorf("Expected 204 dropping a namespace, got %d", code)
+		}
+		if code := do(http.MethodDelete, "/namespaces/tenant-a", ""); code != http.StatusNotFound {
+			t.Errorf("Expected 404 dropping it again, got %d", code)
+		}
+		if code := do(http.MethodDelete, "/namespaces/"+kvs.DefaultNamespace, ""); code != http.StatusConflict {
+			t.Errorf("Expected 409 dropping the default namespace, got %d", code)
+		}
+	})
+}
+
+func TestAuthorization(t *testing.T) {
+	kvsAuth.Configure(kvsConfig.AuthConfig{
+		Enabled: true,
+		ApiKeys: []kvsConfig.ApiKeyConfig{{Identity: "ops", Key: "ops-key-0123456789"}, {Identity: "billing", Key: "billing-key-0123456789"}},
+		Roles: []kvsConfig.RoleConfig{
+			{Name: "operator", Grants: []kvsConfig.GrantConfig{{Permissions: []string{"admin"}}}},
+			{Name: "billing-admin", Grants: []kvsConfig.GrantConfig{{Namespace: "billing", Permissions: []string{"admin"}}}},
+		},
+		Bindings: []kvsConfig.BindingConfig{{Identity: "ops", Roles: []string{"operator"}}, {Identity: "billing", Roles: []string{"billing-admin"}}},
+	})
+	defer kvsAuth.Configure(kvsConfig.AuthConfig{})
+	kvs.Start()
+	defer kvs.Stop()
+	kvsConfig.SetCurrent(kvsConfig.Default())
+	handler := newHandler()
+
+	for _, test := range []struct {
+		name, key, method, path, body string
+		code                          int
+	}{
+		{"Anonymous config", "", http.MethodGet, "/config", "", http.StatusUnauthorized},
+		{"Anonymous namespace drop", "", http.MethodDelete, "/namespaces/billing", "", http.StatusUnauthorized},
+		{"Namespace admin creates its namespace", "billing-key-0123456789", http.MethodPost, "/namespaces", `{"name": "billing"}`, http.StatusCreated},
+		{"Namespace admin creates another", "billing-key-0123456789", http.MethodPost, "/namespaces", `{"name": "reports"}`, http.StatusForbidden},
+		{"Namespace admin reads config", "billing-key-0123456789", http.MethodGet, "/config", "", http.StatusForbidden},
+		{"Namespace admin lists namespaces", "billing-key-0123456789", http.MethodGet, "/namespaces", "", http.StatusForbidden},
+		{"Operator reads config", "ops-key-0123456789", http.MethodGet, "/config", "", http.StatusOK},
+		{"Namespace admin drops its namespace", "billing-key-0123456789", http.MethodDelete, "/namespaces/billing", "", http.StatusNoContent},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			request := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+			if test.key != "" {
+				request.Header.Set("Authorization", "Bearer "+test.key)
+			}
+			response := httptest.NewRecorder()
+			handler.ServeHTTP(response, request)
+			if response.Code != test.code {
+				t.Errorf("Expected %d, got %d", test.code, response.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,292 @@
+package kvsAudit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsLogger"
+	"gokvs/kvsMetrics"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+/*
+ *	One line of the audit log. OldHash and NewHash are SHA-256 digests of the
+ *	JSON encoding of the value before and after the change, empty when there
+ *	was none. Prev is the Hash of the previous entry, empty for the first, and
+ *	Hash covers every other field, so changing, removing or reordering
+ *	entries breaks the chain.
+ */
+type Entry struct {
+	Seq        int64     `json:"seq"`
+	Time       time.Time `json:"time"`
+	Operation  string    `json:"op"`
+	Namespace  string    `json:"namespace"`
+	Key        string    `json:"key"`
+	Identity   string    `json:"identity,omitempty"`
+	Transport  string    `json:"transport,omitempty"`
+	RemoteAddr string    `json:"remoteAddr,omitempty"`
+	OldHash    string    `json:"oldHash,omitempty"`
+	NewHash    string    `json:"newHash,omitempty"`
+	Prev       string    `json:"prev"`
+	Hash       string    `json:"hash"`
+}
+
+// Where a change came from, carried in the context of the request making it.
+type Source struct {
+	Identity   string
+	Transport  string
+	RemoteAddr string
+}
+
+// A change made by the store, passed to Record.
+type Change struct {
+	Operation string
+	Namespace string
+	Key       string
+	Source    Source
+	OldValue  interface{} // nil if the key did not exist
+	NewValue  interface{} // nil if the key was deleted
+}
+
+type queuedChange struct {
+	change Change
+	time   time.Time
+}
+
+/*
+ *	Changes are queued by the store goroutine and written by writeEntries, so
+ *	hashing and disk writes stay off the store goroutine. The queue blocks
+ *	when full rather than losing entries.
+ */
+const queueSize = 1024
+
+var queue chan queuedChange
+var writerDone chan struct{}
+var auditMutex sync.RWMutex
+
+var entriesWritten = kvsMetrics.NewCounterVec(
+	"kvs_audit_entries_total",
+	"Entries appended to the audit log, by operation.",
+	"op",
+)
+
+var writeErrors = kvsMetrics.NewCounterVec(
+	"kvs_audit_write_errors_total",
+	"Audit log entries that failed to be written.",
+)
+
+/*
+ *	Opens the audit log at cfg.Path for appending, continuing the chain of
+ *	the entries already in it. Does nothing when cfg.Path is empty.
+ */
+func Start(cfg kvsConfig.AuditConfig) error {
+	if cfg.Path == "" {
+		return nil
+	}
+	last, err := lastEntry(cfg.Path)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	queue = make(chan queuedChange, queueSize)
+	writerDone = make(chan struct{})
+	go writeEntries(file, info.Size(), last, cfg.Sync, queue, writerDone)
+	kvsLogger.Info("Audit log opened", "path", cfg.Path, "entries", last.Seq)
+	return nil
+}
+
+// Writes the queued entries and closes the audit log.
+func Close() {
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if queue == nil {
+		return
+	}
+	close(queue)
+	<-writerDone
+	queue = nil
+}
+
+// Whether changes are being audited.
+func Enabled() bool {
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+	return queue != nil
+}
+
+// Queues change to be appended to the audit log, if one is open.
+func Record(change Change) {
+	auditMutex.RLock()
+	defer auditMutex.RUnlock()
+	if queue != nil {
+		queue <- queuedChange{change: change, time: time.Now().UTC()}
+	}
+}
+
+type sourceContextKey struct{}
+
+// Records the transport and remote address a request arrived on.
+func WithSource(ctx context.Context, transport, remoteAddr string) context.Context {
+	return context.WithValue(ctx, sourceContextKey{}, Source{Transport: transport, RemoteAddr: remoteAddr})
+}
+
+// The source of the request ctx belongs to, with its authenticated identity.
+func SourceFrom(ctx context.Context) Source {
+	source, _ := ctx.Value(sourceContextKey{}).(Source)
+	if identity, ok := kvsAuth.IdentityFrom(ctx); ok {
+		source.Identity = identity.Name
+	}
+	return source
+}
+
+// The methods of *os.File writeEntries uses, so tests can make writes fail.
+type logFile interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+/*
+ *	Appends an entry for each change to file, which holds size bytes of
+ *	entries ending with last. A failed write is cut back off the file, so a
+ *	partial line never breaks the chain, and the change is dropped. If the
+ *	file cannot be cut back, nothing more is written, as every later entry
+ *	would follow a broken one: the failure is logged and every dropped change
+ *	counted in kvs_audit_write_errors_total.
+ */
+func writeEntries(file logFile, size int64, last Entry, sync bool, changes <-chan queuedChange, done chan<- struct{}) {
+	defer close(done)
+	defer file.Close()
+	broken := false
+	for queued := range changes {
+		if broken {
+			writeErrors.Inc()
+			continue
+		}
+		change := queued.change
+		entry := Entry{
+			Seq:        last.Seq + 1,
+			Time:       queued.time,
+			Operation:  change.Operation,
+			Namespace:  change.Namespace,
+			Key:        change.Key,
+			Identity:   change.Source.Identity,
+			Transport:  change.Source.Transport,
+			RemoteAddr: change.Source.RemoteAddr,
+			OldHash:    valueHash(change.OldValue),
+			NewHash:    valueHash(change.NewValue),
+			Prev:       last.Hash,
+		}
+		entry.Hash = entryHash(entry)
+		line, _ := json.Marshal(entry)
+		line = append(line, '\n')
+		if _, err := file.Write(line); err != nil {
+			kvsLogger.Error("Audit log write failed", "seq", entry.Seq, "err", err)
+			writeErrors.Inc()
+			if err := file.Truncate(size); err != nil {
+				kvsLogger.Error("Audit log could not be repaired after a failed write, no further changes will be audited", "offset", size, "err", err)
+				broken = true
+			}
+			continue
+		}
+		size += int64(len(line))
+		if sync {
+			if err := file.Sync(); err != nil {
+				kvsLogger.Error("Audit log sync failed", "seq", entry.Seq, "err", err)
+				writeErrors.Inc()
+			}
+		}
+		entriesWritten.Inc(entry.Operation)
+		last = entry
+	}
+}
+
+func valueHash(value interface{}) string {
+	if value == nil {
+		return ""
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data = []byte(fmt.Sprintf("%#v", value))
+	}
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// The digest of entry's JSON encoding with Hash left empty.
+func entryHash(entry Entry) string {
+	entry.Hash = ""
+	data, _ := json.Marshal(entry)
+	digest := sha256.Sum256(data)
+	return hex.EncodeToString(digest[:])
+}
+
+// The last entry of the log at path, or an empty entry if it is missing or empty.
+func lastEntry(path string) (Entry, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return Entry{}, nil
+	}
+	if err != nil {
+		return Entry{}, err
+	}
+	defer file.Close()
+	last, err := Verify(file)
+	if err != nil {
+		return Entry{}, fmt.Errorf("Audit log %s is not intact: %v", path, err)
+	}
+	return last, nil
+}
+
+/*
+ *	Reads an audit log from r and checks that every entry follows on from the
+ *	one before it, returning the last entry. The error names the line of the
+ *	first entry that does not. Entries cut off the end of the log cannot be
+ *	detected from the log alone; compare the returned Seq and Hash with a
+ *	copy kept elsewhere for that.
+ */
+func Verify(r io.Reader) (Entry, error) {
+	reader := bufio.NewReader(r)
+	var last Entry
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return last, nil
+		}
+		if err != nil && err != io.EOF {
+			return last, err
+		}
+		var entry Entry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return last, fmt.Errorf("Line %d: %v", lineNumber, err)
+		}
+		if entry.Seq != last.Seq+1 {
+			return last, fmt.Errorf("Line %d: expected seq %d, got %d", lineNumber, last.Seq+1, entry.Seq)
+		}
+		if entry.Prev != last.Hash {
+			return last, fmt.Errorf("Line %d: prev does not match the hash of the previous entry", lineNumber)
+		}
+		if entryHash(entry) != entry.Hash {
+			return last, fmt.Errorf("Line %d: hash does not match the entry", lineNumber)
+		}
+		last = entry
+	}
+}
@@ -0,0 +1,139 @@
+package kvsAudit
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeLog(t *testing.T, path string, changes ...Change) {
+	if err := Start(kvsConfig.AuditConfig{Path: path, Sync: true}); err != nil {
+		t.Fatalf("Start returned err %v", err)
+	}
+	for _, change := range changes {
+		Record(change)
+	}
+	Close()
+}
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	source := Source{Identity: "alice", Transport: "http", RemoteAddr: "192.0.2.1:1000"}
+	writeLog(t, path,
+		Change{Operation: "set", Namespace: "default", Key: "a", Source: source, NewValue: "v1"},
+		Change{Operation: "update", Namespace: "default", Key: "a", Source: source, OldValue: "v1", NewValue: "v2"},
+	)
+	writeLog(t, path, Change{Operation: "delete", Namespace: "default", Key: "a", OldValue: "v2"})
+	data, _ := os.ReadFile(path)
+
+	t.Run("Chain continues across restarts", func(t *testing.T) {
+		last, err := Verify(bytes.NewReader(data))
+		if err != nil || last.Seq != 3 || last.Operation != "delete" {
+			t.Errorf("Expected 3 intact entries ending with the delete, got %+v, %v", last, err)
+		}
+	})
+
+	t.Run("Value hashes", func(t *testing.T) {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if !strings.Contains(lines[1], `"oldHash":"`+valueHash("v1")+`"`) || !strings.Contains(lines[1], `"newHash":"`+valueHash("v2")+`"`) {
+			t.Errorf("Expected the update to hash both values, got %s", lines[1])
+		}
+		if strings.Contains(lines[0], "oldHash") || strings.Contains(lines[2], "newHash") {
+			t.Errorf("Expected no hash for missing values, got %s and %s", lines[0], lines[2])
+		}
+		if !strings.Contains(lines[0], `"identity":"alice","transport":"http","remoteAddr":"192.0.2.1:1000"`) {
+			t.Errorf("Expected the source to be recorded, got %s", lines[0])
+		}
+	})
+
+	for _, test := range []struct {
+		name   string
+		tamper func(lines []string) []string
+		line   string
+	}{
+		{"Edited entry", func(lines []string) []string {
+			lines[1] = strings.Replace(lines[1], `"identity":"alice"`, `"identity":"bob"`, 1)
+			return lines
+		}, "Line 2"},
+		{"Removed entry", func(lines []string) []string { return append(lines[:1], lines[2:]...) }, "Line 2"},
+		{"Reordered entries", func(lines []string) []string {
+			lines[0], lines[1] = lines[1], lines[0]
+			return lines
+		}, "Line 1"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			lines := test.tamper(strings.Split(strings.TrimSpace(string(data)), "\n"))
+			if _, err := Verify(strings.NewReader(strings.Join(lines, "\n"))); err == nil || !strings.HasPrefix(err.Error(), test.line) {
+				t.Errorf("Expected an error on %s, got %v", test.line, err)
+			}
+		})
+	}
+
+	t.Run("Tampered log is not reopened", func(t *testing.T) {
+		os.WriteFile(path, bytes.Replace(data, []byte(`"key":"a"`), []byte(`"key":"b"`), 1), 0600)
+		if err := Start(kvsConfig.AuditConfig{Path: path}); err == nil {
+			Close()
+			t.Errorf("Expected Start to refuse a broken chain")
+		}
+	})
+}
+
+func TestSourceFrom(t *testing.T) {
+	ctx := WithSource(context.Background(), "tcp", "192.0.2.1:1000")
+	ctx = kvsAuth.WithIdentity(ctx, kvsAuth.Identity{Name: "ci"})
+	if source := SourceFrom(ctx); source != (Source{Identity: "ci", Transport: "tcp", RemoteAddr: "192.0.2.1:1000"}) {
+		t.Errorf("Unexpected source %+v", source)
+	}
+	if source := SourceFrom(context.Background()); source != (Source{}) {
+		t.Errorf("Expected an empty source, got %+v", source)
+	}
+	if Enabled() {
+		t.Errorf("Expected auditing to be off without Start")
+	}
+	Record(Change{Operation: "set"}) // Dropped without an open log
+}
+
+// Writes only part of the first line given to it, then fails.
+type failingFile struct {
+	*os.File
+	failed bool
+}
+
+func (f *failingFile) Write(p []byte) (int, error) {
+	if !f.failed {
+		f.failed = true
+		n, _ := f.File.Write(p[:len(p)/2])
+		return n, errors.New("disk full")
+	}
+	return f.File.Write(p)
+}
+
+func TestFailedWriteKeepsChain(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	writeLog(t, path, Change{Operation: "set", Namespace: "default", Key: "a", NewValue: "v1"})
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	info, _ := file.Stat()
+	last, _ := lastEntry(path)
+
+	changes := make(chan queuedChange, 2)
+	done := make(chan struct{})
+	changes <- queuedChange{change: Change{Operation: "update", Namespace: "default", Key: "a", OldValue: "v1", NewValue: "v2"}}
+	changes <- queuedChange{change: Change{Operation: "delete", Namespace: "default", Key: "a", OldValue: "v2"}}
+	close(changes)
+	writeEntries(&failingFile{File: file}, info.Size(), last, false, changes, done)
+
+	data, _ := os.ReadFile(path)
+	if last, err := Verify(bytes.NewReader(data)); err != nil || last.Seq != 2 || last.Operation != "delete" {
+		t.Errorf("Expected the failed entry to be cut off and the chain to carry on, got %+v, %v", last, err)
+	}
+	if err := Start(kvsConfig.AuditConfig{Path: path}); err != nil {
+		t.Errorf("Expected the log to reopen after a failed write, got %v", err)
+	}
+	Close()
+}
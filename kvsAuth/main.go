@@ -0,0 +1,303 @@
+package kvsAuth
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"gokvs/kvsConfig"
+	"gokvs/kvsMetrics"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrMissingCredentials = errors.New("Authentication required.")
+var ErrInvalidCredentials = errors.New("Invalid credentials.")
+var ErrTokenExpired = errors.New("Token has expired.")
+
+// Authentication methods, reported with each Identity
+const (
+	ApiKeyMethod      = "api_key"
+	TokenMethod       = "token"
+	CertificateMethod = "certificate"
+)
+
+// Who a client authenticated as, and how.
+type Identity struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+}
+
+/*
+ *	Checks a credential, the API key or token a client presented. An
+ *	authenticator that does not recognise the form of a credential returns
+ *	ErrInvalidCredentials so the next one can try; any other error stops the
+ *	search.
+ */
+type Authenticator interface {
+	Authenticate(credential string) (Identity, error)
+}
+
+/*
+ *	The built-in authenticators are rebuilt from the config by Configure, and
+ *	tried before those added with RegisterAuthenticator. authMutex also guards
+ *	the grants in rbac.go.
+ */
+var enabled bool
+var builtin []Authenticator
+var registered []Authenticator
+var certificateIdentities map[string]string // By subject
+var authMutex sync.RWMutex
+
+var authFailures = kvsMetrics.NewCounterVec(
+	"kvs_auth_failures_total",
+	"Requests and connections refused for missing or invalid credentials, by transport and reason.",
+	"transport", "reason",
+)
+
+// Applies the auth settings, at startup and on config reload.
+func Configure(cfg kvsConfig.AuthConfig) {
+	PrepareConfig(cfg)()
+}
+
+/*
+ *	Builds the authenticators and grants of cfg, returning a function that
+ *	swaps them in at once, so a reload can build every package's settings
+ *	before applying any.
+ */
+func PrepareConfig(cfg kvsConfig.AuthConfig) func() {
+	authenticators := []Authenticator{}
+	if len(cfg.ApiKeys) > 0 {
+		authenticators = append(authenticators, newApiKeyAuthenticator(cfg.ApiKeys))
+	}
+	if len(cfg.TokenSecrets) > 0 {
+		authenticators = append(authenticators, &TokenAuthenticator{Secrets: cfg.TokenSecrets})
+	}
+	subjects := map[string]string{}
+	for _, certificate := range cfg.ClientCertificates {
+		subjects[certificate.Subject] = certificate.Identity
+	}
+	grants := grantsOfConfig(cfg)
+	return func() {
+		authMutex.Lock()
+		defer authMutex.Unlock()
+		enabled = cfg.Enabled
+		builtin = authenticators
+		certificateIdentities = subjects
+		rbacEnabled = len(cfg.Roles) > 0
+		identityGrants = grants
+	}
+}
+
+// Adds an authenticator tried after the configured API keys and tokens.
+func RegisterAuthenticator(authenticator Authenticator) {
+	authMutex.Lock()
+	defer authMutex.Unlock()
+	registered = append(registered, authenticator)
+}
+
+// Whether clients must authenticate.
+func Required() bool {
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	return enabled
+}
+
+// Tries credential with every authenticator in turn.
+func Authenticate(credential string) (Identity, error) {
+	if credential == "" {
+		return Identity{}, ErrMissingCredentials
+	}
+	authMutex.RLock()
+	authenticators := append(append([]Authenticator{}, builtin...), registered...)
+	authMutex.RUnlock()
+	for _, authenticator := range authenticators {
+		identity, err := authenticator.Authenticate(credential)
+		if err != ErrInvalidCredentials {
+			return identity, err
+		}
+	}
+	return Identity{}, ErrInvalidCredentials
+}
+
+/*
+ *	Maps a client certificate, already verified by the listener, to the
+ *	identity configured for its full subject, or failing that for its
+ *	"CN=<common name>". Certificates with no configured subject are
+ *	ErrInvalidCredentials.
+ */
+func AuthenticateCertificate(certificate *x509.Certificate) (Identity, error) {
+	if certificate == nil {
+		return Identity{}, ErrMissingCredentials
+	}
+	authMutex.RLock()
+	defer authMutex.RUnlock()
+	name, ok := certificateIdentities[certificate.Subject.String()]
+	if !ok {
+		name, ok = certificateIdentities["CN="+certificate.Subject.CommonName]
+	}
+	if !ok {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Name: name, Method: CertificateMethod}, nil
+}
+
+const bearerPrefix = "Bearer "
+
+// The credential in an "Authorization: Bearer ..." header, empty if there is none.
+func BearerCredential(header string) string {
+	if len(header) > len(bearerPrefix) && strings.EqualFold(header[:len(bearerPrefix)], bearerPrefix) {
+		return strings.TrimSpace(header[len(bearerPrefix):])
+	}
+	return ""
+}
+
+// Counts a refused request or connection, see kvs_auth_failures_total.
+func RegisterFailure(transport string, err error) {
+	reason := "invalid"
+	switch err {
+	case ErrMissingCredentials:
+		reason = "missing"
+	case ErrTokenExpired:
+		reason = "expired"
+	}
+	authFailures.Inc(transport, reason)
+}
+
+type identityContextKey struct{}
+
+func WithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// The identity ctx was authenticated as, false for anonymous requests.
+func IdentityFrom(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
+
+/*
+ *	API keys are compared by their SHA-256 digests in constant time, and every
+ *	key is compared, so the time taken gives nothing away about which keys
+ *	exist.
+ */
+type apiKeyAuthenticator struct {
+	digests    [][sha256.Size]byte
+	identities []string
+}
+
+func newApiKeyAuthenticator(apiKeys []kvsConfig.ApiKeyConfig) *apiKeyAuthenticator {
+	authenticator := &apiKeyAuthenticator{}
+	for _, apiKey := range apiKeys {
+		authenticator.digests = append(authenticator.digests, sha256.Sum256([]byte(apiKey.Key)))
+		authenticator.identities = append(authenticator.identities, apiKey.Identity)
+	}
+	return authenticator
+}
+
+func (a *apiKeyAuthenticator) Authenticate(credential string) (Identity, error) {
+	digest := sha256.Sum256([]byte(credential))
+	match := -1
+	for i := range a.digests {
+		if subtle.ConstantTimeCompare(digest[:], a.digests[i][:]) == 1 {
+			match = i
+		}
+	}
+	if match < 0 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Name: a.identities[match], Method: ApiKeyMethod}, nil
+}
+
+/*
+ *	Bearer tokens are JWTs signed with HMAC-SHA256 (alg HS256). The sub claim
+ *	is the identity, and exp and nbf, in Unix seconds, are enforced when
+ *	present. Any of Secrets may have signed a token.
+ */
+type TokenAuthenticator struct {
+	Secrets []string
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ,omitempty"`
+}
+
+type tokenClaims struct {
+	Subject   string `json:"sub"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
+var tokenEncoding = base64.RawURLEncoding
+
+func sign(secret, signingInput string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingInput))
+	return mac.Sum(nil)
+}
+
+func (a *TokenAuthenticator) Authenticate(credential string) (Identity, error) {
+	parts := strings.Split(credential, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrInvalidCredentials
+	}
+	signature, err := tokenEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrInvalidCredentials
+	}
+	signingInput := parts[0] + "." + parts[1]
+	valid := false
+	for _, secret := range a.Secrets {
+		if hmac.Equal(signature, sign(secret, signingInput)) {
+			valid = true
+		}
+	}
+	if !valid {
+		return Identity{}, ErrInvalidCredentials
+	}
+
+	var header tokenHeader
+	var claims tokenClaims
+	if decodeSegment(parts[0], &header) != nil || header.Alg != "HS256" || decodeSegment(parts[1], &claims) != nil || claims.Subject == "" {
+		return Identity{}, ErrInvalidCredentials
+	}
+	now := time.Now().Unix()
+	if claims.ExpiresAt != 0 && now >= claims.ExpiresAt {
+		return Identity{}, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now < claims.NotBefore {
+		return Identity{}, ErrInvalidCredentials
+	}
+	return Identity{Name: claims.Subject, Method: TokenMethod}, nil
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	data, err := tokenEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+/*
+ *	Issues a token for subject signed with secret, valid for ttl (forever when
+ *	ttl is 0).
+ */
+func IssueToken(secret, subject string, ttl time.Duration) string {
+	now := time.Now()
+	claims := tokenClaims{Subject: subject, IssuedAt: now.Unix()}
+	if ttl != 0 {
+		claims.ExpiresAt = now.Add(ttl).Unix()
+	}
+	header, _ := json.Marshal(tokenHeader{Alg: "HS256", Typ: "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := tokenEncoding.EncodeToString(header) + "." + tokenEncoding.EncodeToString(payload)
+	return signingInput + "." + tokenEncoding.EncodeToString(sign(secret, signingInput))
+}
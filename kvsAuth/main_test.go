@@ -0,0 +1,167 @@
+package kvsAuth
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"gokvs/kvsConfig"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "0123456789abcdef0123"
+
+func TestAuthenticate(t *testing.T) {
+	Configure(kvsConfig.AuthConfig{
+		Enabled:      true,
+		ApiKeys:      []kvsConfig.ApiKeyConfig{{Identity: "ci", Key: "ci-key-0123456789"}, {Identity: "ops", Key: "ops-key-0123456789"}},
+		TokenSecrets: []string{"old-secret-0123456789", testSecret},
+	})
+	defer Configure(kvsConfig.AuthConfig{})
+	if !Required() {
+		t.Errorf("Expected authentication to be required")
+	}
+
+	for _, test := range []struct {
+		name       string
+		credential string
+		identity   Identity
+		err        error
+	}{
+		{"API key", "ops-key-0123456789", Identity{Name: "ops", Method: ApiKeyMethod}, nil},
+		{"Token", IssueToken(testSecret, "alice", time.Hour), Identity{Name: "alice", Method: TokenMethod}, nil},
+		{"Token signed with an older secret", IssueToken("old-secret-0123456789", "bob", 0), Identity{Name: "bob", Method: TokenMethod}, nil},
+		{"Missing", "", Identity{}, ErrMissingCredentials},
+		{"Unknown key", "not-a-key", Identity{}, ErrInvalidCredentials},
+		{"Unknown secret", IssueToken("other-secret-0123456789", "mallory", time.Hour), Identity{}, ErrInvalidCredentials},
+		{"Expired token", IssueToken(testSecret, "alice", -time.Second), Identity{}, ErrTokenExpired},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := Authenticate(test.credential)
+			if identity != test.identity || err != test.err {
+				t.Errorf("Expected %+v, %v, got %+v, %v", test.identity, test.err, identity, err)
+			}
+		})
+	}
+
+	t.Run("Tampered token", func(t *testing.T) {
+		parts := strings.Split(IssueToken(testSecret, "alice", time.Hour), ".")
+		forged := IssueToken(testSecret, "admin", time.Hour)
+		parts[1] = strings.Split(forged, ".")[1]
+		if _, err := Authenticate(strings.Join(parts, ".")); err != ErrInvalidCredentials {
+			t.Errorf("Expected ErrInvalidCredentials, got %v", err)
+		}
+	})
+}
+
+func TestAuthenticateCertificate(t *testing.T) {
+	Configure(kvsConfig.AuthConfig{
+		Enabled: true,
+		ClientCertificates: []kvsConfig.ClientCertificateConfig{
+			{Subject: "CN=billing,O=Acme", Identity: "billing"},
+			{Subject: "CN=reports", Identity: "reporting"},
+		},
+	})
+	defer Configure(kvsConfig.AuthConfig{})
+
+	for _, test := range []struct {
+		name     string
+		subject  pkix.Name
+		identity Identity
+		err      error
+	}{
+		{"Full subject", pkix.Name{CommonName: "billing", Organization: []string{"Acme"}}, Identity{Name: "billing", Method: CertificateMethod}, nil},
+		{"Common name", pkix.Name{CommonName: "reports", Organization: []string{"Acme"}}, Identity{Name: "reporting", Method: CertificateMethod}, nil},
+		{"Other organisation", pkix.Name{CommonName: "billing", Organization: []string{"Other"}}, Identity{}, ErrInvalidCredentials},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			identity, err := AuthenticateCertificate(&x509.Certificate{Subject: test.subject})
+			if identity != test.identity || err != test.err {
+				t.Errorf("Expected %+v, %v, got %+v, %v", test.identity, test.err, identity, err)
+			}
+		})
+	}
+	if _, err := AuthenticateCertificate(nil); err != ErrMissingCredentials {
+		t.Errorf("Expected ErrMissingCredentials without a certificate, got %v", err)
+	}
+}
+
+type staticAuthenticator struct{}
+
+func (staticAuthenticator) Authenticate(credential string) (Identity, error) {
+	if credential == "let-me-in" {
+		return Identity{Name: "plugin", Method: "static"}, nil
+	}
+	return Identity{}, ErrInvalidCredentials
+}
+
+func TestRegisterAuthenticator(t *testing.T) {
+	defer func() { registered = nil }()
+	RegisterAuthenticator(staticAuthenticator{})
+	if identity, err := Authenticate("let-me-in"); err != nil || identity.Name != "plugin" {
+		t.Errorf("Expected the registered authenticator to accept, got %+v, %v", identity, err)
+	}
+	ctx := WithIdentity(context.Background(), Identity{Name: "plugin"})
+	if identity, ok := IdentityFrom(ctx); !ok || identity.Name != "plugin" {
+		t.Errorf("Expected the identity from the context, got %+v", identity)
+	}
+	if _, ok := IdentityFrom(context.Background()); ok {
+		t.Errorf("Expected no identity in an empty context")
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	Configure(kvsConfig.AuthConfig{
+		Enabled: true,
+		ApiKeys: []kvsConfig.ApiKeyConfig{{Identity: "ci", Key: "ci-key-0123456789"}},
+		Roles: []kvsConfig.RoleConfig{
+			{Name: "reader", Grants: []kvsConfig.GrantConfig{{Permissions: []string{"read"}}}},
+			{Name: "billing-writer", Grants: []kvsConfig.GrantConfig{{Namespace: "billing", KeyPrefix: "ab", Permissions: []string{"write", "delete"}}}},
+			{Name: "billing-admin", Grants: []kvsConfig.GrantConfig{{Namespace: "billing", Permissions: []string{"admin"}}}},
+		},
+		Bindings: []kvsConfig.BindingConfig{
+			{Identity: "alice", Roles: []string{"reader", "billing-writer"}},
+			{Identity: "ops", Roles: []string{"billing-admin"}},
+		},
+	})
+	defer Configure(kvsConfig.AuthConfig{})
+	as := func(name string) context.Context {
+		return WithIdentity(context.Background(), Identity{Name: name})
+	}
+
+	for _, test := range []struct {
+		name    string
+		ctx     context.Context
+		request Request
+		allowed bool
+	}{
+		{"Read anywhere", as("alice"), Request{Permission: ReadPermission, Namespace: "default", Key: "cd"}, true},
+		{"Write under the prefix", as("alice"), Request{Permission: WritePermission, Namespace: "billing", Key: "ab12"}, true},
+		{"Write outside the prefix", as("alice"), Request{Permission: WritePermission, Namespace: "billing", Key: "cd12"}, false},
+		{"Write without a key", as("alice"), Request{Permission: WritePermission, Namespace: "billing"}, false},
+		{"Write in another namespace", as("alice"), Request{Permission: WritePermission, Namespace: "default", Key: "ab12"}, false},
+		{"Admin implies the rest", as("ops"), Request{Permission: DeletePermission, Namespace: "billing"}, true},
+		{"Admin is per namespace", as("ops"), Request{Permission: ReadPermission, Namespace: "default", Key: "ab"}, false},
+		{"Unbound identity", as("ci"), Request{Permission: ReadPermission, Namespace: "default"}, false},
+		{"Anonymous", context.Background(), Request{Permission: ReadPermission, Namespace: "default"}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := Authorize(test.ctx, test.request)
+			if test.allowed && err != nil || !test.allowed && err != ErrPermissionDenied {
+				t.Errorf("Expected allowed to be %v, got %v", test.allowed, err)
+			}
+		})
+	}
+
+	t.Run("No roles", func(t *testing.T) {
+		Configure(kvsConfig.AuthConfig{Enabled: true, ApiKeys: []kvsConfig.ApiKeyConfig{{Identity: "ci", Key: "ci-key-0123456789"}}})
+		if err := Authorize(as("ci"), Request{Permission: AdminPermission, Namespace: "default"}); err != nil {
+			t.Errorf("Expected any identity to be allowed without roles, got %v", err)
+		}
+		Configure(kvsConfig.AuthConfig{})
+		if err := Authorize(context.Background(), Request{Permission: AdminPermission, Namespace: "default"}); err != nil {
+			t.Errorf("Expected everything to be allowed without authentication, got %v", err)
+		}
+	})
+}
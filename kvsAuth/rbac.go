@@ -0,0 +1,119 @@
+package kvsAuth
+
+import (
+	"context"
+	"errors"
+	"gokvs/kvsConfig"
+	"gokvs/kvsLogger"
+	"gokvs/kvsMetrics"
+	"strings"
+)
+
+var ErrPermissionDenied = errors.New("Permission denied.")
+
+// Permissions granted by roles. Admin includes the others.
+const (
+	ReadPermission   = "read"
+	WritePermission  = "write"
+	DeletePermission = "delete"
+	AdminPermission  = "admin"
+)
+
+/*
+ *	An operation to authorise. Key is empty for operations on no particular
+ *	key, like listing values or storing one under a new id, which need a grant
+ *	covering every key in the namespace.
+ */
+type Request struct {
+	Permission string
+	Namespace  string
+	Key        string
+}
+
+type grant struct {
+	namespace   string // "*" for every namespace
+	keyPrefix   string
+	permissions map[string]bool
+}
+
+func (g grant) allows(request Request) bool {
+	if g.namespace != "*" && g.namespace != request.Namespace {
+		return false
+	}
+	if !g.permissions[request.Permission] && !g.permissions[AdminPermission] {
+		return false
+	}
+	return g.keyPrefix == "" || (request.Key != "" && strings.HasPrefix(request.Key, g.keyPrefix))
+}
+
+/*
+ *	The grants of each identity, rebuilt by Configure. rbacEnabled is false
+ *	when no roles are declared, leaving every identity unrestricted.
+ */
+var rbacEnabled bool
+var identityGrants map[string][]grant
+
+var authDecisions = kvsMetrics.NewCounterVec(
+	"kvs_auth_decisions_total",
+	"Authorisation decisions, by permission and decision.",
+	"permission", "decision",
+)
+
+func grantsOfConfig(cfg kvsConfig.AuthConfig) map[string][]grant {
+	roleGrants := map[string][]grant{}
+	for _, role := range cfg.Roles {
+		for _, grantConfig := range role.Grants {
+			g := grant{namespace: grantConfig.Namespace, keyPrefix: grantConfig.KeyPrefix, permissions: map[string]bool{}}
+			if g.namespace == "" {
+				g.namespace = "*"
+			}
+			for _, permission := range grantConfig.Permissions {
+				g.permissions[permission] = true
+			}
+			roleGrants[role.Name] = append(roleGrants[role.Name], g)
+		}
+	}
+	grants := map[string][]grant{}
+	for _, binding := range cfg.Bindings {
+		for _, role := range binding.Roles {
+			grants[binding.Identity] = append(grants[binding.Identity], roleGrants[role]...)
+		}
+	}
+	return grants
+}
+
+/*
+ *	Decides whether the identity ctx was authenticated as may make request,
+ *	returning ErrPermissionDenied if not. Every request is allowed while
+ *	authentication is disabled. Denials are logged as warnings and
+ *	allowed requests at debug level, with the logger of ctx, which the
+ *	transports tag with the identity.
+ */
+func Authorize(ctx context.Context, request Request) error {
+	authMutex.RLock()
+	required, restricted, grants := enabled, rbacEnabled, identityGrants
+	authMutex.RUnlock()
+	if !required {
+		return nil
+	}
+	identity, ok := IdentityFrom(ctx)
+	allowed := ok && !restricted
+	if ok && restricted {
+		for _, g := range grants[identity.Name] {
+			if g.allows(request) {
+				allowed = true
+				break
+			}
+		}
+	}
+
+	logger := kvsLogger.FromContext(ctx)
+	if !allowed {
+		logger.Warn("Permission denied", "permission", request.Permission, "namespace", request.Namespace, "key", request.Key)
+		authDecisions.Inc(request.Permission, "denied")
+		return ErrPermissionDenied
+	}
+	logger.Debug("Permission granted", "permission", request.Permission, "namespace", request.Namespace, "key", request.Key)
+	authDecisions.Inc(request.Permission, "allowed")
+	return nil
+}
@@ -0,0 +1,678 @@
+package kvsConfig
+
+import (
+	"encoding/json"
+	"fmt"
+	"gokvs/kvsDocument"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+/*
+ *	Settings tagged `reload:"true"` can be applied to a running server on SIGHUP.
+ *	Everything else requires a restart and is left untouched by Reloadable.
+ */
+type HttpConfig struct {
+	Port            int       `json:"port"`
+	DrainSeconds    int       `json:"drainSeconds"`                  // Time between failing /readyz and shutting down
+	MaxRequestBytes int64     `json:"maxRequestBytes" reload:"true"` // Larger bodies get 413, 0 means no limit
+	Tls             TlsConfig `json:"tls"`
+}
+
+type TcpConfig struct {
+	Port            int       `json:"port"`
+	MaxRequestBytes int64     `json:"maxRequestBytes" reload:"true"` // Longest operation line, 0 means no limit
+	MaxConnections  int       `json:"maxConnections"`                // Further connections are refused, 0 means no limit
+	Tls             TlsConfig `json:"tls"`
+}
+
+/*
+ *	Every change to a key is appended to the audit log at Path, when set. With
+ *	Sync, the file is synced after each entry.
+ */
+type AuditConfig struct {
+	Path string `json:"path"`
+	Sync bool   `json:"sync"`
+}
+
+/*
+ *	Each client, an authenticated identity or the remote address of an
+ *	anonymous one, gets a token bucket refilled at RequestsPerSecond and
+ *	holding up to Burst requests. TCP connections are closed after
+ *	DisconnectAfter throttled operations in a row. Separately, each remote
+ *	address may fail authentication AuthFailureBurst times, refilled at
+ *	AuthFailuresPerSecond, before its authentication attempts are refused
+ *	unchecked.
+ */
+type RateLimitConfig struct {
+	RequestsPerSecond     float64 `json:"requestsPerSecond"` // 0 means no limit
+	Burst                 int     `json:"burst"`
+	DisconnectAfter       int     `json:"disconnectAfter"`       // 0 means never
+	AuthFailuresPerSecond float64 `json:"authFailuresPerSecond"` // 0 means no limit
+	AuthFailureBurst      int     `json:"authFailureBurst"`
+}
+
+/*
+ *	A listener serves TLS when CertFile is set. With ClientCAFile, clients may
+ *	present a certificate signed by one of its CAs, and must when
+ *	RequireClientCert is set. The files are re-read when they change on disk,
+ *	so certificates can be renewed without a restart.
+ */
+type TlsConfig struct {
+	CertFile          string `json:"certFile"`
+	KeyFile           string `json:"keyFile"`
+	ClientCAFile      string `json:"clientCAFile"`
+	RequireClientCert bool   `json:"requireClientCert"`
+}
+
+func (cfg TlsConfig) Enabled() bool {
+	return cfg.CertFile != ""
+}
+
+/*
+ *	Operations slower than SlowLogThresholdMicros, measured from being queued for
+ *	the store goroutine to its reply, are kept in a ring of SlowLogSize entries.
+ *	A threshold of 0 disables the slow log.
+ *
+ *	Writes that would take the store over MaxKeys keys or MaxBytes approximate
+ *	bytes make room according to EvictionPolicy. Single values over
+ *	MaxValueBytes and ids longer than MaxKeyLength are rejected. 0 means no limit.
+ *
+ *	Indexes are rebuilt from the stored values whenever they change.
+ *
+ *	These limits apply to the default namespace. Namespaces are created at
+ *	startup or reload with their own limits, and are never dropped by a reload.
+ */
+type StoreConfig struct {
+	SlowLogThresholdMicros int64             `json:"slowLogThresholdMicros" reload:"true"`
+	SlowLogSize            int               `json:"slowLogSize" reload:"true"`
+	MaxKeys                int               `json:"maxKeys" reload:"true"`
+	MaxBytes               int64             `json:"maxBytes" reload:"true"`
+	EvictionPolicy         string            `json:"evictionPolicy" reload:"true"` // "reject", "lru", "lfu", "random" or "ttl"
+	MaxValueBytes          int64             `json:"maxValueBytes" reload:"true"`
+	MaxKeyLength           int               `json:"maxKeyLength" reload:"true"`
+	Indexes                []IndexConfig     `json:"indexes" reload:"true"`
+	Namespaces             []NamespaceConfig `json:"namespaces" reload:"true"`
+}
+
+/*
+ *	A separate keyspace with its own limits, see StoreConfig. There are no
+ *	persistence settings: like the rest of the store, a namespace and its keys
+ *	live in memory only.
+ */
+type NamespaceConfig struct {
+	Name           string `json:"name"`
+	MaxKeys        int    `json:"maxKeys"`
+	MaxBytes       int64  `json:"maxBytes"`
+	EvictionPolicy string `json:"evictionPolicy"` // "reject" when empty
+	MaxValueBytes  int64  `json:"maxValueBytes"`
+	MaxKeyLength   int    `json:"maxKeyLength"`
+}
+
+const DefaultNamespace = "default"
+
+// A secondary index over the values selected by a JSONPath, e.g. "$.email".
+type IndexConfig struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// The admin listener is bound to localhost by default. An empty address disables it.
+type AdminConfig struct {
+	Address string `json:"address"`
+}
+
+/*
+ *	With Enabled, HTTP requests must carry an API key or a bearer token in the
+ *	Authorization header and TCP connections must start with an AUTH
+ *	operation. Tokens are HS256 JWTs signed with any of TokenSecrets, so a
+ *	secret can be rotated by adding the new one before removing the old.
+ *	Settings tagged `secret:"true"` are redacted from /config and the reload
+ *	log.
+ *
+ *	Bindings give identities Roles. Once any role is declared, an identity may
+ *	only do what its roles grant; with no roles every identity may do anything.
+ */
+type AuthConfig struct {
+	Enabled      bool            `json:"enabled" reload:"true"`
+	ApiKeys      []ApiKeyConfig  `json:"apiKeys" reload:"true"`
+	TokenSecrets []string        `json:"tokenSecrets" reload:"true" secret:"true"`
+	Roles        []RoleConfig    `json:"roles" reload:"true"`
+	Bindings     []BindingConfig `json:"bindings" reload:"true"`
+
+	// Client certificates verified by a listener's clientCAFile authenticate as the identity of their subject
+	ClientCertificates []ClientCertificateConfig `json:"clientCertificates" reload:"true"`
+}
+
+/*
+ *	Subject is the certificate's distinguished name as written by
+ *	pkix.Name.String, e.g. "CN=billing,O=Acme", or just "CN=billing" to match
+ *	on the common name alone.
+ */
+type ClientCertificateConfig struct {
+	Subject  string `json:"subject"`
+	Identity string `json:"identity"`
+}
+
+type RoleConfig struct {
+	Name   string        `json:"name"`
+	Grants []GrantConfig `json:"grants"`
+}
+
+/*
+ *	Permissions on the keys starting with KeyPrefix (every key when empty) in
+ *	Namespace ("*" or empty for every namespace).
+ */
+type GrantConfig struct {
+	Namespace   string   `json:"namespace"`
+	KeyPrefix   string   `json:"keyPrefix"`
+	Permissions []string `json:"permissions"` // "read", "write", "delete" or "admin"
+}
+
+type BindingConfig struct {
+	Identity string   `json:"identity"`
+	Roles    []string `json:"roles"`
+}
+
+var Permissions = []string{"read", "write", "delete", "admin"}
+
+// A static API key, authenticating its holder as Identity.
+type ApiKeyConfig struct {
+	Identity string `json:"identity"`
+	Key      string `json:"key" secret:"true"`
+}
+
+// Shortest API key or token secret accepted
+const MinSecretLength = 16
+
+type LogOutputConfig struct {
+	Type        string `json:"type"` // "stdout" or "file"
+	Path        string `json:"path"`
+	MaxSizeMB   int64  `json:"maxSizeMB"`
+	MaxAgeHours int    `json:"maxAgeHours"`
+	MaxBackups  int    `json:"maxBackups"`
+	Compress    bool   `json:"compress"`
+}
+
+type LoggerConfig struct {
+	Level          string            `json:"level" reload:"true"`
+	Format         string            `json:"format" reload:"true"`
+	Outputs        []LogOutputConfig `json:"outputs"`
+	BufferSize     int               `json:"bufferSize"`
+	OverflowPolicy string            `json:"overflowPolicy" reload:"true"` // "block", "dropOldest" or "dropNewest"
+}
+
+type TracingConfig struct {
+	Exporter    string  `json:"exporter"` // "none", "otlp" or "file"
+	Endpoint    string  `json:"endpoint"` // OTLP/HTTP collector, e.g. http://localhost:4318
+	FilePath    string  `json:"filePath"`
+	ServiceName string  `json:"serviceName"`
+	SampleRatio float64 `json:"sampleRatio"`
+}
+
+type Config struct {
+	Http      HttpConfig      `json:"http"`
+	Tcp       TcpConfig       `json:"tcp"`
+	Admin     AdminConfig     `json:"admin"`
+	Store     StoreConfig     `json:"store"`
+	Auth      AuthConfig      `json:"auth"`
+	RateLimit RateLimitConfig `json:"rateLimit" reload:"true"`
+	Audit     AuditConfig     `json:"audit"`
+	Logger    LoggerConfig    `json:"logger"`
+	Tracing   TracingConfig   `json:"tracing"`
+}
+
+// A single setting that differs between two configs.
+type Change struct {
+	Setting    string
+	Old        interface{}
+	New        interface{}
+	Reloadable bool
+}
+
+var LogLevels = []string{"debug", "info", "warn", "error", "panic", "fatal"}
+var LogFormats = []string{"text", "json"}
+var LogOverflowPolicies = []string{"block", "dropOldest", "dropNewest"}
+var EvictionPolicies = []string{"reject", "lru", "lfu", "random", "ttl"}
+
+var current Config
+var currentMutex sync.RWMutex
+
+func Default() Config {
+	return Config{
+		Http:      HttpConfig{Port: 8080, MaxRequestBytes: 4 << 20},
+		Tcp:       TcpConfig{Port: 8081, MaxRequestBytes: 4 << 20},
+		Admin:     AdminConfig{Address: "127.0.0.1:8082"},
+		Store:     StoreConfig{SlowLogThresholdMicros: 10000, SlowLogSize: 128, EvictionPolicy: "reject", MaxValueBytes: 1 << 20, MaxKeyLength: 256},
+		RateLimit: RateLimitConfig{Burst: 50, DisconnectAfter: 100, AuthFailuresPerSecond: 1, AuthFailureBurst: 10},
+		Logger:    LoggerConfig{Level: "info", Format: "text", BufferSize: 1024, OverflowPolicy: "block"},
+		Tracing:   TracingConfig{Exporter: "none", ServiceName: "gokvs", SampleRatio: 1},
+	}
+}
+
+/*
+ *	Reads the JSON config file at path on top of the defaults and validates it.
+ *	An empty path returns the defaults.
+ */
+func Load(path string) (Config, error) {
+	cfg := Default()
+	if path == "" {
+		return cfg, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return cfg, err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("Config decoding error in %s: %v", path, err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+func (cfg Config) Validate() error {
+	if cfg.Http.Port <= 0 || cfg.Http.Port > 65535 {
+		return fmt.Errorf("Invalid http.port %d", cfg.Http.Port)
+	}
+	if cfg.Http.DrainSeconds < 0 {
+		return fmt.Errorf("Invalid http.drainSeconds %d", cfg.Http.DrainSeconds)
+	}
+	if cfg.Http.MaxRequestBytes < 0 {
+		return fmt.Errorf("Invalid http.maxRequestBytes %d", cfg.Http.MaxRequestBytes)
+	}
+	if cfg.Tcp.MaxRequestBytes < 0 {
+		return fmt.Errorf("Invalid tcp.maxRequestBytes %d", cfg.Tcp.MaxRequestBytes)
+	}
+	if cfg.Tcp.MaxConnections < 0 {
+		return fmt.Errorf("Invalid tcp.maxConnections %d", cfg.Tcp.MaxConnections)
+	}
+	if cfg.Tcp.Port <= 0 || cfg.Tcp.Port > 65535 {
+		return fmt.Errorf("Invalid tcp.port %d", cfg.Tcp.Port)
+	}
+	if cfg.Http.Port == cfg.Tcp.Port {
+		return fmt.Errorf("http.port and tcp.port must differ")
+	}
+	if cfg.Admin.Address != "" {
+		if _, _, err := net.SplitHostPort(cfg.Admin.Address); err != nil {
+			return fmt.Errorf("Invalid admin.address %q: %v", cfg.Admin.Address, err)
+		}
+		if !loopbackAddress(cfg.Admin.Address) && !cfg.Auth.Enabled {
+			return fmt.Errorf("admin.address %q is not a loopback address, which requires auth.enabled", cfg.Admin.Address)
+		}
+	}
+	if cfg.RateLimit.RequestsPerSecond < 0 {
+		return fmt.Errorf("Invalid rateLimit.requestsPerSecond %v", cfg.RateLimit.RequestsPerSecond)
+	}
+	if cfg.RateLimit.RequestsPerSecond > 0 && cfg.RateLimit.Burst < 1 {
+		return fmt.Errorf("Invalid rateLimit.burst %d, must be at least 1", cfg.RateLimit.Burst)
+	}
+	if cfg.RateLimit.DisconnectAfter < 0 {
+		return fmt.Errorf("Invalid rateLimit.disconnectAfter %d", cfg.RateLimit.DisconnectAfter)
+	}
+	if cfg.RateLimit.AuthFailuresPerSecond < 0 {
+		return fmt.Errorf("Invalid rateLimit.authFailuresPerSecond %v", cfg.RateLimit.AuthFailuresPerSecond)
+	}
+	if cfg.RateLimit.AuthFailuresPerSecond > 0 && cfg.RateLimit.AuthFailureBurst < 1 {
+		return fmt.Errorf("Invalid rateLimit.authFailureBurst %d, must be at least 1", cfg.RateLimit.AuthFailureBurst)
+	}
+	if err := cfg.Store.Validate(); err != nil {
+		return err
+	}
+	if !contains(LogLevels, cfg.Logger.Level) {
+		return fmt.Errorf("Invalid logger.level %q, expected one of %v", cfg.Logger.Level, LogLevels)
+	}
+	if err := cfg.Http.Tls.Validate("http.tls"); err != nil {
+		return err
+	}
+	if err := cfg.Tcp.Tls.Validate("tcp.tls"); err != nil {
+		return err
+	}
+	if err := cfg.Auth.Validate(); err != nil {
+		return err
+	}
+	if !contains(LogFormats, cfg.Logger.Format) {
+		return fmt.Errorf("Invalid logger.format %q, expected one of %v", cfg.Logger.Format, LogFormats)
+	}
+	if cfg.Logger.BufferSize < 0 {
+		return fmt.Errorf("Invalid logger.bufferSize %d", cfg.Logger.BufferSize)
+	}
+	if !contains(LogOverflowPolicies, cfg.Logger.OverflowPolicy) {
+		return fmt.Errorf("Invalid logger.overflowPolicy %q, expected one of %v", cfg.Logger.OverflowPolicy, LogOverflowPolicies)
+	}
+	for i, output := range cfg.Logger.Outputs {
+		switch output.Type {
+		case "stdout":
+		case "file":
+			if output.Path == "" {
+				return fmt.Errorf("logger.outputs[%d] is a file output without a path", i)
+			}
+			if output.MaxSizeMB < 0 || output.MaxAgeHours < 0 || output.MaxBackups < 0 {
+				return fmt.Errorf("logger.outputs[%d] rotation settings must not be negative", i)
+			}
+		default:
+			return fmt.Errorf("Invalid logger.outputs[%d].type %q, expected stdout or file", i, output.Type)
+		}
+	}
+	switch cfg.Tracing.Exporter {
+	case "none":
+	case "otlp":
+		if cfg.Tracing.Endpoint == "" {
+			return fmt.Errorf("tracing.endpoint is required for the otlp exporter")
+		}
+	case "file":
+		if cfg.Tracing.FilePath == "" {
+			return fmt.Errorf("tracing.filePath is required for the file exporter")
+		}
+	default:
+		return fmt.Errorf("Invalid tracing.exporter %q, expected none, otlp or file", cfg.Tracing.Exporter)
+	}
+	if cfg.Tracing.SampleRatio < 0 || cfg.Tracing.SampleRatio > 1 {
+		return fmt.Errorf("Invalid tracing.sampleRatio %v, expected a value between 0 and 1", cfg.Tracing.SampleRatio)
+	}
+	return nil
+}
+
+func (cfg TlsConfig) Validate(setting string) error {
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return fmt.Errorf("%s.certFile and %s.keyFile must be set together", setting, setting)
+	}
+	if cfg.ClientCAFile != "" && !cfg.Enabled() {
+		return fmt.Errorf("%s.clientCAFile requires %s.certFile", setting, setting)
+	}
+	if cfg.RequireClientCert && cfg.ClientCAFile == "" {
+		return fmt.Errorf("%s.requireClientCert requires %s.clientCAFile", setting, setting)
+	}
+	return nil
+}
+
+func (cfg AuthConfig) Validate() error {
+	identities := map[string]bool{}
+	for i, apiKey := range cfg.ApiKeys {
+		if apiKey.Identity == "" {
+			return fmt.Errorf("auth.apiKeys[%d] has no identity", i)
+		}
+		if identities[apiKey.Identity] {
+			return fmt.Errorf("Duplicate auth.apiKeys[%d].identity %q", i, apiKey.Identity)
+		}
+		identities[apiKey.Identity] = true
+		if len(apiKey.Key) < MinSecretLength {
+			return fmt.Errorf("auth.apiKeys[%d].key must be at least %d characters", i, MinSecretLength)
+		}
+	}
+	for i, secret := range cfg.TokenSecrets {
+		if len(secret) < MinSecretLength {
+			return fmt.Errorf("auth.tokenSecrets[%d] must be at least %d characters", i, MinSecretLength)
+		}
+	}
+	roles := map[string]bool{}
+	for i, role := range cfg.Roles {
+		if !validName(role.Name) {
+			return fmt.Errorf("Invalid auth.roles[%d].name %q, expected letters, digits, _ or -", i, role.Name)
+		}
+		if roles[role.Name] {
+			return fmt.Errorf("Duplicate auth.roles[%d].name %q", i, role.Name)
+		}
+		roles[role.Name] = true
+		for j, grant := range role.Grants {
+			if grant.Namespace != "" && grant.Namespace != "*" && !validName(grant.Namespace) {
+				return fmt.Errorf("Invalid auth.roles[%d].grants[%d].namespace %q", i, j, grant.Namespace)
+			}
+			if len(grant.Permissions) == 0 {
+				return fmt.Errorf("auth.roles[%d].grants[%d] has no permissions", i, j)
+			}
+			for _, permission := range grant.Permissions {
+				if !contains(Permissions, permission) {
+					return fmt.Errorf("Invalid permission %q in auth.roles[%d].grants[%d], expected one of %v", permission, i, j, Permissions)
+				}
+			}
+		}
+	}
+	for i, binding := range cfg.Bindings {
+		if binding.Identity == "" {
+			return fmt.Errorf("auth.bindings[%d] has no identity", i)
+		}
+		for _, role := range binding.Roles {
+			if !roles[role] {
+				return fmt.Errorf("Unknown role %q in auth.bindings[%d]", role, i)
+			}
+		}
+	}
+	subjects := map[string]bool{}
+	for i, certificate := range cfg.ClientCertificates {
+		if certificate.Subject == "" || certificate.Identity == "" {
+			return fmt.Errorf("auth.clientCertificates[%d] needs a subject and an identity", i)
+		}
+		if subjects[certificate.Subject] {
+			return fmt.Errorf("Duplicate auth.clientCertificates[%d].subject %q", i, certificate.Subject)
+		}
+		subjects[certificate.Subject] = true
+	}
+	if cfg.Enabled && len(cfg.ApiKeys) == 0 && len(cfg.TokenSecrets) == 0 && len(cfg.ClientCertificates) == 0 {
+		return fmt.Errorf("auth.enabled requires auth.apiKeys, auth.tokenSecrets or auth.clientCertificates")
+	}
+	return nil
+}
+
+// Checks the store settings, naming the first invalid one.
+func (cfg StoreConfig) Validate() error {
+	if cfg.SlowLogThresholdMicros < 0 {
+		return fmt.Errorf("Invalid store.slowLogThresholdMicros %d", cfg.SlowLogThresholdMicros)
+	}
+	if cfg.SlowLogSize <= 0 {
+		return fmt.Errorf("Invalid store.slowLogSize %d", cfg.SlowLogSize)
+	}
+	if cfg.MaxKeys < 0 {
+		return fmt.Errorf("Invalid store.maxKeys %d", cfg.MaxKeys)
+	}
+	if cfg.MaxBytes < 0 {
+		return fmt.Errorf("Invalid store.maxBytes %d", cfg.MaxBytes)
+	}
+	if cfg.MaxValueBytes < 0 {
+		return fmt.Errorf("Invalid store.maxValueBytes %d", cfg.MaxValueBytes)
+	}
+	if cfg.MaxKeyLength < 0 {
+		return fmt.Errorf("Invalid store.maxKeyLength %d", cfg.MaxKeyLength)
+	}
+	indexNames := map[string]bool{}
+	for i, index := range cfg.Indexes {
+		if !validName(index.Name) {
+			return fmt.Errorf("Invalid store.indexes[%d].name %q, expected letters, digits, _ or -", i, index.Name)
+		}
+		if indexNames[index.Name] {
+			return fmt.Errorf("Duplicate store.indexes[%d].name %q", i, index.Name)
+		}
+		indexNames[index.Name] = true
+		if _, err := kvsDocument.ParsePath(index.Path); err != nil {
+			return fmt.Errorf("Invalid store.indexes[%d].path %q: %v", i, index.Path, err)
+		}
+	}
+	namespaceNames := map[string]bool{}
+	for i, namespace := range cfg.Namespaces {
+		if err := namespace.Validate(); err != nil {
+			return fmt.Errorf("Invalid store.namespaces[%d]: %v", i, err)
+		}
+		if namespaceNames[namespace.Name] {
+			return fmt.Errorf("Duplicate store.namespaces[%d].name %q", i, namespace.Name)
+		}
+		namespaceNames[namespace.Name] = true
+	}
+	if !contains(EvictionPolicies, cfg.EvictionPolicy) {
+		return fmt.Errorf("Invalid store.evictionPolicy %q, expected one of %v", cfg.EvictionPolicy, EvictionPolicies)
+	}
+	return nil
+}
+
+func (cfg NamespaceConfig) Validate() error {
+	if !validName(cfg.Name) {
+		return fmt.Errorf("Invalid name %q, expected letters, digits, _ or -", cfg.Name)
+	}
+	if cfg.Name == DefaultNamespace {
+		return fmt.Errorf("The %s namespace is configured by the store settings", DefaultNamespace)
+	}
+	if cfg.MaxKeys < 0 || cfg.MaxBytes < 0 || cfg.MaxValueBytes < 0 || cfg.MaxKeyLength < 0 {
+		return fmt.Errorf("Limits of namespace %q must not be negative", cfg.Name)
+	}
+	if cfg.EvictionPolicy != "" && !contains(EvictionPolicies, cfg.EvictionPolicy) {
+		return fmt.Errorf("Invalid evictionPolicy %q, expected one of %v", cfg.EvictionPolicy, EvictionPolicies)
+	}
+	return nil
+}
+
+func Current() Config {
+	currentMutex.RLock()
+	defer currentMutex.RUnlock()
+	return current
+}
+
+func SetCurrent(cfg Config) {
+	currentMutex.Lock()
+	defer currentMutex.Unlock()
+	current = cfg
+}
+
+/*
+ *	Lists every setting that differs between old and new, named by its json path
+ *	(e.g. "logger.level"). Secrets are compared as they are, but their Old and
+ *	New values are redacted, as changes get logged.
+ */
+func Diff(old, new Config) []Change {
+	changes := []Change{}
+	diffValues("", reflect.ValueOf(old), reflect.ValueOf(new), reflect.ValueOf(old.Redacted()), reflect.ValueOf(new.Redacted()), false, &changes)
+	return changes
+}
+
+// Replaces every non-empty secret
+const RedactedSecret = "REDACTED"
+
+// Returns a copy of cfg with the settings tagged `secret:"true"` replaced by RedactedSecret.
+func (cfg Config) Redacted() Config {
+	redacted := reflect.New(reflect.TypeOf(cfg)).Elem()
+	copyRedacted(redacted, reflect.ValueOf(cfg), false)
+	return redacted.Interface().(Config)
+}
+
+func copyRedacted(dst, src reflect.Value, secret bool) {
+	switch src.Kind() {
+	case reflect.Struct:
+		for i := 0; i < src.NumField(); i++ {
+			copyRedacted(dst.Field(i), src.Field(i), secret || src.Type().Field(i).Tag.Get("secret") == "true")
+		}
+	case reflect.Slice:
+		if src.IsNil() {
+			return
+		}
+		dst.Set(reflect.MakeSlice(src.Type(), src.Len(), src.Len()))
+		for i := 0; i < src.Len(); i++ {
+			copyRedacted(dst.Index(i), src.Index(i), secret)
+		}
+	case reflect.String:
+		if secret && src.Len() > 0 {
+			dst.SetString(RedactedSecret)
+			return
+		}
+		dst.Set(src)
+	default:
+		dst.Set(src)
+	}
+}
+
+/*
+ *	Returns old with every reloadable setting taken from new, so that settings
+ *	requiring a restart keep their running values.
+ */
+func Reloadable(old, new Config) Config {
+	merged := old
+	mergeReloadable(reflect.ValueOf(&merged).Elem(), reflect.ValueOf(new), false)
+	return merged
+}
+
+// Compares old with new, reporting the matching oldShown and newShown values.
+func diffValues(prefix string, old, new, oldShown, newShown reflect.Value, reloadable bool, changes *[]Change) {
+	if old.Kind() != reflect.Struct {
+		if !reflect.DeepEqual(old.Interface(), new.Interface()) {
+			*changes = append(*changes, Change{
+				Setting:    prefix,
+				Old:        oldShown.Interface(),
+				New:        newShown.Interface(),
+				Reloadable: reloadable,
+			})
+		}
+		return
+	}
+	for i := 0; i < old.NumField(); i++ {
+		field := old.Type().Field(i)
+		diffValues(
+			settingName(prefix, field),
+			old.Field(i),
+			new.Field(i),
+			oldShown.Field(i),
+			newShown.Field(i),
+			reloadable || field.Tag.Get("reload") == "true",
+			changes,
+		)
+	}
+}
+
+func mergeReloadable(dst, src reflect.Value, reloadable bool) {
+	if dst.Kind() != reflect.Struct {
+		if reloadable {
+			dst.Set(src)
+		}
+		return
+	}
+	for i := 0; i < dst.NumField(); i++ {
+		field := dst.Type().Field(i)
+		mergeReloadable(dst.Field(i), src.Field(i), reloadable || field.Tag.Get("reload") == "true")
+	}
+}
+
+func settingName(prefix string, field reflect.StructField) string {
+	name := strings.Split(field.Tag.Get("json"), ",")[0]
+	if name == "" {
+		name = field.Name
+	}
+	if prefix == "" {
+		return name
+	}
+	return prefix + "." + name
+}
+
+func loopbackAddress(address string) bool {
+	host, _, _ := net.SplitHostPort(address)
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Index and namespace names appear in URLs and metric labels.
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func contains(s []string, val string) bool {
+	for _, v := range s {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,210 @@
+package kvsConfig
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("Empty path returns defaults", func(t *testing.T) {
+		cfg, err := Load("")
+		if err != nil {
+			t.Errorf("Load returned err %v", err)
+		}
+		if !reflect.DeepEqual(cfg, Default()) {
+			t.Errorf("Expected defaults, got %+v", cfg)
+		}
+	})
+
+	t.Run("File overrides defaults", func(t *testing.T) {
+		path := filepath.Join(dir, "valid.json")
+		os.WriteFile(path, []byte(`{"logger": {"level": "error"}}`), 0600)
+		cfg, err := Load(path)
+		if err != nil {
+			t.Errorf("Load returned err %v", err)
+		}
+		if cfg.Logger.Level != "error" || cfg.Http.Port != 8080 {
+			t.Errorf("Unexpected config %+v", cfg)
+		}
+	})
+
+	t.Run("Invalid config is rejected", func(t *testing.T) {
+		path := filepath.Join(dir, "invalid.json")
+		os.WriteFile(path, []byte(`{"logger": {"level": "verbose"}}`), 0600)
+		if _, err := Load(path); err == nil {
+			t.Errorf("Expected invalid level to be rejected")
+		}
+	})
+
+	t.Run("Invalid indexes are rejected", func(t *testing.T) {
+		for _, indexes := range []string{
+			`[{"name": "", "path": "$.a"}]`,
+			`[{"name": "a b", "path": "$.a"}]`,
+			`[{"name": "a", "path": "$.a"}, {"name": "a", "path": "$.b"}]`,
+			`[{"name": "a", "path": "$["}]`,
+		} {
+			path := filepath.Join(dir, "indexes.json")
+			os.WriteFile(path, []byte(`{"store": {"indexes": `+indexes+`}}`), 0600)
+			if _, err := Load(path); err == nil {
+				t.Errorf("Expected indexes %s to be rejected", indexes)
+			}
+		}
+	})
+
+	t.Run("Invalid namespaces are rejected", func(t *testing.T) {
+		for _, namespaces := range []string{
+			`[{"name": ""}]`,
+			`[{"name": "default"}]`,
+			`[{"name": "a"}, {"name": "a"}]`,
+			`[{"name": "a", "maxKeys": -1}]`,
+			`[{"name": "a", "evictionPolicy": "oldest"}]`,
+		} {
+			path := filepath.Join(dir, "namespaces.json")
+			os.WriteFile(path, []byte(`{"store": {"namespaces": `+namespaces+`}}`), 0600)
+			if _, err := Load(path); err == nil {
+				t.Errorf("Expected namespaces %s to be rejected", namespaces)
+			}
+		}
+	})
+
+	t.Run("Invalid rate limits are rejected", func(t *testing.T) {
+		for _, config := range []string{
+			`{"rateLimit": {"requestsPerSecond": -1}}`,
+			`{"rateLimit": {"requestsPerSecond": 10, "burst": 0}}`,
+			`{"rateLimit": {"disconnectAfter": -1}}`,
+			`{"tcp": {"maxConnections": -1}}`,
+		} {
+			path := filepath.Join(dir, "ratelimit.json")
+			os.WriteFile(path, []byte(config), 0600)
+			if _, err := Load(path); err == nil {
+				t.Errorf("Expected %s to be rejected", config)
+			}
+		}
+	})
+
+	t.Run("Public admin listener requires auth", func(t *testing.T) {
+		path := filepath.Join(dir, "admin.json")
+		for config, valid := range map[string]bool{
+			`{"admin": {"address": "0.0.0.0:8082"}}`:   false,
+			`{"admin": {"address": ":8082"}}`:          false,
+			`{"admin": {"address": "localhost:8082"}}`: true,
+			`{"admin": {"address": "[::1]:8082"}}`:     true,
+			`{"admin": {"address": ":8082"}, "auth": {"enabled": true, "apiKeys": [{"identity": "ops", "key": "ops-key-0123456789"}]}}`: true,
+		} {
+			os.WriteFile(path, []byte(config), 0600)
+			if _, err := Load(path); (err == nil) != valid {
+				t.Errorf("Expected %s to be valid: %v, got %v", config, valid, err)
+			}
+		}
+	})
+
+	t.Run("Invalid TLS settings are rejected", func(t *testing.T) {
+		for _, tls := range []string{
+			`{"certFile": "server.pem"}`,
+			`{"keyFile": "server.key"}`,
+			`{"clientCAFile": "ca.pem"}`,
+			`{"certFile": "server.pem", "keyFile": "server.key", "requireClientCert": true}`,
+		} {
+			path := filepath.Join(dir, "tls.json")
+			os.WriteFile(path, []byte(`{"tcp": {"tls": `+tls+`}}`), 0600)
+			if _, err := Load(path); err == nil {
+				t.Errorf("Expected TLS settings %s to be rejected", tls)
+			}
+		}
+	})
+}
+
+func TestDiffAndReloadable(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.Http.Port = 9090
+	new.Logger.Level = "error"
+
+	changes := Diff(old, new)
+	if len(changes) != 2 {
+		t.Fatalf("Expected 2 changes, got %v", changes)
+	}
+	for _, change := range changes {
+		switch change.Setting {
+		case "http.port":
+			if change.Reloadable {
+				t.Errorf("http.port should not be reloadable")
+			}
+		case "logger.level":
+			if !change.Reloadable {
+				t.Errorf("logger.level should be reloadable")
+			}
+		default:
+			t.Errorf("Unexpected change %v", change.Setting)
+		}
+	}
+
+	applied := Reloadable(old, new)
+	if applied.Http.Port != old.Http.Port {
+		t.Errorf("Expected http.port to keep running value %d, got %d", old.Http.Port, applied.Http.Port)
+	}
+	if applied.Logger.Level != "error" {
+		t.Errorf("Expected logger.level to be reloaded, got %v", applied.Logger.Level)
+	}
+}
+
+func TestRedacted(t *testing.T) {
+	old := Default()
+	new := Default()
+	new.Auth = AuthConfig{
+		Enabled:      true,
+		ApiKeys:      []ApiKeyConfig{{Identity: "ci", Key: "ci-key-0123456789"}},
+		TokenSecrets: []string{"secret-0123456789"},
+	}
+
+	redacted := new.Redacted()
+	if redacted.Auth.ApiKeys[0].Identity != "ci" || redacted.Auth.ApiKeys[0].Key != RedactedSecret || redacted.Auth.TokenSecrets[0] != RedactedSecret {
+		t.Errorf("Expected only the secrets to be redacted, got %+v", redacted.Auth)
+	}
+	if new.Auth.ApiKeys[0].Key != "ci-key-0123456789" || new.Auth.TokenSecrets[0] != "secret-0123456789" {
+		t.Errorf("Expected Redacted to leave the config untouched, got %+v", new.Auth)
+	}
+	for _, change := range Diff(old, new) {
+		if strings.Contains(fmt.Sprint(change.New), "0123456789") {
+			t.Errorf("Expected secrets to be redacted from changes, got %v", change)
+		}
+	}
+
+	t.Run("Changed secrets are reloaded", func(t *testing.T) {
+		rotated := new
+		rotated.Auth.ApiKeys = []ApiKeyConfig{{Identity: "ci", Key: "ci-key-9876543210"}}
+		changes := Diff(new, rotated)
+		if len(changes) != 1 || changes[0].Setting != "auth.apiKeys" || !changes[0].Reloadable {
+			t.Fatalf("Expected a reloadable auth.apiKeys change, got %v", changes)
+		}
+		if strings.Contains(fmt.Sprint(changes[0].Old, changes[0].New), "0123456789") || strings.Contains(fmt.Sprint(changes[0].New), "9876543210") {
+			t.Errorf("Expected the change to be redacted, got %v", changes[0])
+		}
+		if applied := Reloadable(new, rotated); applied.Auth.ApiKeys[0].Key != "ci-key-9876543210" {
+			t.Errorf("Expected the new key to be applied, got %v", applied.Auth.ApiKeys)
+		}
+	})
+
+	for _, auth := range []string{
+		`{"enabled": true}`,
+		`{"apiKeys": [{"identity": "ci", "key": "short"}]}`,
+		`{"apiKeys": [{"identity": "", "key": "ci-key-0123456789"}]}`,
+		`{"tokenSecrets": ["short"]}`,
+		`{"roles": [{"name": "r", "grants": [{"permissions": ["execute"]}]}]}`,
+		`{"roles": [{"name": "r", "grants": [{"permissions": []}]}]}`,
+		`{"roles": [{"name": "r", "grants": [{"namespace": "a b", "permissions": ["read"]}]}]}`,
+		`{"bindings": [{"identity": "ci", "roles": ["missing"]}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "auth.json")
+		os.WriteFile(path, []byte(`{"auth": `+auth+`}`), 0600)
+		if _, err := Load(path); err == nil {
+			t.Errorf("Expected auth %s to be rejected", auth)
+		}
+	}
+}
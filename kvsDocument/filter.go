@@ -0,0 +1,420 @@
+package kvsDocument
+
+import (
+	"fmt"
+	"strings"
+)
+
+/*
+ *	A small filter language over documents:
+ *		age >= 18 AND (country = "NL" OR country = "BE")
+ *		status IN ("active", "trial") AND NOT exists($.deletedAt)
+ *	Fields are paths (see ParsePath), compared with =, !=, <, <=, > or >= to a
+ *	JSON literal, or tested with IN (...), NOT IN (...) and exists(...).
+ *	Keywords are case-insensitive and strings may use single or double quotes.
+ *	A path selecting several values matches if any of them does, and a path
+ *	selecting nothing never matches a comparison. Numbers compare as numbers,
+ *	strings lexically, and values of different types are never ordered.
+ */
+type Filter interface {
+	Match(doc interface{}) bool
+}
+
+type andFilter struct{ left, right Filter }
+type orFilter struct{ left, right Filter }
+type notFilter struct{ filter Filter }
+type existsFilter struct{ path Path }
+
+type compareFilter struct {
+	path  Path
+	op    string
+	value interface{}
+}
+
+type inFilter struct {
+	path   Path
+	values []interface{}
+}
+
+func (f andFilter) Match(doc interface{}) bool {
+	return f.left.Match(doc) && f.right.Match(doc)
+}
+
+func (f orFilter) Match(doc interface{}) bool {
+	return f.left.Match(doc) || f.right.Match(doc)
+}
+
+func (f notFilter) Match(doc interface{}) bool {
+	return !f.filter.Match(doc)
+}
+
+func (f existsFilter) Match(doc interface{}) bool {
+	return len(f.path.Select(doc)) > 0
+}
+
+func (f compareFilter) Match(doc interface{}) bool {
+	for _, selected := range f.path.Select(doc) {
+		if compareMatches(selected, f.op, f.value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f inFilter) Match(doc interface{}) bool {
+	for _, selected := range f.path.Select(doc) {
+		for _, value := range f.values {
+			if Equal(selected, value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func compareMatches(a interface{}, op string, b interface{}) bool {
+	switch op {
+	case "=":
+		return Equal(a, b)
+	case "!=":
+		return !Equal(a, b)
+	}
+	order, ok := compareOrder(a, b)
+	if !ok {
+		return false
+	}
+	switch op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	}
+	return order >= 0
+}
+
+// Orders two numbers or two strings. Anything else is unordered.
+func compareOrder(a, b interface{}) (int, bool) {
+	if aNumber, ok := toRat(a); ok {
+		if bNumber, ok := toRat(b); ok {
+			return aNumber.Cmp(bNumber), true
+		}
+		return 0, false
+	}
+	aText, aOk := a.(string)
+	bText, bOk := b.(string)
+	if !aOk || !bOk {
+		return 0, false
+	}
+	return strings.Compare(aText, bText), true
+}
+
+/*
+ *	Parsing
+ */
+const (
+	wordToken = iota
+	stringToken
+	symbolToken
+	endToken
+)
+
+type filterToken struct {
+	kind int
+	text string
+}
+
+var comparisonOps = map[string]string{"=": "=", "==": "=", "!=": "!=", "<": "<", "<=": "<=", ">": ">", ">=": ">="}
+
+func tokenizeFilter(text string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(' || c == ')' || c == ',':
+			tokens = append(tokens, filterToken{symbolToken, string(c)})
+			i++
+		case strings.ContainsRune("=!<>", rune(c)):
+			end := i + 1
+			if end < len(text) && text[end] == '=' {
+				end++
+			}
+			if _, ok := comparisonOps[text[i:end]]; !ok {
+				return nil, fmt.Errorf("Unexpected %q in filter", text[i:end])
+			}
+			tokens = append(tokens, filterToken{symbolToken, text[i:end]})
+			i = end
+		case c == '"' || c == '\'':
+			value, end, err := readQuoted(text, i)
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, filterToken{stringToken, value})
+			i = end
+		default:
+			end := wordEnd(text, i)
+			tokens = append(tokens, filterToken{wordToken, text[i:end]})
+			i = end
+		}
+	}
+	return append(tokens, filterToken{kind: endToken}), nil
+}
+
+// Reads the quoted string starting at text[start], returning it unquoted and the index after it.
+func readQuoted(text string, start int) (string, int, error) {
+	quote := text[start]
+	value := strings.Builder{}
+	for i := start + 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			if i+1 == len(text) {
+				break
+			}
+			i++
+			switch text[i] {
+			case 'n':
+				value.WriteByte('\n')
+			case 't':
+				value.WriteByte('\t')
+			default:
+				value.WriteByte(text[i])
+			}
+		case quote:
+			return value.String(), i + 1, nil
+		default:
+			value.WriteByte(text[i])
+		}
+	}
+	return "", 0, fmt.Errorf("Unterminated string in filter")
+}
+
+// Words are paths, keywords and literals. Brackets in paths may hold quoted names with spaces.
+func wordEnd(text string, start int) int {
+	depth := 0
+	for i := start; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == '[':
+			depth++
+		case c == ']':
+			depth--
+		case depth > 0 && (c == '\'' || c == '"'):
+			if _, end, err := readQuoted(text, i); err == nil {
+				i = end - 1
+			}
+		case depth == 0 && strings.ContainsRune(" \t\n\r(),=!<>", rune(c)):
+			return i
+		}
+	}
+	return len(text)
+}
+
+// Deepest nesting of NOT and parentheses a filter may have, so untrusted filters cannot exhaust the stack
+const maxFilterDepth = 64
+
+type filterParser struct {
+	tokens []filterToken
+	next   int
+	depth  int
+}
+
+// Counts a level of nesting, failing past maxFilterDepth. Paired with a deferred p.depth--.
+func (p *filterParser) nest() error {
+	if p.depth++; p.depth > maxFilterDepth {
+		return fmt.Errorf("Filter nested too deeply, at most %d levels of NOT and parentheses", maxFilterDepth)
+	}
+	return nil
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.tokens[p.next]
+}
+
+func (p *filterParser) take() filterToken {
+	token := p.tokens[p.next]
+	if token.kind != endToken {
+		p.next++
+	}
+	return token
+}
+
+func (p *filterParser) keyword(word string) bool {
+	token := p.peek()
+	if token.kind == wordToken && strings.EqualFold(token.text, word) {
+		p.next++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(symbol string) error {
+	if token := p.take(); token.kind != symbolToken || token.text != symbol {
+		return fmt.Errorf("Expected %q in filter, got %s", symbol, describeToken(token))
+	}
+	return nil
+}
+
+func describeToken(token filterToken) string {
+	if token.kind == endToken {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", token.text)
+}
+
+func ParseFilter(text string) (Filter, error) {
+	tokens, err := tokenizeFilter(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{tokens: tokens}
+	filter, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if token := p.peek(); token.kind != endToken {
+		return nil, fmt.Errorf("Unexpected %s in filter", describeToken(token))
+	}
+	return filter, nil
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.keyword("OR") {
+		var right Filter
+		right, err = p.parseAnd()
+		left = orFilter{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	left, err := p.parseNot()
+	for err == nil && p.keyword("AND") {
+		var right Filter
+		right, err = p.parseNot()
+		left = andFilter{left, right}
+	}
+	return left, err
+}
+
+func (p *filterParser) parseNot() (Filter, error) {
+	if p.keyword("NOT") {
+		defer func() { p.depth-- }()
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		filter, err := p.parseNot()
+		return notFilter{filter}, err
+	}
+	if token := p.peek(); token.kind == symbolToken && token.text == "(" {
+		p.take()
+		defer func() { p.depth-- }()
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		filter, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return filter, p.expect(")")
+	}
+	if p.keyword("EXISTS") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		path, err := p.parsePath()
+		if err != nil {
+			return nil, err
+		}
+		return existsFilter{path}, p.expect(")")
+	}
+	return p.parsePredicate()
+}
+
+func (p *filterParser) parsePath() (Path, error) {
+	token := p.take()
+	if token.kind != wordToken {
+		return Path{}, fmt.Errorf("Expected a field in filter, got %s", describeToken(token))
+	}
+	return ParsePath(token.text)
+}
+
+func (p *filterParser) parsePredicate() (Filter, error) {
+	path, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	negated := p.keyword("NOT")
+	if p.keyword("IN") {
+		values, err := p.parseList()
+		if err != nil {
+			return nil, err
+		}
+		var filter Filter = inFilter{path, values}
+		if negated {
+			filter = notFilter{filter}
+		}
+		return filter, nil
+	}
+	if negated {
+		return nil, fmt.Errorf("Expected IN after NOT in filter, got %s", describeToken(p.peek()))
+	}
+	token := p.take()
+	op, ok := comparisonOps[token.text]
+	if token.kind != symbolToken || !ok {
+		return nil, fmt.Errorf("Expected a comparison in filter, got %s", describeToken(token))
+	}
+	value, err := p.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	return compareFilter{path, op, value}, nil
+}
+
+func (p *filterParser) parseList() ([]interface{}, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	var values []interface{}
+	for {
+		value, err := p.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+		token := p.take()
+		if token.kind == symbolToken && token.text == ")" {
+			return values, nil
+		}
+		if token.kind != symbolToken || token.text != "," {
+			return nil, fmt.Errorf("Expected \",\" or \")\" in filter, got %s", describeToken(token))
+		}
+	}
+}
+
+// Literals are strings, numbers, true, false and null.
+func (p *filterParser) parseLiteral() (interface{}, error) {
+	token := p.take()
+	switch token.kind {
+	case stringToken:
+		return token.text, nil
+	case wordToken:
+		switch strings.ToLower(token.text) {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		if value, err := Decode([]byte(token.text)); err == nil {
+			if _, ok := toRat(value); ok {
+				return value, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("Expected a value in filter, got %s", describeToken(token))
+}
@@ -0,0 +1,418 @@
+package kvsDocument
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+ *	Operations on decoded JSON documents: maps, slices, strings, bools, nil and
+ *	numbers, which may be json.Number or any Go numeric type. Documents are
+ *	never modified in place, since stored values are shared with readers;
+ *	every change works on a copy.
+ */
+const JsonPatchContentType = "application/json-patch+json"
+const MergePatchContentType = "application/merge-patch+json"
+
+var ErrNotDocument = errors.New("Value is not a JSON document.")
+
+// A parsed patch, applied to a copy of a document.
+type Patch interface {
+	Apply(doc interface{}) (interface{}, error)
+}
+
+// Decodes a JSON document, keeping numbers as json.Number.
+func Decode(data []byte) (interface{}, error) {
+	var doc interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if decoder.More() {
+		return nil, fmt.Errorf("Unexpected data after JSON document")
+	}
+	return doc, nil
+}
+
+func DeepCopy(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		docCopy := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			docCopy[key] = DeepCopy(item)
+		}
+		return docCopy
+	case []interface{}:
+		docCopy := make([]interface{}, len(v))
+		for i, item := range v {
+			docCopy[i] = DeepCopy(item)
+		}
+		return docCopy
+	}
+	return doc
+}
+
+// Compares documents as JSON values, so 1, 1.0 and json.Number("1") are equal.
+func Equal(a, b interface{}) bool {
+	if aNumber, ok := toRat(a); ok {
+		bNumber, ok := toRat(b)
+		return ok && aNumber.Cmp(bNumber) == 0
+	}
+	switch av := a.(type) {
+	case map[string]interface{}:
+		bv, ok := b.(map[string]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for key, item := range av {
+			other, ok := bv[key]
+			if !ok || !Equal(item, other) {
+				return false
+			}
+		}
+		return true
+	case []interface{}:
+		bv, ok := b.([]interface{})
+		if !ok || len(av) != len(bv) {
+			return false
+		}
+		for i := range av {
+			if !Equal(av[i], bv[i]) {
+				return false
+			}
+		}
+		return true
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	case nil:
+		return b == nil
+	}
+	return false
+}
+
+func toRat(value interface{}) (*big.Rat, bool) {
+	var text string
+	switch v := value.(type) {
+	case json.Number:
+		text = v.String()
+	case float64:
+		text = strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		text = strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		text = fmt.Sprintf("%d", v)
+	default:
+		return nil, false
+	}
+	return new(big.Rat).SetString(text)
+}
+
+/*
+ *	RFC 6901 JSON Pointers
+ */
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("JSON pointer %q must start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+	return tokens, nil
+}
+
+// Parses an array index token. "-" (past the end) is only allowed when adding.
+func arrayIndex(token string, length int, allowEnd bool) (int, error) {
+	if token == "-" && allowEnd {
+		return length, nil
+	}
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("Invalid array index %q", token)
+	}
+	index, err := strconv.Atoi(token)
+	if err != nil || index < 0 {
+		return 0, fmt.Errorf("Invalid array index %q", token)
+	}
+	limit := length - 1
+	if allowEnd {
+		limit = length
+	}
+	if index > limit {
+		return 0, fmt.Errorf("Array index %d out of range", index)
+	}
+	return index, nil
+}
+
+func get(doc interface{}, tokens []string) (interface{}, error) {
+	current := doc
+	for _, token := range tokens {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			item, ok := v[token]
+			if !ok {
+				return nil, fmt.Errorf("Member %q does not exist", token)
+			}
+			current = item
+		case []interface{}:
+			index, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			current = v[index]
+		default:
+			return nil, fmt.Errorf("Cannot address %q in a scalar value", token)
+		}
+	}
+	return current, nil
+}
+
+/*
+ *	Returns doc with fn applied to the container holding the last token. fn
+ *	returns the new container, which lets it grow or shrink arrays.
+ */
+func update(doc interface{}, tokens []string, fn func(container interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(tokens) == 1 {
+		return fn(doc, tokens[0])
+	}
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		item, ok := v[tokens[0]]
+		if !ok {
+			return nil, fmt.Errorf("Member %q does not exist", tokens[0])
+		}
+		updated, err := update(item, tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		v[tokens[0]] = updated
+		return v, nil
+	case []interface{}:
+		index, err := arrayIndex(tokens[0], len(v), false)
+		if err != nil {
+			return nil, err
+		}
+		updated, err := update(v[index], tokens[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		v[index] = updated
+		return v, nil
+	}
+	return nil, fmt.Errorf("Cannot address %q in a scalar value", tokens[0])
+}
+
+func add(doc interface{}, tokens []string, value interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		return value, nil
+	}
+	return update(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch v := container.(type) {
+		case map[string]interface{}:
+			v[token] = value
+			return v, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(v), true)
+			if err != nil {
+				return nil, err
+			}
+			v = append(v, nil)
+			copy(v[index+1:], v[index:])
+			v[index] = value
+			return v, nil
+		}
+		return nil, fmt.Errorf("Cannot add %q to a scalar value", token)
+	})
+}
+
+func remove(doc interface{}, tokens []string) (interface{}, error) {
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("Cannot remove the whole document")
+	}
+	return update(doc, tokens, func(container interface{}, token string) (interface{}, error) {
+		switch v := container.(type) {
+		case map[string]interface{}:
+			if _, ok := v[token]; !ok {
+				return nil, fmt.Errorf("Member %q does not exist", token)
+			}
+			delete(v, token)
+			return v, nil
+		case []interface{}:
+			index, err := arrayIndex(token, len(v), false)
+			if err != nil {
+				return nil, err
+			}
+			return append(v[:index], v[index+1:]...), nil
+		}
+		return nil, fmt.Errorf("Cannot remove %q from a scalar value", token)
+	})
+}
+
+/*
+ *	RFC 6902 JSON Patch
+ */
+type JsonPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  *string         `json:"path"`
+	From  *string         `json:"from"`
+	Value json.RawMessage `json:"value"` // Raw, so a null value can be told from a missing one
+
+	value interface{}
+}
+
+type JsonPatch []JsonPatchOperation
+
+func ParseJsonPatch(data []byte) (JsonPatch, error) {
+	var patch JsonPatch
+	if err := json.Unmarshal(data, &patch); err != nil {
+		return nil, fmt.Errorf("Invalid JSON Patch: %v", err)
+	}
+	for i := range patch {
+		operation := &patch[i]
+		if operation.Value != nil {
+			value, err := Decode(operation.Value)
+			if err != nil {
+				return nil, fmt.Errorf("JSON Patch operation %d has an invalid value: %v", i, err)
+			}
+			operation.value = value
+		}
+		if operation.Path == nil {
+			return nil, fmt.Errorf("JSON Patch operation %d has no path", i)
+		}
+		switch operation.Op {
+		case "add", "replace", "test":
+			if operation.Value == nil {
+				return nil, fmt.Errorf("JSON Patch operation %d (%s) has no value", i, operation.Op)
+			}
+		case "move", "copy":
+			if operation.From == nil {
+				return nil, fmt.Errorf("JSON Patch operation %d (%s) has no from", i, operation.Op)
+			}
+		case "remove":
+		default:
+			return nil, fmt.Errorf("JSON Patch operation %d has unknown op %q", i, operation.Op)
+		}
+	}
+	return patch, nil
+}
+
+// Applies every operation in order. If one fails, none take effect.
+func (patch JsonPatch) Apply(doc interface{}) (interface{}, error) {
+	result := DeepCopy(doc)
+	for i, operation := range patch {
+		var err error
+		result, err = operation.apply(result)
+		if err != nil {
+			return nil, fmt.Errorf("JSON Patch operation %d (%s %s) failed: %v", i, operation.Op, *operation.Path, err)
+		}
+	}
+	return result, nil
+}
+
+func (operation JsonPatchOperation) apply(doc interface{}) (interface{}, error) {
+	path, err := parsePointer(*operation.Path)
+	if err != nil {
+		return nil, err
+	}
+	switch operation.Op {
+	case "add":
+		return add(doc, path, DeepCopy(operation.value))
+	case "remove":
+		return remove(doc, path)
+	case "replace":
+		if _, err := get(doc, path); err != nil {
+			return nil, err
+		}
+		if len(path) == 0 {
+			return DeepCopy(operation.value), nil
+		}
+		doc, _ = remove(doc, path)
+		return add(doc, path, DeepCopy(operation.value))
+	case "test":
+		current, err := get(doc, path)
+		if err != nil {
+			return nil, err
+		}
+		if !Equal(current, operation.value) {
+			return nil, fmt.Errorf("Test failed")
+		}
+		return doc, nil
+	}
+
+	from, err := parsePointer(*operation.From)
+	if err != nil {
+		return nil, err
+	}
+	value, err := get(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	if operation.Op == "copy" {
+		return add(doc, path, DeepCopy(value))
+	}
+	if *operation.From == *operation.Path {
+		return doc, nil
+	}
+	if strings.HasPrefix(*operation.Path, *operation.From+"/") {
+		return nil, fmt.Errorf("Cannot move a value into one of its children")
+	}
+	doc, err = remove(doc, from)
+	if err != nil {
+		return nil, err
+	}
+	return add(doc, path, value)
+}
+
+/*
+ *	RFC 7396 JSON Merge Patch
+ */
+type MergePatch struct {
+	patch interface{}
+}
+
+func ParseMergePatch(data []byte) (MergePatch, error) {
+	patch, err := Decode(data)
+	if err != nil {
+		return MergePatch{}, fmt.Errorf("Invalid JSON Merge Patch: %v", err)
+	}
+	return MergePatch{patch: patch}, nil
+}
+
+func NewMergePatch(patch interface{}) MergePatch {
+	return MergePatch{patch: patch}
+}
+
+func (patch MergePatch) Apply(doc interface{}) (interface{}, error) {
+	return mergePatch(DeepCopy(doc), patch.patch), nil
+}
+
+func mergePatch(target, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return DeepCopy(patch)
+	}
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+		} else {
+			targetObject[key] = mergePatch(targetObject[key], value)
+		}
+	}
+	return targetObject
+}
@@ -0,0 +1,248 @@
+package kvsDocument
+
+import (
+	"strings"
+	"testing"
+)
+
+func mustDecode(t *testing.T, text string) interface{} {
+	t.Helper()
+	doc, err := Decode([]byte(text))
+	if err != nil {
+		t.Fatalf("Decode(%s) returned err %v", text, err)
+	}
+	return doc
+}
+
+// Cases from RFC 6902 appendix A
+func TestJsonPatch(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		doc   string
+		patch string
+		want  string
+	}{
+		{"Add object member", `{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"baz":"qux","foo":"bar"}`},
+		{"Add array element", `{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{"Append array element", `{"foo":[1]}`, `[{"op":"add","path":"/foo/-","value":2}]`, `{"foo":[1,2]}`},
+		{"Remove object member", `{"baz":"qux","foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, `{"foo":"bar"}`},
+		{"Remove array element", `{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{"Replace", `{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{"Move", `{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{"Move array element", `{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{"Copy", `{"a":{"b":1}}`, `[{"op":"copy","from":"/a","path":"/c"}]`, `{"a":{"b":1},"c":{"b":1}}`},
+		{"Test passes", `{"baz":"qux","foo":["a",2,"c"]}`, `[{"op":"test","path":"/baz","value":"qux"},{"op":"test","path":"/foo/1","value":2.0}]`, `{"baz":"qux","foo":["a",2,"c"]}`},
+		{"Escaped pointer", `{"/":9,"~1":10}`, `[{"op":"test","path":"/~01","value":10},{"op":"replace","path":"/~1","value":1}]`, `{"/":1,"~1":10}`},
+		{"Add null value", `{}`, `[{"op":"add","path":"/a","value":null}]`, `{"a":null}`},
+		{"Replace whole document", `{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := ParseJsonPatch([]byte(test.patch))
+			if err != nil {
+				t.Fatalf("ParseJsonPatch returned err %v", err)
+			}
+			doc := mustDecode(t, test.doc)
+			got, err := patch.Apply(doc)
+			if err != nil {
+				t.Fatalf("Apply returned err %v", err)
+			}
+			if !Equal(got, mustDecode(t, test.want)) {
+				t.Errorf("Expected %s, got %v", test.want, got)
+			}
+			if !Equal(doc, mustDecode(t, test.doc)) {
+				t.Errorf("Apply modified the original document: %v", doc)
+			}
+		})
+	}
+}
+
+func TestJsonPatchErrors(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		doc   string
+		patch string
+	}{
+		{"Missing target", `{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":"qux"}]`},
+		{"Failed test", `{"baz":"qux"}`, `[{"op":"test","path":"/baz","value":"bar"}]`},
+		{"Remove missing member", `{}`, `[{"op":"remove","path":"/a"}]`},
+		{"Index out of range", `{"a":[1]}`, `[{"op":"replace","path":"/a/1","value":2}]`},
+		{"Leading zero index", `{"a":[1,2]}`, `[{"op":"remove","path":"/a/01"}]`},
+		{"Move into own child", `{"a":{"b":{}}}`, `[{"op":"move","from":"/a","path":"/a/b/c"}]`},
+		{"Later failure undoes earlier operations", `{"a":1}`, `[{"op":"replace","path":"/a","value":2},{"op":"test","path":"/a","value":3}]`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			patch, err := ParseJsonPatch([]byte(test.patch))
+			if err != nil {
+				t.Fatalf("ParseJsonPatch returned err %v", err)
+			}
+			doc := mustDecode(t, test.doc)
+			if _, err := patch.Apply(doc); err == nil {
+				t.Errorf("Expected Apply to fail")
+			}
+			if !Equal(doc, mustDecode(t, test.doc)) {
+				t.Errorf("Failed Apply modified the original document: %v", doc)
+			}
+		})
+	}
+
+	for _, invalid := range []string{`{"op":"add"}`, `[{"op":"add","path":"/a"}]`, `[{"op":"jump","path":"/a"}]`, `[{"op":"move","path":"/a"}]`} {
+		if _, err := ParseJsonPatch([]byte(invalid)); err == nil {
+			t.Errorf("Expected %s to be rejected", invalid)
+		}
+	}
+}
+
+// Cases from RFC 7396 appendix A
+func TestMergePatch(t *testing.T) {
+	for _, test := range []struct {
+		doc   string
+		patch string
+		want  string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"c"}`, `{"a":["b"]}`, `{"a":["b"]}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"a":"b"}`, `["c"]`, `["c"]`},
+		{`{"e":null}`, `{"a":1}`, `{"e":null,"a":1}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+		{`{}`, `{"a":{"bb":{"ccc":null}}}`, `{"a":{"bb":{}}}`},
+	} {
+		patch, err := ParseMergePatch([]byte(test.patch))
+		if err != nil {
+			t.Fatalf("ParseMergePatch returned err %v", err)
+		}
+		doc := mustDecode(t, test.doc)
+		got, _ := patch.Apply(doc)
+		if !Equal(got, mustDecode(t, test.want)) {
+			t.Errorf("Merging %s into %s: expected %s, got %v", test.patch, test.doc, test.want, got)
+		}
+		if !Equal(doc, mustDecode(t, test.doc)) {
+			t.Errorf("Apply modified the original document: %v", doc)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	doc := mustDecode(t, `{
+		"store": {
+			"book": [
+				{"author": "Rees", "title": "Sayings", "price": 8.95},
+				{"author": "Waugh", "title": "Sword", "price": 12.99},
+				{"author": "Melville", "title": "Moby Dick", "isbn": "0-553"}
+			],
+			"bicycle": {"color": "red", "price": 19.95}
+		},
+		"odd key": true
+	}`)
+	for _, test := range []struct {
+		path     string
+		definite bool
+		want     string
+	}{
+		{"$.store.bicycle.color", true, `["red"]`},
+		{"store.bicycle.color", true, `["red"]`},
+		{"$['odd key']", true, `[true]`},
+		{"$.store.book[0].author", true, `["Rees"]`},
+		{"$.store.book[-1].title", true, `["Moby Dick"]`},
+		{"$.store.book[5]", true, `[]`},
+		{"$.store.book[*].author", false, `["Rees","Waugh","Melville"]`},
+		{"$.store.book[0,2].title", false, `["Sayings","Moby Dick"]`},
+		{"$.store.book[1:].author", false, `["Waugh","Melville"]`},
+		{"$.store.book[::-2].author", false, `["Melville","Rees"]`},
+		{"$.store.bicycle['color','price']", false, `["red",19.95]`},
+		{"$.store.bicycle.*", false, `["red",19.95]`},
+		{"$..price", false, `[19.95,8.95,12.99]`},
+		{"$..book[*].isbn", false, `["0-553"]`},
+		{"$.missing", true, `[]`},
+		{"$.store.book[1:3:9223372036854775807].author", false, `["Waugh"]`},
+		{"$.store.book[::-9223372036854775808].author", false, `["Melville"]`},
+		{"$.store.book[-9223372036854775808:9223372036854775807:2].author", false, `["Rees","Melville"]`},
+	} {
+		path, err := ParsePath(test.path)
+		if err != nil {
+			t.Fatalf("ParsePath(%q) returned err %v", test.path, err)
+		}
+		if path.Definite() != test.definite {
+			t.Errorf("%s: expected Definite() %v", test.path, test.definite)
+		}
+		got := path.Select(doc)
+		if !Equal(got, mustDecode(t, test.want)) {
+			t.Errorf("%s: expected %s, got %v", test.path, test.want, got)
+		}
+	}
+
+	if whole, _ := ParsePath("$"); !whole.Definite() || !Equal(whole.Select(doc), []interface{}{doc}) {
+		t.Errorf("Expected $ to select the whole document")
+	}
+
+	for _, path := range []string{"$.", "$[", "$[0", "$.a[?(@.b)]", "$[1:2:3:4]", "$[::0]", "$['a',0]", "$[x]", "$a"} {
+		if _, err := ParsePath(path); err == nil {
+			t.Errorf("Expected ParsePath(%q) to fail", path)
+		}
+	}
+}
+
+func TestFilter(t *testing.T) {
+	doc := mustDecode(t, `{"name": "Ada", "age": 36, "tags": ["math", "code"], "address": {"city": "London"}, "note": null, "odd key": 1}`)
+	for _, test := range []struct {
+		filter string
+		want   bool
+	}{
+		{`name = "Ada"`, true},
+		{`name == 'Ada'`, true},
+		{`name != "Ada"`, false},
+		{`age > 30 AND age <= 36`, true},
+		{`age >= 36.0`, true},
+		{`age < 36`, false},
+		{`age > "30"`, false},
+		{`name < "B"`, true},
+		{`$.address.city = "London"`, true},
+		{`address.city = "Paris" OR tags[*] = "code"`, true},
+		{`tags[*] IN ("art", "math")`, true},
+		{`name NOT IN ("Ada", "Alan")`, false},
+		{`exists(address.city) AND NOT exists(deleted)`, true},
+		{`exists(note) AND note = null`, true},
+		{`missing != 1`, false},
+		{`NOT missing = 1`, true},
+		{`$['odd key'] = 1`, true},
+		{`(age < 18 OR age > 30) and name = "Ada"`, true},
+		{`age < 18 OR age > 30 AND name = "Bob"`, false},
+	} {
+		filter, err := ParseFilter(test.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%s) returned err %v", test.filter, err)
+			continue
+		}
+		if got := filter.Match(doc); got != test.want {
+			t.Errorf("%s: expected %v, got %v", test.filter, test.want, got)
+		}
+	}
+
+	for _, filter := range []string{
+		``, `name`, `name =`, `name = Ada`, `name = "Ada`, `(age > 1`, `age > 1)`, `age => 1`,
+		`age IN 1`, `age IN (1 2)`, `age NOT = 1`, `exists(age`, `age > 1 AND`, `$[ = 1`,
+	} {
+		if _, err := ParseFilter(filter); err == nil {
+			t.Errorf("Expected ParseFilter(%s) to fail", filter)
+		}
+	}
+
+	nested := strings.Repeat("(", maxFilterDepth) + "age > 1" + strings.Repeat(")", maxFilterDepth)
+	if _, err := ParseFilter(nested); err != nil {
+		t.Errorf("Expected %d levels of parentheses to parse, got %v", maxFilterDepth, err)
+	}
+	for name, filter := range map[string]string{
+		"parentheses": strings.Repeat("(", 10000) + "age > 1" + strings.Repeat(")", 10000),
+		"NOT":         strings.Repeat("NOT ", 10000) + "age > 1",
+	} {
+		if _, err := ParseFilter(filter); err == nil || !strings.Contains(err.Error(), "nested too deeply") {
+			t.Errorf("Expected 10000 nested %s to be rejected, got %v", name, err)
+		}
+	}
+}
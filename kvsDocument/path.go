@@ -0,0 +1,354 @@
+package kvsDocument
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/*
+ *	A subset of JSONPath (RFC 9535) for reading parts of a document:
+ *		$				the whole document, may be left out
+ *		.name, ['name']	object member
+ *		[0], [-1]		array element, negative indexes count from the end
+ *		[0,2], ['a','b']	several members or elements
+ *		[1:3], [::2]	array slice
+ *		.*, [*]			every member or element
+ *		..name, ..*		members or elements at any depth
+ *	Filter expressions are not supported.
+ */
+type Path struct {
+	segments []pathSegment
+}
+
+type pathSegment struct {
+	selector  selector
+	recursive bool
+}
+
+type selector interface {
+	selectFrom(node interface{}, out []interface{}) []interface{}
+	definite() bool
+}
+
+type nameSelector []string
+type indexSelector []int
+type wildcardSelector struct{}
+type sliceSelector struct {
+	start, end *int
+	step       int
+}
+
+func ParsePath(expression string) (Path, error) {
+	expression = strings.TrimSpace(expression)
+	switch {
+	case strings.HasPrefix(expression, "$"):
+		expression = expression[1:]
+	case expression != "" && expression[0] != '.' && expression[0] != '[':
+		expression = "." + expression
+	}
+
+	var path Path
+	for expression != "" {
+		recursive := false
+		switch {
+		case strings.HasPrefix(expression, ".."):
+			recursive = true
+			expression = expression[2:]
+		case expression[0] == '.':
+			expression = expression[1:]
+		case expression[0] != '[':
+			return Path{}, fmt.Errorf("Unexpected %q in path", expression)
+		}
+
+		var sel selector
+		var err error
+		if expression != "" && expression[0] == '[' {
+			sel, expression, err = parseBracket(expression)
+		} else {
+			sel, expression, err = parseDotName(expression)
+		}
+		if err != nil {
+			return Path{}, err
+		}
+		path.segments = append(path.segments, pathSegment{selector: sel, recursive: recursive})
+	}
+	return path, nil
+}
+
+func parseDotName(expression string) (selector, string, error) {
+	end := strings.IndexAny(expression, ".[")
+	if end == -1 {
+		end = len(expression)
+	}
+	name := expression[:end]
+	if name == "" {
+		return nil, "", fmt.Errorf("Empty member name in path")
+	}
+	if name == "*" {
+		return wildcardSelector{}, expression[end:], nil
+	}
+	return nameSelector{name}, expression[end:], nil
+}
+
+// Parses a bracketed selector, returning the rest of the expression after it.
+func parseBracket(expression string) (selector, string, error) {
+	var items []string
+	var quoted []bool
+	current := strings.Builder{}
+	currentQuoted := false
+	var quote byte
+	for i := 1; i < len(expression); i++ {
+		c := expression[i]
+		switch {
+		case quote != 0 && c == '\\' && i+1 < len(expression):
+			i++
+			current.WriteByte(expression[i])
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote != 0:
+			current.WriteByte(c)
+		case c == '\'' || c == '"':
+			quote = c
+			currentQuoted = true
+		case c == ',' || c == ']':
+			items = append(items, strings.TrimSpace(current.String()))
+			quoted = append(quoted, currentQuoted)
+			current.Reset()
+			currentQuoted = false
+			if c == ']' {
+				sel, err := bracketSelector(items, quoted)
+				return sel, expression[i+1:], err
+			}
+		case c != ' ':
+			current.WriteByte(c)
+		}
+	}
+	return nil, "", fmt.Errorf("Unterminated [ in path")
+}
+
+func bracketSelector(items []string, quoted []bool) (selector, error) {
+	if len(items) == 1 && !quoted[0] {
+		switch {
+		case items[0] == "*":
+			return wildcardSelector{}, nil
+		case strings.HasPrefix(items[0], "?"):
+			return nil, fmt.Errorf("Filter expressions are not supported in paths")
+		case strings.Contains(items[0], ":"):
+			return parseSlice(items[0])
+		}
+	}
+	if quoted[0] {
+		names := nameSelector{}
+		for i, item := range items {
+			if !quoted[i] {
+				return nil, fmt.Errorf("Cannot mix names and indexes in [%s]", strings.Join(items, ","))
+			}
+			names = append(names, item)
+		}
+		return names, nil
+	}
+	indexes := indexSelector{}
+	for i, item := range items {
+		index, err := strconv.Atoi(item)
+		if quoted[i] || err != nil {
+			return nil, fmt.Errorf("Invalid index %q in path", item)
+		}
+		indexes = append(indexes, index)
+	}
+	return indexes, nil
+}
+
+func parseSlice(item string) (selector, error) {
+	parts := strings.Split(item, ":")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("Invalid slice %q in path", item)
+	}
+	slice := sliceSelector{step: 1}
+	bounds := []**int{&slice.start, &slice.end}
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid slice %q in path", item)
+		}
+		if i == 2 {
+			slice.step = value
+		} else {
+			*bounds[i] = &value
+		}
+	}
+	if slice.step == 0 {
+		return nil, fmt.Errorf("Slice step cannot be 0 in %q", item)
+	}
+	return slice, nil
+}
+
+/*
+ *	Selectors
+ */
+func (s nameSelector) selectFrom(node interface{}, out []interface{}) []interface{} {
+	if object, ok := node.(map[string]interface{}); ok {
+		for _, name := range s {
+			if value, ok := object[name]; ok {
+				out = append(out, value)
+			}
+		}
+	}
+	return out
+}
+
+func (s nameSelector) definite() bool {
+	return len(s) == 1
+}
+
+func (s indexSelector) selectFrom(node interface{}, out []interface{}) []interface{} {
+	if array, ok := node.([]interface{}); ok {
+		for _, index := range s {
+			if index < 0 {
+				index += len(array)
+			}
+			if index >= 0 && index < len(array) {
+				out = append(out, array[index])
+			}
+		}
+	}
+	return out
+}
+
+func (s indexSelector) definite() bool {
+	return len(s) == 1
+}
+
+func (wildcardSelector) selectFrom(node interface{}, out []interface{}) []interface{} {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			out = append(out, v[key])
+		}
+	case []interface{}:
+		out = append(out, v...)
+	}
+	return out
+}
+
+func (wildcardSelector) definite() bool {
+	return false
+}
+
+func (s sliceSelector) selectFrom(node interface{}, out []interface{}) []interface{} {
+	array, ok := node.([]interface{})
+	if !ok {
+		return out
+	}
+	length := len(array)
+	normalize := func(bound *int, fallback int) int {
+		if bound == nil {
+			return fallback
+		}
+		index := *bound
+		if index < 0 {
+			index += length
+		}
+		return index
+	}
+	// The loops stop before stepping past end, so a huge step cannot overflow i
+	if s.step > 0 {
+		start, end := clamp(normalize(s.start, 0), 0, length), clamp(normalize(s.end, length), 0, length)
+		for i := start; i < end; i += s.step {
+			out = append(out, array[i])
+			if s.step >= end-i {
+				break
+			}
+		}
+	} else {
+		start, end := clamp(normalize(s.start, length-1), -1, length-1), clamp(normalize(s.end, -length-1), -1, length-1)
+		for i := start; i > end; i += s.step {
+			out = append(out, array[i])
+			if s.step <= end-i {
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (sliceSelector) definite() bool {
+	return false
+}
+
+func clamp(value, low, high int) int {
+	if value < low {
+		return low
+	}
+	if value > high {
+		return high
+	}
+	return value
+}
+
+// Wildcards visit object members in key order, so results are stable.
+func sortedKeys(object map[string]interface{}) []string {
+	keys := make([]string, 0, len(object))
+	for key := range object {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Appends node and everything below it, in document order.
+func descendants(node interface{}, out []interface{}) []interface{} {
+	out = append(out, node)
+	switch v := node.(type) {
+	case map[string]interface{}:
+		for _, key := range sortedKeys(v) {
+			out = descendants(v[key], out)
+		}
+	case []interface{}:
+		for _, item := range v {
+			out = descendants(item, out)
+		}
+	}
+	return out
+}
+
+/*
+ *	Evaluation
+ */
+
+// Returns every value the path selects from doc.
+func (p Path) Select(doc interface{}) []interface{} {
+	nodes := []interface{}{doc}
+	for _, segment := range p.segments {
+		if segment.recursive {
+			var all []interface{}
+			for _, node := range nodes {
+				all = descendants(node, all)
+			}
+			nodes = all
+		}
+		var selected []interface{}
+		for _, node := range nodes {
+			selected = segment.selector.selectFrom(node, selected)
+		}
+		nodes = selected
+	}
+	if nodes == nil {
+		nodes = []interface{}{}
+	}
+	return nodes
+}
+
+// A definite path selects at most one value, e.g. $.a[0] but not $.a[*].
+func (p Path) Definite() bool {
+	for _, segment := range p.segments {
+		if segment.recursive || !segment.selector.definite() {
+			return false
+		}
+	}
+	return true
+}
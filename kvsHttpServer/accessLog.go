@@ -0,0 +1,83 @@
+package kvsHttpServer
+
+import (
+	"gokvs/kvsLogger"
+	"gokvs/kvsTracing"
+	"net/http"
+	"time"
+
+	uuid "github.com/google/uuid"
+)
+
+const requestIdHeader = "X-Request-Id"
+
+// Longest client supplied request id that is propagated as is.
+const maxRequestIdLength = 128
+
+// Records the status code and body size written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Lets handlers stream through the recorder, see scanHandler.
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+/*
+ *	Takes the request id from the X-Request-Id header or generates one, echoes
+ *	it back on the response and attaches a logger carrying it to the request
+ *	context. Logs one access line per request once the handler returns.
+ */
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+
+		requestId := req.Header.Get(requestIdHeader)
+		if requestId == "" || len(requestId) > maxRequestIdLength {
+			requestId = uuid.New().String()
+		}
+		w.Header().Set(requestIdHeader, requestId)
+
+		logger := kvsLogger.With("reqId", requestId)
+		if sc := kvsTracing.SpanContextFromContext(req.Context()); sc.IsValid() {
+			logger = logger.With("traceId", sc.TraceID, "spanId", sc.SpanID)
+		}
+		req = req.WithContext(kvsLogger.NewContext(req.Context(), logger))
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req)
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		logger.Info("HTTP access",
+			"method", req.Method,
+			"path", req.URL.Path,
+			"status", recorder.status,
+			"bytes", recorder.bytes,
+			"latency", time.Since(start),
+			"remoteAddr", req.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,83 @@
+package kvsHttpServer
+
+import (
+	"gokvs/kvs"
+	"gokvs/kvsAudit"
+	"gokvs/kvsAuth"
+	"gokvs/kvsLogger"
+	"gokvs/kvsRateLimit"
+	"gokvs/kvsTls"
+	"net/http"
+)
+
+/*
+ *	When kvsAuth requires it, refuses requests without a valid API key or
+ *	token in "Authorization: Bearer ..." with 401. Without the header, a
+ *	client certificate verified by the TLS listener is used instead. The
+ *	identity of accepted requests is attached to the request context and its
+ *	logger. Every request's context also gets its remote address, for the
+ *	audit log. An address that has failed authentication too often recently
+ *	gets 429 before its credential is checked.
+ */
+func authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req = req.WithContext(kvsAudit.WithSource(req.Context(), "http", req.RemoteAddr))
+		if !kvsAuth.Required() {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if wait, err := kvsRateLimit.AllowAuthentication("http", req.RemoteAddr); err != nil {
+			kvsLogger.FromContext(req.Context()).Warn("HTTP authentication throttled", "remoteAddr", req.RemoteAddr, "retryAfter", wait)
+			writeThrottled(w, wait, err)
+			return
+		}
+		credential := kvsAuth.BearerCredential(req.Header.Get("Authorization"))
+		var identity kvsAuth.Identity
+		var err error
+		if certificate := kvsTls.ClientCertificate(req.TLS); credential == "" && certificate != nil {
+			identity, err = kvsAuth.AuthenticateCertificate(certificate)
+		} else {
+			identity, err = kvsAuth.Authenticate(credential)
+		}
+		if err != nil {
+			kvsLogger.FromContext(req.Context()).Warn("HTTP authentication failed", "remoteAddr", req.RemoteAddr, "err", err)
+			kvsAuth.RegisterFailure("http", err)
+			kvsRateLimit.RegisterAuthFailure(req.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="gokvs"`)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		ctx := kvsAuth.WithIdentity(req.Context(), identity)
+		ctx = kvsLogger.NewContext(ctx, kvsLogger.FromContext(ctx).With("identity", identity.Name))
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+/*
+ *	Checks that the request's identity holds permission on id (or on every
+ *	key, when id is empty) in the request's namespace, answering 403
+ *	otherwise.
+ */
+func authorized(w http.ResponseWriter, req *http.Request, permission, id string) bool {
+	err := kvsAuth.Authorize(req.Context(), kvsAuth.Request{
+		Permission: permission,
+		Namespace:  kvs.NamespaceFrom(req.Context()),
+		Key:        id,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+/*
+ *	Permissions needed for each method on /kvs/{id}. PATCH replies with the
+ *	patched value, so it needs read as well as write.
+ */
+var methodPermissions = map[string][]string{
+	http.MethodGet:    {kvsAuth.ReadPermission},
+	http.MethodPut:    {kvsAuth.WritePermission},
+	http.MethodPatch:  {kvsAuth.WritePermission, kvsAuth.ReadPermission},
+	http.MethodDelete: {kvsAuth.DeletePermission},
+}
@@ -0,0 +1,70 @@
+package kvsHttpServer
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Set once the root context is cancelled, so /readyz fails while the server drains.
+var draining int32
+
+var readinessChecks = map[string]func() error{}
+var readinessMutex sync.RWMutex
+
+/*
+ *	Adds a named check to /readyz. The server is ready only while every check
+ *	returns nil.
+ */
+func RegisterReadinessCheck(name string, check func() error) {
+	readinessMutex.Lock()
+	defer readinessMutex.Unlock()
+	readinessChecks[name] = check
+}
+
+type readinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// Liveness: the process is up and serving HTTP.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok\n"))
+}
+
+func readyzHandler(w http.ResponseWriter, req *http.Request) {
+	response := readinessResponse{Status: "ok", Checks: map[string]string{}}
+
+	if atomic.LoadInt32(&draining) == 1 {
+		response.Status = "unavailable"
+		response.Checks["shutdown"] = "server is shutting down"
+	}
+
+	readinessMutex.RLock()
+	names := make([]string, 0, len(readinessChecks))
+	for name := range readinessChecks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := readinessChecks[name](); err != nil {
+			response.Status = "unavailable"
+			response.Checks[name] = err.Error()
+		} else {
+			response.Checks[name] = "ok"
+		}
+	}
+	readinessMutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if response.Status == "ok" {
+		w.WriteHeader(http.StatusOK)
+	} else {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(response)
+}
@@ -1,15 +1,26 @@
 package kvsHttpServer
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gokvs/kvs"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsDocument"
 	"gokvs/kvsLogger"
-	"log"
+	"gokvs/kvsMetrics"
+	"gokvs/kvsTls"
+	"io"
+	"mime"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -17,70 +28,447 @@ type ParsedBody struct {
 	Value interface{} `json:"value"`
 }
 
+/*
+ *	Reads the value to store from the body of req. JSON bodies (or bodies with
+ *	no Content-Type) are a {"value": ...} document; numbers are kept as
+ *	json.Number so they round-trip exactly. Any other body is stored verbatim
+ *	with its Content-Type.
+ */
+func readValue(req *http.Request) (interface{}, error) {
+	body, err := readBody(req)
+	if err != nil {
+		return nil, err
+	}
+	contentType := req.Header.Get("Content-Type")
+	if kvs.IsJsonContentType(contentType) {
+		var v ParsedBody
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&v); err != nil {
+			return nil, err
+		}
+		return v.Value, nil
+	}
+	return kvs.Blob{ContentType: contentType, Data: body}, nil
+}
+
+// Set by StartHttpServer and SetMaxRequestBytes, 0 means no limit
+var maxRequestBytes int64
+
+// Changes the body size limit of requests read from now on, for config reloads.
+func SetMaxRequestBytes(limit int64) {
+	atomic.StoreInt64(&maxRequestBytes, limit)
+}
+
+var errRequestTooLarge = errors.New("Request body too large")
+
+// Reads the whole body of req, failing with errRequestTooLarge past maxRequestBytes.
+func readBody(req *http.Request) ([]byte, error) {
+	limit := atomic.LoadInt64(&maxRequestBytes)
+	if limit <= 0 {
+		return io.ReadAll(req.Body)
+	}
+	if req.ContentLength > limit {
+		return nil, errRequestTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errRequestTooLarge
+	}
+	return body, nil
+}
+
+// Answers requests over a size limit with 413. Returns false for any other error.
+func writeTooLarge(w http.ResponseWriter, err error) bool {
+	var reason string
+	switch err {
+	case errRequestTooLarge:
+		reason = kvsMetrics.RejectedRequestTooLarge
+	case kvs.ErrValueTooLarge:
+		reason = kvsMetrics.RejectedValueTooLarge
+	case kvs.ErrKeyTooLong:
+		reason = kvsMetrics.RejectedKeyTooLong
+	default:
+		return false
+	}
+	kvsMetrics.RequestsRejected.Inc("http", reason)
+	http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+	return true
+}
+
+// Writes a stored value, JSON encoded or verbatim for raw values.
+func writeValue(w http.ResponseWriter, val interface{}) error {
+	if blob, ok := val.(kvs.Blob); ok {
+		w.Header().Set("Content-Type", blob.ContentType)
+		w.WriteHeader(http.StatusOK)
+		w.Write(blob.Data)
+		return nil
+	}
+	jsonResult, err := json.Marshal(val)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", kvs.JsonContentType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(jsonResult)
+	return nil
+}
+
 func getAndValidateIdInput(req *http.Request) (string, error) {
-	id := strings.TrimPrefix(req.URL.Path, "/kvs/")
+	return validateId(req.Context(), strings.TrimPrefix(req.URL.Path, "/kvs/"))
+}
+
+func validateId(ctx context.Context, id string) (string, error) {
 	if len(id) == 0 {
 		return "", fmt.Errorf("No id provided")
 	}
+	if err := kvs.CheckKeyLength(ctx, id); err != nil {
+		return "", err
+	}
 	if isValid, validationError := kvs.IdIsValid(id); !isValid {
 		return "", fmt.Errorf("ID format error: %s", validationError.Error())
 	}
 	return id, nil
 }
 
+// Reads the optional ttl query parameter, in seconds.
+func getTTL(req *http.Request) (time.Duration, error) {
+	ttlParam := req.URL.Query().Get("ttl")
+	if ttlParam == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.ParseFloat(ttlParam, 64)
+	if err != nil {
+		return 0, kvs.ErrInvalidTTL
+	}
+	return kvs.TTLFromSeconds(seconds)
+}
+
+/*
+ *	Writes over a size limit get 413, writes to a full store 507, requests to a
+ *	namespace dropped since the request started 404, other errors 400.
+ */
+func writeStoreError(w http.ResponseWriter, err error, clientErrorMessage string) {
+	if writeTooLarge(w, err) {
+		return
+	}
+	switch err {
+	case kvs.ErrStoreFull:
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	case kvs.ErrUnknownNamespace:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	http.Error(w, clientErrorMessage, http.StatusBadRequest)
+}
+
+// Delta is decoded with UseNumber, and anything but a json.Number is rejected.
+type IncrementBody struct {
+	Delta interface{} `json:"delta"`
+}
+
+const incrementSuffix = "/_incr"
+
+/*
+ *	POST /kvs/{id}/_incr adds the optional {"delta": n} body (1 by default) to
+ *	the number stored under id, creating it if absent, and returns the result.
+ */
+func incrementHandler(w http.ResponseWriter, req *http.Request) {
+	logger := kvsLogger.FromContext(req.Context())
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not supported with /:id/_incr", http.StatusBadRequest)
+		return
+	}
+	id, err := validateId(req.Context(), strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/kvs/"), incrementSuffix))
+	if writeTooLarge(w, err) {
+		return
+	}
+	if err != nil {
+		logger.Warn("Id validation error", "method", req.Method, "path", req.URL.Path, "err", err)
+		http.Error(w, fmt.Sprintf("Id validation error %v", err.Error()), http.StatusBadRequest)
+		return
+	}
+	// The reply holds the new value, so reading it must be allowed too
+	if !authorized(w, req, kvsAuth.WritePermission, id) || !authorized(w, req, kvsAuth.ReadPermission, id) {
+		return
+	}
+	body, err := readBody(req)
+	if writeTooLarge(w, err) {
+		return
+	}
+	delta := json.Number("1")
+	if err == nil && len(bytes.TrimSpace(body)) > 0 {
+		var v IncrementBody
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		err = decoder.Decode(&v)
+		if err == nil && v.Delta != nil {
+			if number, ok := v.Delta.(json.Number); ok {
+				delta = number
+			} else {
+				err = fmt.Errorf("Delta of type %T is not a number", v.Delta)
+			}
+		}
+	}
+	if err != nil {
+		logger.Warn("Increment body decoding error", "id", id, "err", err)
+		http.Error(w, fmt.Sprintf("Could not increment id %v", id), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	val, err := kvs.IncrementContext(req.Context(), id, delta)
+	kvsMetrics.ObserveOperation("increment", "http", kvsMetrics.OutcomeOf(err), start)
+	if err != nil {
+		logger.Warn("Increment error", "id", id, "err", err)
+		if err == kvs.ErrNotNumeric || err == kvs.ErrOverflow {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeStoreError(w, err, fmt.Sprintf("Could not increment id %v", id))
+		return
+	}
+	writeValue(w, map[string]interface{}{"value": val})
+}
+
+const indexPrefix = "/kvs/_index/"
+
+/*
+ *	GET /kvs/_index/{name} returns the documents whose values in the index are
+ *	equal to ?eq=, or within ?gt=/?gte= and ?lt=/?lte=, ordered by indexed
+ *	value. ?limit= caps the number of matches.
+ */
+func indexHandler(w http.ResponseWriter, req *http.Request) {
+	logger := kvsLogger.FromContext(req.Context())
+	if req.Method != http.MethodGet {
+		http.Error(w, "Method not supported with /_index/:name", http.StatusMethodNotAllowed)
+		return
+	}
+	if !authorized(w, req, kvsAuth.ReadPermission, "") {
+		return
+	}
+	name := strings.TrimPrefix(req.URL.Path, indexPrefix)
+	params := req.URL.Query()
+	query := kvs.IndexQuery{}
+	for param, bound := range map[string]*interface{}{
+		"eq": &query.Eq, "gt": &query.Gt, "gte": &query.Gte, "lt": &query.Lt, "lte": &query.Lte,
+	} {
+		if _, ok := params[param]; ok {
+			*bound = kvs.ParseIndexValue(params.Get(param))
+		}
+	}
+	if limit := params.Get("limit"); limit != "" {
+		var err error
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", limit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	start := time.Now()
+	matches, err := kvs.QueryIndexContext(req.Context(), name, query)
+	kvsMetrics.ObserveOperation("index_query", "http", kvsMetrics.OutcomeOf(err), start)
+	switch err {
+	case nil:
+	case kvs.ErrUnknownIndex:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	default:
+		logger.Warn("Index query error", "index", name, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeValue(w, matches)
+}
+
+/*
+ *	PATCH /kvs/{id} applies a JSON Patch (application/json-patch+json) or a
+ *	JSON Merge Patch (application/merge-patch+json) to the stored document and
+ *	returns the result.
+ */
+func patchHandler(w http.ResponseWriter, req *http.Request, id string) {
+	logger := kvsLogger.FromContext(req.Context())
+	body, err := readBody(req)
+	if writeTooLarge(w, err) {
+		return
+	}
+	clientErrorMessage := fmt.Sprintf("Could not PATCH on id %v", id)
+	if err != nil {
+		logger.Warn("PATCH body read error", "id", id, "err", err)
+		http.Error(w, clientErrorMessage, http.StatusBadRequest)
+		return
+	}
+	var patch kvsDocument.Patch
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	switch mediaType {
+	case kvsDocument.JsonPatchContentType:
+		patch, err = kvsDocument.ParseJsonPatch(body)
+	case kvsDocument.MergePatchContentType:
+		patch, err = kvsDocument.ParseMergePatch(body)
+	default:
+		http.Error(w, fmt.Sprintf("PATCH requires Content-Type %s or %s", kvsDocument.JsonPatchContentType, kvsDocument.MergePatchContentType), http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		logger.Warn("PATCH body decoding error", "id", id, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	start := time.Now()
+	val, err := kvs.PatchContext(req.Context(), id, patch)
+	if err == nil && val == nil {
+		kvsMetrics.ObserveOperation("patch", "http", kvsMetrics.OutcomeNotFound, start)
+	} else {
+		kvsMetrics.ObserveOperation("patch", "http", kvsMetrics.OutcomeOf(err), start)
+	}
+	if err != nil {
+		logger.Warn("PATCH error", "id", id, "err", err)
+		if errors.Is(err, kvs.ErrPatchFailed) || err == kvsDocument.ErrNotDocument {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		writeStoreError(w, err, clientErrorMessage)
+		return
+	}
+	if val == nil {
+		http.Error(w, "Requested resource does not exist.", http.StatusNotFound)
+		return
+	}
+	if err := writeValue(w, val); err != nil {
+		logger.Error("PATCH JSON formatting error", "id", id, "err", err)
+	}
+}
+
+// Answers GET /kvs/{id}?path=... with the part of the value the path selects.
+func getPathHandler(w http.ResponseWriter, req *http.Request, id string, start time.Time) {
+	logger := kvsLogger.FromContext(req.Context())
+	path, err := kvsDocument.ParsePath(req.URL.Query().Get("path"))
+	if err != nil {
+		logger.Warn("GET path parsing error", "id", id, "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	val, found, err := kvs.GetPathContext(req.Context(), id, path)
+	if (err == nil && !found) || err == kvs.ErrPathNotFound {
+		kvsMetrics.ObserveOperation("get", "http", kvsMetrics.OutcomeNotFound, start)
+	} else {
+		kvsMetrics.ObserveOperation("get", "http", kvsMetrics.OutcomeOf(err), start)
+	}
+	switch {
+	case err == kvs.ErrPathNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	case err == kvsDocument.ErrNotDocument:
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		logger.Error("GET error", "id", id, "err", err)
+		http.Error(w, fmt.Sprintf("Could not GET on id %v", id), http.StatusBadRequest)
+		return
+	case !found:
+		logger.Debug("GET 404: Resource not found.", "id", id)
+		http.Error(w, "Requested resource does not exist.", http.StatusNotFound)
+		return
+	}
+	if err := writeValue(w, val); err != nil {
+		logger.Error("GET JSON formatting error", "id", id, "err", err)
+		http.Error(w, fmt.Sprintf("Could not GET on id %v", id), http.StatusBadRequest)
+	}
+}
+
 func idResponseHandler(w http.ResponseWriter, req *http.Request) {
+	if strings.HasPrefix(req.URL.Path, indexPrefix) {
+		indexHandler(w, req)
+		return
+	}
+	if strings.HasSuffix(req.URL.Path, incrementSuffix) {
+		incrementHandler(w, req)
+		return
+	}
+	logger := kvsLogger.FromContext(req.Context())
 	id, err := getAndValidateIdInput(req)
+	if writeTooLarge(w, err) {
+		return
+	}
 	if err != nil {
 		errMessage := fmt.Sprintf("Id validation error %v", err.Error())
-		kvsLogger.Log(errMessage)
+		logger.Warn("Id validation error", "method", req.Method, "path", req.URL.Path, "err", err)
 		http.Error(w, errMessage, http.StatusBadRequest)
 		return
 	}
-	kvsLogger.Log(fmt.Sprintf("%v Request for id %v\n", req.Method, id))
+	logger.Debug("Request for id", "method", req.Method, "id", id)
+	for _, permission := range methodPermissions[req.Method] {
+		if !authorized(w, req, permission, id) {
+			return
+		}
+	}
+	start := time.Now()
 	switch req.Method {
 	case "GET":
-		val, err := kvs.Get(id)
+		if _, ok := req.URL.Query()["path"]; ok {
+			getPathHandler(w, req, id, start)
+			return
+		}
+		val, err := kvs.GetContext(req.Context(), id)
+		if err == nil && val == nil {
+			kvsMetrics.ObserveOperation("get", "http", kvsMetrics.OutcomeNotFound, start)
+		} else {
+			kvsMetrics.ObserveOperation("get", "http", kvsMetrics.OutcomeOf(err), start)
+		}
 		clientErrorMessage := fmt.Sprintf("Could not GET on id %v", id)
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("GET Error %v\n", err))
-			http.Error(w, clientErrorMessage, http.StatusBadRequest)
+			logger.Error("GET error", "id", id, "err", err)
+			writeStoreError(w, err, clientErrorMessage)
 			return
 		}
 		if val == nil {
-			kvsLogger.Log("GET 404: Resource not found.")
+			logger.Debug("GET 404: Resource not found.", "id", id)
 			http.Error(w, "Requested resource does not exist.", http.StatusNotFound)
 			return
 		}
-		jsonResult, err := json.Marshal(val)
-		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("GET JSON formatting Error %v", err))
+		if err := writeValue(w, val); err != nil {
+			logger.Error("GET JSON formatting error", "id", id, "err", err)
 			http.Error(w, clientErrorMessage, http.StatusBadRequest)
 			return
 		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(jsonResult)
 	case "PUT":
-		var v ParsedBody
-		err := json.NewDecoder(req.Body).Decode(&v)
+		value, err := readValue(req)
 		clientErrorMessage := fmt.Sprintf("Could not PUT on id %v", id)
+		if writeTooLarge(w, err) {
+			return
+		}
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("PUT Body JSON decoding Error %v\n", err))
+			logger.Warn("PUT body decoding error", "id", id, "err", err)
 			http.Error(w, clientErrorMessage, http.StatusBadRequest)
 			return
 		}
-		err = kvs.Update(id, v.Value)
+		ttl, err := getTTL(req)
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("PUT Error %v\n", err))
-			http.Error(w, clientErrorMessage, http.StatusBadRequest)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = kvs.UpdateWithTTLContext(req.Context(), id, value, ttl)
+		kvsMetrics.ObserveOperation("update", "http", kvsMetrics.OutcomeOf(err), start)
+		if err != nil {
+			logger.Error("PUT error", "id", id, "err", err)
+			writeStoreError(w, err, clientErrorMessage)
 			return
 		}
 		w.WriteHeader(http.StatusAccepted)
+	case "PATCH":
+		patchHandler(w, req, id)
 	case "DELETE":
-		err := kvs.Delete(id)
+		err := kvs.DeleteContext(req.Context(), id)
+		kvsMetrics.ObserveOperation("delete", "http", kvsMetrics.OutcomeOf(err), start)
 		clientErrorMessage := fmt.Sprintf("Could not DELETE on id %v", id)
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("DELETE Error %v\n", err))
-			http.Error(w, clientErrorMessage, http.StatusBadRequest)
+			logger.Error("DELETE error", "id", id, "err", err)
+			writeStoreError(w, err, clientErrorMessage)
 			return
 		}
 		w.WriteHeader(http.StatusAccepted)
@@ -90,28 +478,129 @@ func idResponseHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// How many values are written between flushes
+const scanBatchSize = 256
+
+// A scanned value, with raw values base64 encoded as over TCP
+type scanItem struct {
+	Id          string      `json:"id"`
+	Value       interface{} `json:"value"`
+	Encoding    string      `json:"encoding,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+}
+
+func newScanItem(item kvs.ScanItem) scanItem {
+	if blob, ok := item.Value.(kvs.Blob); ok {
+		return scanItem{Id: item.Id, Value: base64.StdEncoding.EncodeToString(blob.Data), Encoding: "base64", ContentType: blob.ContentType}
+	}
+	return scanItem{Id: item.Id, Value: item.Value}
+}
+
+/*
+ *	GET /kvs lists stored values in id order as {"items": [...], "cursor": ...},
+ *	optionally only those matching ?filter=. At most ?limit= values are
+ *	returned (kvs.DefaultScanLimit by default, up to kvs.MaxScanLimit); pass
+ *	the cursor back as ?cursor= for the next page. The whole page is fetched
+ *	from the store at once and flushed to the client in batches as it is
+ *	encoded.
+ */
+func scanHandler(w http.ResponseWriter, req *http.Request, start time.Time) {
+	logger := kvsLogger.FromContext(req.Context())
+	params := req.URL.Query()
+	var filter kvsDocument.Filter
+	if text := params.Get("filter"); text != "" {
+		var err error
+		if filter, err = kvsDocument.ParseFilter(text); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	limit := kvs.DefaultScanLimit
+	if text := params.Get("limit"); text != "" {
+		var err error
+		if limit, err = strconv.Atoi(text); err != nil || limit <= 0 || limit > kvs.MaxScanLimit {
+			http.Error(w, fmt.Sprintf("Invalid limit %q, expected 1 to %d", text, kvs.MaxScanLimit), http.StatusBadRequest)
+			return
+		}
+	}
+
+	// Every scan visits the whole namespace, so the page is fetched in one pass
+	page, err := kvs.ScanContext(req.Context(), filter, params.Get("cursor"), limit)
+	if err != nil {
+		kvsMetrics.ObserveOperation("scan", "http", kvsMetrics.OutcomeOf(err), start)
+		writeStoreError(w, err, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", kvs.JsonContentType)
+	w.WriteHeader(http.StatusOK)
+	io.WriteString(w, `{"items":[`)
+	flusher, canFlush := w.(http.Flusher)
+	for i, item := range page.Items {
+		if i > 0 {
+			io.WriteString(w, ",")
+			if canFlush && i%scanBatchSize == 0 {
+				flusher.Flush()
+			}
+		}
+		var encoded []byte
+		if encoded, err = json.Marshal(newScanItem(item)); err != nil {
+			break
+		}
+		w.Write(encoded)
+	}
+	kvsMetrics.ObserveOperation("scan", "http", kvsMetrics.OutcomeOf(err), start)
+	if err != nil {
+		// Too late for an error status, the client gets a truncated document
+		logger.Error("GET /kvs error", "err", err)
+		return
+	}
+	io.WriteString(w, "]")
+	if page.Cursor != "" {
+		fmt.Fprintf(w, `,"cursor":%q`, page.Cursor)
+	}
+	io.WriteString(w, "}")
+}
+
 func responseHandler(w http.ResponseWriter, req *http.Request) {
-	kvsLogger.Log(fmt.Sprintf("%v Request\n", req.Method))
+	logger := kvsLogger.FromContext(req.Context())
+	logger.Debug("Request", "method", req.Method)
+	start := time.Now()
 	switch req.Method {
+	case "GET":
+		if !authorized(w, req, kvsAuth.ReadPermission, "") {
+			return
+		}
+		scanHandler(w, req, start)
 	case "POST":
-		var v ParsedBody
-		err := json.NewDecoder(req.Body).Decode(&v)
+		if !authorized(w, req, kvsAuth.WritePermission, "") {
+			return
+		}
+		value, err := readValue(req)
+		if writeTooLarge(w, err) {
+			return
+		}
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("POST JSON decoding error %v", err))
+			logger.Warn("POST body decoding error", "err", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		id, err := kvs.Set(v.Value)
+		ttl, err := getTTL(req)
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("POST Error %v", err))
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		id, err := kvs.SetWithTTLContext(req.Context(), value, ttl)
+		kvsMetrics.ObserveOperation("set", "http", kvsMetrics.OutcomeOf(err), start)
+		if err != nil {
+			logger.Warn("POST error", "err", err)
+			writeStoreError(w, err, err.Error())
+			return
+		}
 		rMap := make(map[string]interface{})
 		rMap["id"] = id
 		jsonResult, err := json.Marshal(rMap)
 		if err != nil {
-			kvsLogger.Log(fmt.Sprintf("POST JSON encoding error %v", err))
+			logger.Error("POST JSON encoding error", "err", err)
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
@@ -123,38 +612,116 @@ func responseHandler(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func StartHttpServer(rootCtx context.Context, rootWg *sync.WaitGroup, portNumber int) {
-	rootWg.Add(1)
+const namespacePrefix = "/ns/"
+
+// Splits /ns/{namespace}/kvs... into the namespace and the /kvs... path.
+func splitNamespacePath(path string) (string, string) {
+	rest := strings.TrimPrefix(path, namespacePrefix)
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return rest, ""
+	}
+	return rest[:slash], rest[slash:]
+}
+
+/*
+ *	/ns/{namespace}/kvs and everything under it are served like /kvs, on the
+ *	keys of the namespace.
+ */
+func namespaceHandler(w http.ResponseWriter, req *http.Request) {
+	name, path := splitNamespacePath(req.URL.Path)
+	if path != "/kvs" && !strings.HasPrefix(path, "/kvs/") {
+		http.NotFound(w, req)
+		return
+	}
+	if !kvs.HasNamespace(name) {
+		http.Error(w, kvs.ErrUnknownNamespace.Error(), http.StatusNotFound)
+		return
+	}
+	nsReq := req.WithContext(kvs.WithNamespace(req.Context(), name))
+	nsURL := *req.URL
+	nsURL.Path, nsURL.RawPath = path, ""
+	nsReq.URL = &nsURL
+	if path == "/kvs" {
+		responseHandler(w, nsReq)
+		return
+	}
+	idResponseHandler(w, nsReq)
+}
+
+func newHandler() http.Handler {
 	mux := http.NewServeMux()
-	mux.Handle("/kvs", http.HandlerFunc(responseHandler))
-	mux.Handle("/kvs/", http.HandlerFunc(idResponseHandler))
+	// Only requests reaching the store are rate limited, not metrics scrapes
+	mux.Handle("/kvs", rateLimitMiddleware(http.HandlerFunc(responseHandler)))
+	mux.Handle("/kvs/", rateLimitMiddleware(http.HandlerFunc(idResponseHandler)))
+	mux.Handle(namespacePrefix, rateLimitMiddleware(http.HandlerFunc(namespaceHandler)))
+	mux.Handle("/metrics", kvsMetrics.Handler())
 
+	// Probes bypass access logging and tracing, they are hit every few seconds
+	rootMux := http.NewServeMux()
+	rootMux.Handle("/healthz", http.HandlerFunc(healthzHandler))
+	rootMux.Handle("/readyz", http.HandlerFunc(readyzHandler))
+	rootMux.Handle("/", tracingMiddleware(accessLogMiddleware(authMiddleware(mux))))
+	return rootMux
+}
+
+/*
+ *	Serves until rootCtx is cancelled. /readyz starts failing straight away and
+ *	the server keeps serving for cfg.DrainSeconds, giving load balancers time to
+ *	stop sending traffic before srv.Shutdown. With cfg.Tls, serves HTTPS and
+ *	picks up renewed certificates from disk.
+ */
+func StartHttpServer(rootCtx context.Context, rootWg *sync.WaitGroup, cfg kvsConfig.HttpConfig) {
+	rootWg.Add(1)
+	portNumber := cfg.Port
+	atomic.StoreInt32(&draining, 0)
+	SetMaxRequestBytes(cfg.MaxRequestBytes)
 	srv := &http.Server{
 		Addr:    ":" + fmt.Sprintf("%d", portNumber),
-		Handler: mux,
+		Handler: newHandler(),
+	}
+	if cfg.Tls.Enabled() {
+		reloader, err := kvsTls.NewReloader("http", cfg.Tls)
+		if err != nil {
+			kvsLogger.Fatal("HTTP TLS setup failed", "err", err)
+		}
+		srv.TLSConfig = reloader.ServerConfig("h2", "http/1.1")
+		go reloader.Watch(rootCtx)
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen:%+s\n", err)
+		var err error
+		if srv.TLSConfig != nil {
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			kvsLogger.Fatal("HTTP Server listen failed", "err", err)
 		}
 	}()
 
-	kvsLogger.Log(fmt.Sprintf("HTTP Server started on port %d", portNumber))
+	kvsLogger.Info("HTTP Server started", "port", portNumber, "tls", cfg.Tls.Enabled())
 
 	<-rootCtx.Done()
+	atomic.StoreInt32(&draining, 1)
+
+	if cfg.DrainSeconds > 0 {
+		kvsLogger.Info("HTTP Server draining", "seconds", cfg.DrainSeconds)
+		time.Sleep(time.Duration(cfg.DrainSeconds) * time.Second)
+	}
 
-	kvsLogger.Log(fmt.Sprintf("HTTP Server stopping..."))
+	kvsLogger.Info("HTTP Server stopping...")
 	ctxShutDown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer func() {
 		cancel()
 	}()
 
 	if err := srv.Shutdown(ctxShutDown); err != nil {
-		log.Fatalf("HTTP Server Shutdown failed: %+s", err)
+		kvsLogger.Fatal("HTTP Server Shutdown failed", "err", err)
 	}
 
-	kvsLogger.Log(fmt.Sprintf("HTTP Server exited properly"))
+	kvsLogger.Info("HTTP Server exited properly")
 
 	rootWg.Done()
 }
@@ -0,0 +1,34 @@
+package kvsHttpServer
+
+import (
+	"gokvs/kvsLogger"
+	"gokvs/kvsRateLimit"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+/*
+ *	Refuses requests from clients over their rate limit with 429 and a
+ *	Retry-After of the whole seconds until their next token. Wraps the store
+ *	routes inside authMiddleware, so authenticated clients are limited by
+ *	identity. Failed authentications are limited by address in
+ *	authMiddleware itself, before the credential is checked.
+ */
+func rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		wait, err := kvsRateLimit.Allow(req.Context(), "http", req.RemoteAddr)
+		if err != nil {
+			kvsLogger.FromContext(req.Context()).Debug("HTTP request throttled", "remoteAddr", req.RemoteAddr, "retryAfter", wait)
+			writeThrottled(w, wait, err)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+func writeThrottled(w http.ResponseWriter, wait time.Duration, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http.Error(w, err.Error(), http.StatusTooManyRequests)
+}
@@ -0,0 +1,54 @@
+package kvsHttpServer
+
+import (
+	"gokvs/kvsTracing"
+	"net/http"
+	"strings"
+)
+
+// Groups request paths into low cardinality span names.
+func routeOf(path string) string {
+	if strings.HasPrefix(path, namespacePrefix) {
+		_, rest := splitNamespacePath(path)
+		return namespacePrefix + "{namespace}" + routeOf(rest)
+	}
+	if strings.HasPrefix(path, indexPrefix) {
+		return indexPrefix + "{name}"
+	}
+	if strings.HasPrefix(path, "/kvs/") {
+		if strings.HasSuffix(path, incrementSuffix) {
+			return "/kvs/{id}" + incrementSuffix
+		}
+		return "/kvs/{id}"
+	}
+	return path
+}
+
+/*
+ *	Starts a server span for every request, continuing the trace in the W3C
+ *	traceparent header when the client sent one.
+ */
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := kvsTracing.Extract(req.Context(), req.Header.Get(kvsTracing.TraceparentHeader))
+		route := routeOf(req.URL.Path)
+		ctx, span := kvsTracing.StartSpan(ctx, req.Method+" "+route, kvsTracing.KindServer,
+			kvsTracing.Attribute{Key: "http.request.method", Value: req.Method},
+			kvsTracing.Attribute{Key: "http.route", Value: route},
+			kvsTracing.Attribute{Key: "url.path", Value: req.URL.Path},
+			kvsTracing.Attribute{Key: "client.address", Value: req.RemoteAddr},
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(recorder, req.WithContext(ctx))
+		if recorder.status == 0 {
+			recorder.status = http.StatusOK
+		}
+
+		span.SetAttributes(kvsTracing.Attribute{Key: "http.response.status_code", Value: recorder.status})
+		if recorder.status >= http.StatusInternalServerError {
+			span.SetStatus(kvsTracing.StatusError, http.StatusText(recorder.status))
+		}
+	})
+}
@@ -1,53 +1,598 @@
 package kvsLogger
 
 import (
+	"context"
+	"encoding/json"
+	"expvar"
 	"fmt"
-	"log"
+	"gokvs/kvsConfig"
+	"gokvs/kvsMetrics"
+	"io"
 	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-type LogChannelType chan string
+type Level int
+
+const (
+	DebugLevel Level = iota
+	InfoLevel
+	WarnLevel
+	ErrorLevel
+	PanicLevel
+	FatalLevel
+)
+
+var levelNames = []string{"debug", "info", "warn", "error", "panic", "fatal"}
+
+func (level Level) String() string {
+	if level < DebugLevel || level > FatalLevel {
+		return fmt.Sprintf("level(%d)", int(level))
+	}
+	return levelNames[level]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if levelName == name {
+			return Level(i), nil
+		}
+	}
+	return InfoLevel, fmt.Errorf("Unknown log level %q", name)
+}
+
+type Format int
+
+const (
+	TextFormat Format = iota
+	JsonFormat
+)
+
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text":
+		return TextFormat, nil
+	case "json":
+		return JsonFormat, nil
+	default:
+		return TextFormat, fmt.Errorf("Unknown log format %q", name)
+	}
+}
+
+type OverflowPolicy int
+
+const (
+	BlockPolicy OverflowPolicy = iota
+	DropOldestPolicy
+	DropNewestPolicy
+)
+
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch name {
+	case "block":
+		return BlockPolicy, nil
+	case "dropOldest":
+		return DropOldestPolicy, nil
+	case "dropNewest":
+		return DropNewestPolicy, nil
+	default:
+		return BlockPolicy, fmt.Errorf("Unknown overflow policy %q", name)
+	}
+}
+
+type entry struct {
+	time   time.Time
+	level  Level
+	msg    string
+	fields []interface{}
+
+	// Set on flush markers only. Closed by the writer once every entry queued
+	// before the marker has been written.
+	flushed chan struct{}
+}
+
+type LoggerMetricsStruct struct {
+	Buffered int
+	Capacity int
+	Written  uint64
+	Dropped  uint64
+}
+
+/*
+ *	A Logger carries key-value fields that are added to every entry it emits.
+ *	The package-level functions log through a Logger with no fields.
+ */
+type Logger struct {
+	fields []interface{}
+}
+
+type LogChannelType chan entry
 
 var LogChannel LogChannelType
-var customLog *log.Logger
-var wg sync.WaitGroup
 
-func StartLogger(rootWg *sync.WaitGroup) chan string {
-	customLog = log.New(os.Stdout, "", 0)
-	LogChannel = make(LogChannelType)
-	go processLogChannelEntries()
+// Held for reading while sending on LogChannel, for writing while closing it.
+var channelMutex sync.RWMutex
+var closed bool
+var writerDone chan struct{}
+
+var writtenCount uint64
+var droppedCount uint64
+var publishMetrics sync.Once
+
+var _ = kvsMetrics.NewCounterFunc(
+	"kvs_log_entries_written_total",
+	"Log entries written by the logger goroutine.",
+	func() float64 { return float64(atomic.LoadUint64(&writtenCount)) },
+)
+
+var _ = kvsMetrics.NewCounterFunc(
+	"kvs_log_entries_dropped_total",
+	"Log entries dropped because the log buffer was full.",
+	func() float64 { return float64(atomic.LoadUint64(&droppedCount)) },
+)
+
+var rootLogger = &Logger{}
+
+var settingsMutex sync.RWMutex
+var minLevel = InfoLevel
+var format = TextFormat
+var overflowPolicy = BlockPolicy
+var output io.Writer = os.Stdout
+var outputCloser io.Closer
+var outputMutex sync.Mutex
+
+// Used by Fatal, replaced in tests.
+var exit = os.Exit
+
+// How long Panic and Fatal wait for buffered entries to be written.
+const flushOnExitTimeout = 5 * time.Second
+
+/*
+ *	Starts the writer goroutine with a buffer of cfg.BufferSize entries and
+ *	applies the reloadable settings in cfg.
+ */
+func StartLogger(cfg kvsConfig.LoggerConfig) LogChannelType {
+	ApplyConfig(cfg)
+
+	channelMutex.Lock()
+	LogChannel = make(LogChannelType, cfg.BufferSize)
+	closed = false
+	writerDone = make(chan struct{})
+	go processLogChannelEntries(LogChannel, writerDone)
+	channelMutex.Unlock()
+
+	publishMetrics.Do(func() {
+		expvar.Publish("Logger Metrics", expvar.Func(LoggerMetrics))
+	})
 	return LogChannel
 }
 
-func WaitForLoggerToComplete() {
-	wg.Wait()
+/*
+ *	Blocks until every entry logged before the call has been written, or ctx is
+ *	done. Returns immediately if the logger is not running.
+ */
+func Flush(ctx context.Context) error {
+	marker := entry{flushed: make(chan struct{})}
+
+	channelMutex.RLock()
+	if LogChannel == nil || closed {
+		channelMutex.RUnlock()
+		return nil
+	}
+	select {
+	case LogChannel <- marker:
+		channelMutex.RUnlock()
+	case <-ctx.Done():
+		channelMutex.RUnlock()
+		return ctx.Err()
+	}
+
+	select {
+	case <-marker.flushed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+/*
+ *	Writes out buffered entries, stops the writer goroutine and closes the
+ *	outputs. Entries logged afterwards are written synchronously to stdout.
+ */
+func Close() error {
+	channelMutex.Lock()
+	if LogChannel == nil || closed {
+		channelMutex.Unlock()
+		return CloseOutputs()
+	}
+	closed = true
+	close(LogChannel)
+	done := writerDone
+	channelMutex.Unlock()
+
+	<-done
+	return CloseOutputs()
+}
+
+func LoggerMetrics() interface{} {
+	metrics := LoggerMetricsStruct{
+		Written: atomic.LoadUint64(&writtenCount),
+		Dropped: atomic.LoadUint64(&droppedCount),
+	}
+	channelMutex.RLock()
+	defer channelMutex.RUnlock()
+	if LogChannel != nil && !closed {
+		metrics.Buffered = len(LogChannel)
+		metrics.Capacity = cap(LogChannel)
+	}
+	return metrics
+}
+
+// Applies the reloadable logger settings. cfg is expected to be validated already.
+func ApplyConfig(cfg kvsConfig.LoggerConfig) {
+	if apply, err := PrepareConfig(cfg); err == nil {
+		apply()
+	}
 }
 
-func processLogChannelEntries() {
-	defer close(LogChannel)
-	for msg := range LogChannel {
-		log.Println(msg)
-		wg.Done()
+/*
+ *	Checks the reloadable logger settings of cfg, returning a function that
+ *	applies them all at once, or the first invalid setting.
+ */
+func PrepareConfig(cfg kvsConfig.LoggerConfig) (func(), error) {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return nil, err
 	}
+	logFormat, err := ParseFormat(cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	policy, err := ParseOverflowPolicy(cfg.OverflowPolicy)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		settingsMutex.Lock()
+		defer settingsMutex.Unlock()
+		minLevel = level
+		format = logFormat
+		overflowPolicy = policy
+	}, nil
+}
+
+func SetLevel(level Level) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	minLevel = level
+}
+
+func GetLevel() Level {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return minLevel
+}
+
+func SetFormat(logFormat Format) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	format = logFormat
+}
+
+func SetOverflowPolicy(policy OverflowPolicy) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	overflowPolicy = policy
+}
+
+func getOverflowPolicy() OverflowPolicy {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return overflowPolicy
+}
+
+func SetOutput(w io.Writer) {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	output = w
+	outputCloser = nil
+}
+
+/*
+ *	Replaces the current output with the configured sinks. Should be called
+ *	during startup, before entries are logged.
+ */
+func ConfigureOutputs(outputs []kvsConfig.LogOutputConfig) error {
+	sinks, err := NewSinks(outputs)
+	if err != nil {
+		return err
+	}
+	CloseOutputs()
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	output = sinks
+	outputCloser = sinks
+	return nil
+}
+
+// Closes any file outputs. Entries logged afterwards go to stdout.
+func CloseOutputs() error {
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	var err error
+	if outputCloser != nil {
+		err = outputCloser.Close()
+	}
+	output = os.Stdout
+	outputCloser = nil
+	return err
+}
+
+func processLogChannelEntries(logChannel LogChannelType, done chan struct{}) {
+	defer close(done)
+	for e := range logChannel {
+		if e.flushed != nil {
+			close(e.flushed)
+			continue
+		}
+		write(e)
+		atomic.AddUint64(&writtenCount, 1)
+	}
+}
+
+/*
+ *	Queues e according to the overflow policy. Returns false if the logger is
+ *	not running and e should be written synchronously instead.
+ */
+func enqueue(e entry) bool {
+	channelMutex.RLock()
+	defer channelMutex.RUnlock()
+	if LogChannel == nil || closed {
+		return false
+	}
+
+	switch getOverflowPolicy() {
+	case DropNewestPolicy:
+		select {
+		case LogChannel <- e:
+		default:
+			atomic.AddUint64(&droppedCount, 1)
+		}
+	case DropOldestPolicy:
+		for {
+			select {
+			case LogChannel <- e:
+				return true
+			default:
+			}
+			select {
+			case oldest := <-LogChannel:
+				if oldest.flushed != nil {
+					// Never drop a flush marker, hand it straight back to its waiter
+					close(oldest.flushed)
+				} else {
+					atomic.AddUint64(&droppedCount, 1)
+				}
+			default:
+			}
+		}
+	default:
+		LogChannel <- e
+	}
+	return true
+}
+
+func write(e entry) {
+	settingsMutex.RLock()
+	logFormat := format
+	settingsMutex.RUnlock()
+
+	var line []byte
+	if logFormat == JsonFormat {
+		line = formatJson(e)
+	} else {
+		line = formatText(e)
+	}
+
+	outputMutex.Lock()
+	defer outputMutex.Unlock()
+	output.Write(line)
+}
+
+/*
+ *	Formatting
+ */
+func formatText(e entry) []byte {
+	var b strings.Builder
+	b.WriteString(e.time.Format(time.RFC3339Nano))
+	b.WriteByte(' ')
+	b.WriteString(strings.ToUpper(e.level.String()))
+	b.WriteByte(' ')
+	b.WriteString(e.msg)
+	forEachField(e.fields, func(key string, val interface{}) {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+		b.WriteString(textValue(val))
+	})
+	b.WriteByte('\n')
+	return []byte(b.String())
+}
+
+func textValue(val interface{}) string {
+	var s string
+	switch v := val.(type) {
+	case string:
+		s = v
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprintf("%v", v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+func formatJson(e entry) []byte {
+	record := map[string]interface{}{}
+	forEachField(e.fields, func(key string, val interface{}) {
+		switch v := val.(type) {
+		case error:
+			record[key] = v.Error()
+		case fmt.Stringer:
+			record[key] = v.String()
+		default:
+			record[key] = v
+		}
+	})
+	record["time"] = e.time.Format(time.RFC3339Nano)
+	record["level"] = e.level.String()
+	record["msg"] = e.msg
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		// A field could not be encoded, fall back to its string form
+		for key, val := range record {
+			record[key] = fmt.Sprintf("%v", val)
+		}
+		line, _ = json.Marshal(record)
+	}
+	return append(line, '\n')
+}
+
+/*
+ *	Calls fn for every key-value pair. A trailing key without a value is
+ *	reported under "!BADKEY" rather than dropped.
+ */
+func forEachField(fields []interface{}, fn func(key string, val interface{})) {
+	for i := 0; i < len(fields); i += 2 {
+		if i+1 >= len(fields) {
+			fn("!BADKEY", fields[i])
+			return
+		}
+		key, ok := fields[i].(string)
+		if !ok {
+			key = fmt.Sprintf("%v", fields[i])
+		}
+		fn(key, fields[i+1])
+	}
+}
+
+type contextKey struct{}
+
+// Returns a copy of ctx carrying logger, for FromContext to pick up further down the call chain.
+func NewContext(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, logger)
+}
+
+// Returns the logger stored in ctx by NewContext, or the root logger.
+func FromContext(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return logger
+	}
+	return rootLogger
+}
+
+/*
+ *	Logging methods
+ */
+func With(keyvals ...interface{}) *Logger {
+	return rootLogger.With(keyvals...)
+}
+
+func (l *Logger) With(keyvals ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(keyvals))
+	fields = append(fields, l.fields...)
+	fields = append(fields, keyvals...)
+	return &Logger{fields: fields}
+}
+
+func (l *Logger) log(level Level, msg string, keyvals []interface{}) {
+	if level < GetLevel() {
+		return
+	}
+	fields := l.fields
+	if len(keyvals) > 0 {
+		fields = make([]interface{}, 0, len(l.fields)+len(keyvals))
+		fields = append(fields, l.fields...)
+		fields = append(fields, keyvals...)
+	}
+	e := entry{
+		time:   time.Now().UTC(),
+		level:  level,
+		msg:    msg,
+		fields: fields,
+	}
+	if !enqueue(e) {
+		// Logger not running, e.g. in tests. Write synchronously.
+		write(e)
+	}
+}
+
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.log(DebugLevel, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.log(InfoLevel, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.log(WarnLevel, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.log(ErrorLevel, msg, keyvals)
+}
+
+// Logs msg, waits for the logger to flush and then panics with msg.
+func (l *Logger) Panic(msg string, keyvals ...interface{}) {
+	l.log(PanicLevel, msg, keyvals)
+	flushBeforeExit()
+	panic(msg)
+}
+
+// Logs msg, waits for the logger to flush and then exits with status 1.
+func (l *Logger) Fatal(msg string, keyvals ...interface{}) {
+	l.log(FatalLevel, msg, keyvals)
+	flushBeforeExit()
+	exit(1)
+}
+
+func flushBeforeExit() {
+	ctx, cancel := context.WithTimeout(context.Background(), flushOnExitTimeout)
+	defer cancel()
+	Flush(ctx)
+}
+
+func Debug(msg string, keyvals ...interface{}) {
+	rootLogger.log(DebugLevel, msg, keyvals)
+}
+
+func Info(msg string, keyvals ...interface{}) {
+	rootLogger.log(InfoLevel, msg, keyvals)
 }
 
-func Log(msg string) {
-	wg.Add(1)
-	LogChannel <- fmt.Sprintf("Log : %v", msg)
+func Warn(msg string, keyvals ...interface{}) {
+	rootLogger.log(WarnLevel, msg, keyvals)
 }
 
-func Error(msg string) {
-	wg.Add(1)
-	LogChannel <- fmt.Sprintf("Error : %v", msg)
+func Error(msg string, keyvals ...interface{}) {
+	rootLogger.log(ErrorLevel, msg, keyvals)
 }
 
-func Panic(msg string) {
-	wg.Add(1)
-	LogChannel <- fmt.Sprintf("Panic : %v", msg)
+func Panic(msg string, keyvals ...interface{}) {
+	rootLogger.Panic(msg, keyvals...)
 }
 
-func Fatal(msg string) {
-	wg.Add(1)
-	LogChannel <- fmt.Sprintf("Fatal : %v", msg)
+func Fatal(msg string, keyvals ...interface{}) {
+	rootLogger.Fatal(msg, keyvals...)
 }
@@ -0,0 +1,199 @@
+package kvsLogger
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"gokvs/kvsConfig"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func captureOutput(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	SetOutput(buf)
+	SetLevel(InfoLevel)
+	SetFormat(TextFormat)
+	return buf
+}
+
+func TestTextFormat(t *testing.T) {
+	buf := captureOutput(t)
+
+	With("reqId", "abc").Info("Stored value", "id", "1234", "note", "has spaces")
+
+	line := buf.String()
+	if !strings.Contains(line, " INFO Stored value reqId=abc id=1234 note=\"has spaces\"\n") {
+		t.Errorf("Unexpected text output %q", line)
+	}
+}
+
+func TestJsonFormat(t *testing.T) {
+	buf := captureOutput(t)
+	SetFormat(JsonFormat)
+
+	Warn("Something odd", "count", 3)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("Output is not JSON: %v", err)
+	}
+	if record["level"] != "warn" || record["msg"] != "Something odd" || record["count"] != 3.0 {
+		t.Errorf("Unexpected JSON output %v", record)
+	}
+}
+
+func TestLevelFiltering(t *testing.T) {
+	buf := captureOutput(t)
+	SetLevel(WarnLevel)
+
+	Debug("debug")
+	Info("info")
+	Error("error")
+
+	if got := strings.Count(buf.String(), "\n"); got != 1 {
+		t.Errorf("Expected only the error line, got %q", buf.String())
+	}
+}
+
+func TestPrepareConfig(t *testing.T) {
+	captureOutput(t)
+	if _, err := PrepareConfig(kvsConfig.LoggerConfig{Level: "debug", Format: "json", OverflowPolicy: "sometimes"}); err == nil {
+		t.Errorf("Expected an invalid overflowPolicy to be rejected")
+	}
+	if GetLevel() != InfoLevel {
+		t.Errorf("Expected a rejected config to leave the level alone, got %v", GetLevel())
+	}
+
+	apply, err := PrepareConfig(kvsConfig.LoggerConfig{Level: "debug", Format: "json", OverflowPolicy: "dropNewest"})
+	if err != nil {
+		t.Fatalf("PrepareConfig returned err %v", err)
+	}
+	if GetLevel() != InfoLevel {
+		t.Errorf("Expected nothing to change before the config is applied")
+	}
+	apply()
+	defer SetOverflowPolicy(BlockPolicy)
+	if GetLevel() != DebugLevel || getOverflowPolicy() != DropNewestPolicy {
+		t.Errorf("Expected the level and overflow policy to be applied, got %v and %v", GetLevel(), getOverflowPolicy())
+	}
+}
+
+func TestPanicAndFatal(t *testing.T) {
+	buf := captureOutput(t)
+
+	t.Run("Panic panics after logging", func(t *testing.T) {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("Expected panic with msg, got %v", r)
+			}
+			if !strings.Contains(buf.String(), "PANIC boom") {
+				t.Errorf("Panic was not logged before panicking: %q", buf.String())
+			}
+		}()
+		Panic("boom")
+	})
+
+	t.Run("Fatal exits after logging", func(t *testing.T) {
+		exitCode := -1
+		exit = func(code int) { exitCode = code }
+		defer func() { exit = os.Exit }()
+
+		Fatal("bye")
+		if exitCode != 1 {
+			t.Errorf("Expected exit code 1, got %d", exitCode)
+		}
+		if !strings.Contains(buf.String(), "FATAL bye") {
+			t.Errorf("Fatal was not logged before exiting: %q", buf.String())
+		}
+	})
+}
+
+// A writer that holds every write until released, so the buffer can be filled.
+type gatedWriter struct {
+	gate chan struct{}
+	buf  bytes.Buffer
+}
+
+func (w *gatedWriter) Write(p []byte) (int, error) {
+	<-w.gate
+	return w.buf.Write(p)
+}
+
+func startGatedLogger(t *testing.T, policy string) *gatedWriter {
+	t.Helper()
+	w := &gatedWriter{gate: make(chan struct{})}
+	SetOutput(w)
+	StartLogger(kvsConfig.LoggerConfig{Level: "info", Format: "text", BufferSize: 2, OverflowPolicy: policy})
+	return w
+}
+
+func fillBuffer(t *testing.T) {
+	t.Helper()
+	// The first entry is picked up by the writer and held at the gate
+	Info("held")
+	for LoggerMetrics().(LoggerMetricsStruct).Buffered != 0 {
+		time.Sleep(time.Millisecond)
+	}
+	Info("one")
+	Info("two")
+	Info("three")
+	Info("four")
+}
+
+func TestOverflowPolicies(t *testing.T) {
+	t.Run("Drop newest", func(t *testing.T) {
+		w := startGatedLogger(t, "dropNewest")
+		droppedBefore := LoggerMetrics().(LoggerMetricsStruct).Dropped
+		fillBuffer(t)
+		close(w.gate)
+		Close()
+
+		if dropped := LoggerMetrics().(LoggerMetricsStruct).Dropped - droppedBefore; dropped != 2 {
+			t.Errorf("Expected 2 dropped entries, got %d", dropped)
+		}
+		out := w.buf.String()
+		if !strings.Contains(out, "one") || !strings.Contains(out, "two") || strings.Contains(out, "three") {
+			t.Errorf("Expected the oldest entries to be kept, got %q", out)
+		}
+	})
+
+	t.Run("Drop oldest", func(t *testing.T) {
+		w := startGatedLogger(t, "dropOldest")
+		droppedBefore := LoggerMetrics().(LoggerMetricsStruct).Dropped
+		fillBuffer(t)
+		close(w.gate)
+		Close()
+
+		if dropped := LoggerMetrics().(LoggerMetricsStruct).Dropped - droppedBefore; dropped != 2 {
+			t.Errorf("Expected 2 dropped entries, got %d", dropped)
+		}
+		out := w.buf.String()
+		if strings.Contains(out, "one") || !strings.Contains(out, "three") || !strings.Contains(out, "four") {
+			t.Errorf("Expected the newest entries to be kept, got %q", out)
+		}
+	})
+}
+
+func TestFlush(t *testing.T) {
+	w := startGatedLogger(t, "block")
+	defer Close()
+	Info("pending")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := Flush(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Flush to time out while the writer is blocked, got %v", err)
+	}
+
+	close(w.gate)
+	if err := Flush(context.Background()); err != nil {
+		t.Errorf("Flush returned err %v", err)
+	}
+	if !strings.Contains(w.buf.String(), "pending") {
+		t.Errorf("Expected entry to be written after Flush, got %q", w.buf.String())
+	}
+}
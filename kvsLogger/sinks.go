@@ -0,0 +1,352 @@
+package kvsLogger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"gokvs/kvsConfig"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// Replaced in tests to make rotation fail
+var rename = os.Rename
+
+type stdoutSink struct{}
+
+func (stdoutSink) Write(p []byte) (int, error) {
+	return os.Stdout.Write(p)
+}
+
+func (stdoutSink) Close() error {
+	return nil
+}
+
+/*
+ *	Writes every entry to each of its sinks. A failing sink does not stop the
+ *	others from receiving the entry.
+ */
+type multiSink []io.WriteCloser
+
+func (sinks multiSink) Write(p []byte) (int, error) {
+	var firstErr error
+	for _, sink := range sinks {
+		if _, err := sink.Write(p); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return len(p), firstErr
+}
+
+func (sinks multiSink) Close() error {
+	var firstErr error
+	for _, sink := range sinks {
+		if err := sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+type FileSinkOptions struct {
+	Path       string
+	MaxSize    int64         // Rotate once the file would grow past this many bytes, 0 to disable
+	MaxAge     time.Duration // Rotate once the file is this old, 0 to disable
+	MaxBackups int           // Number of rotated files to keep, 0 to keep all
+	Compress   bool          // Gzip rotated files
+}
+
+/*
+ *	An append-only log file that is rotated by size and age. Rotated files are
+ *	renamed to <name>-<timestamp><ext>, optionally gzipped, and pruned down to
+ *	MaxBackups in the background.
+ */
+type FileSink struct {
+	options  FileSinkOptions
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	openedAt time.Time
+
+	// Serialises compression and pruning of rotated files
+	backgroundMutex sync.Mutex
+	backgroundWg    sync.WaitGroup
+}
+
+func NewFileSink(options FileSinkOptions) (*FileSink, error) {
+	if options.Path == "" {
+		return nil, fmt.Errorf("No log file path provided")
+	}
+	if err := os.MkdirAll(filepath.Dir(options.Path), 0755); err != nil {
+		return nil, err
+	}
+	sink := &FileSink{options: options}
+	if err := sink.open(); err != nil {
+		return nil, err
+	}
+	return sink, nil
+}
+
+func (sink *FileSink) open() error {
+	file, err := os.OpenFile(sink.options.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	sink.file = file
+	sink.size = info.Size()
+	// An existing file is aged from its last write, so restarts do not hold off rotation
+	sink.openedAt = info.ModTime()
+	return nil
+}
+
+func (sink *FileSink) Write(p []byte) (int, error) {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+
+	if sink.file == nil {
+		return 0, fmt.Errorf("Log file %s is closed", sink.options.Path)
+	}
+	if sink.shouldRotate(int64(len(p))) {
+		if err := sink.rotate(); err != nil {
+			if sink.file == nil {
+				return 0, err
+			}
+			fmt.Fprintf(os.Stderr, "Log file rotation error: %v\n", err)
+		}
+	}
+	n, err := sink.file.Write(p)
+	sink.size += int64(n)
+	return n, err
+}
+
+func (sink *FileSink) shouldRotate(writeSize int64) bool {
+	if sink.size == 0 {
+		return false
+	}
+	if sink.options.MaxSize > 0 && sink.size+writeSize > sink.options.MaxSize {
+		return true
+	}
+	if sink.options.MaxAge > 0 && time.Since(sink.openedAt) > sink.options.MaxAge {
+		return true
+	}
+	return false
+}
+
+// Rotate closes the current file, moves it aside and opens a fresh one.
+func (sink *FileSink) Rotate() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	return sink.rotate()
+}
+
+/*
+ *	When the file cannot be moved aside it is reopened, so logging carries on
+ *	in the oversized file and rotation is retried on the next write.
+ */
+func (sink *FileSink) rotate() error {
+	if sink.file == nil {
+		return fmt.Errorf("Log file %s is closed", sink.options.Path)
+	}
+	if err := sink.file.Close(); err != nil {
+		return err
+	}
+	sink.file = nil
+	backupPath := sink.backupPath(time.Now())
+	if err := rename(sink.options.Path, backupPath); err != nil {
+		if openErr := sink.open(); openErr != nil {
+			return fmt.Errorf("Could not rotate log file %s: %v, nor reopen it: %v", sink.options.Path, err, openErr)
+		}
+		return err
+	}
+	if err := sink.open(); err != nil {
+		return err
+	}
+
+	sink.backgroundWg.Add(1)
+	go func() {
+		defer sink.backgroundWg.Done()
+		sink.backgroundMutex.Lock()
+		defer sink.backgroundMutex.Unlock()
+		if sink.options.Compress {
+			if err := compressFile(backupPath); err != nil {
+				fmt.Fprintf(os.Stderr, "Log file compression error: %v\n", err)
+			}
+		}
+		if err := sink.prune(); err != nil {
+			fmt.Fprintf(os.Stderr, "Log file pruning error: %v\n", err)
+		}
+	}()
+	return nil
+}
+
+func (sink *FileSink) Close() error {
+	sink.mutex.Lock()
+	defer sink.mutex.Unlock()
+	sink.backgroundWg.Wait()
+	if sink.file == nil {
+		return nil
+	}
+	err := sink.file.Close()
+	sink.file = nil
+	return err
+}
+
+func (sink *FileSink) splitPath() (string, string) {
+	ext := filepath.Ext(sink.options.Path)
+	return strings.TrimSuffix(sink.options.Path, ext), ext
+}
+
+func (sink *FileSink) backupPath(rotatedAt time.Time) string {
+	base, ext := sink.splitPath()
+	path := fmt.Sprintf("%s-%s%s", base, rotatedAt.UTC().Format(backupTimeFormat), ext)
+	// Rotations within the same millisecond get a counter suffix
+	for i := 1; fileExists(path) || fileExists(path+".gz"); i++ {
+		path = fmt.Sprintf("%s-%s.%d%s", base, rotatedAt.UTC().Format(backupTimeFormat), i, ext)
+	}
+	return path
+}
+
+/*
+ *	Lists rotated files, oldest first. The timestamp format sorts lexically.
+ *	Only names backupPath could have made are listed, so other files sharing
+ *	the prefix, such as app-debug.log next to app.log, are never pruned.
+ */
+func (sink *FileSink) Backups() ([]string, error) {
+	base, ext := sink.splitPath()
+	matches, err := filepath.Glob(base + "-*" + ext + "*")
+	if err != nil {
+		return nil, err
+	}
+	backups := []string{}
+	for _, match := range matches {
+		if isBackupName(strings.TrimPrefix(match, base+"-"), ext) {
+			backups = append(backups, match)
+		}
+	}
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// Whether suffix is <timestamp>[.<counter>]<ext>[.gz] as written by backupPath.
+func isBackupName(suffix string, ext string) bool {
+	name := strings.TrimSuffix(suffix, ".gz")
+	if !strings.HasSuffix(name, ext) {
+		return false
+	}
+	name = strings.TrimSuffix(name, ext)
+	if len(name) < len(backupTimeFormat) {
+		return false
+	}
+	if _, err := time.Parse(backupTimeFormat, name[:len(backupTimeFormat)]); err != nil {
+		return false
+	}
+	counter := name[len(backupTimeFormat):]
+	if counter == "" {
+		return true
+	}
+	if !strings.HasPrefix(counter, ".") {
+		return false
+	}
+	_, err := strconv.ParseUint(counter[1:], 10, 64)
+	return err == nil
+}
+
+func (sink *FileSink) prune() error {
+	if sink.options.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := sink.Backups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > sink.options.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		gz.Close()
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		os.Remove(path + ".gz")
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+/*
+ *	Builds the configured sinks. With no outputs configured the logger writes to
+ *	stdout only.
+ */
+func NewSinks(outputs []kvsConfig.LogOutputConfig) (io.WriteCloser, error) {
+	if len(outputs) == 0 {
+		return stdoutSink{}, nil
+	}
+	sinks := multiSink{}
+	for _, output := range outputs {
+		switch output.Type {
+		case "stdout":
+			sinks = append(sinks, stdoutSink{})
+		case "file":
+			sink, err := NewFileSink(FileSinkOptions{
+				Path:       output.Path,
+				MaxSize:    output.MaxSizeMB * 1024 * 1024,
+				MaxAge:     time.Duration(output.MaxAgeHours) * time.Hour,
+				MaxBackups: output.MaxBackups,
+				Compress:   output.Compress,
+			})
+			if err != nil {
+				sinks.Close()
+				return nil, err
+			}
+			sinks = append(sinks, sink)
+		default:
+			sinks.Close()
+			return nil, fmt.Errorf("Unknown log output type %q", output.Type)
+		}
+	}
+	if len(sinks) == 1 {
+		return sinks[0], nil
+	}
+	return sinks, nil
+}
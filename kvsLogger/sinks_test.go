@@ -0,0 +1,199 @@
+package kvsLogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSinkRotation(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kvs.log")
+	sink, err := NewFileSink(FileSinkOptions{
+		Path:       path,
+		MaxSize:    20,
+		MaxBackups: 2,
+		Compress:   true,
+	})
+	if err != nil {
+		t.Fatalf("NewFileSink returned err %v", err)
+	}
+
+	for _, line := range []string{"first line 12345\n", "second line 1234\n", "third line 12345\n", "fourth line 1234\n"} {
+		if _, err := sink.Write([]byte(line)); err != nil {
+			t.Fatalf("Write returned err %v", err)
+		}
+		// Keep backup timestamps distinct
+		time.Sleep(2 * time.Millisecond)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatalf("Close returned err %v", err)
+	}
+
+	current, _ := os.ReadFile(path)
+	if string(current) != "fourth line 1234\n" {
+		t.Errorf("Expected current file to hold the last line, got %q", current)
+	}
+
+	backups, err := sink.Backups()
+	if err != nil {
+		t.Fatalf("Backups returned err %v", err)
+	}
+	if len(backups) != 2 {
+		t.Fatalf("Expected 2 backups to be retained, got %v", backups)
+	}
+	for i, want := range []string{"second line 1234\n", "third line 12345\n"} {
+		if !strings.HasSuffix(backups[i], ".log.gz") {
+			t.Errorf("Expected backup %s to be compressed", backups[i])
+			continue
+		}
+		if got := readGzip(t, backups[i]); got != want {
+			t.Errorf("Backup %d: expected %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestFileSinkRotationFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvs.log")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 20})
+	if err != nil {
+		t.Fatalf("NewFileSink returned err %v", err)
+	}
+	defer sink.Close()
+
+	rename = func(string, string) error { return errors.New("rename failed") }
+	defer func() { rename = os.Rename }()
+
+	sink.Write([]byte("first line 12345\n"))
+	if _, err := sink.Write([]byte("second line 1234\n")); err != nil {
+		t.Errorf("Expected the write to go to the current file, got %v", err)
+	}
+	if err := sink.Rotate(); err == nil {
+		t.Errorf("Expected the failed rotation to be reported")
+	}
+
+	rename = os.Rename
+	if _, err := sink.Write([]byte("third line 12345\n")); err != nil {
+		t.Fatalf("Expected the sink to keep working after a failed rotation, got %v", err)
+	}
+	backups, _ := sink.Backups()
+	if len(backups) != 1 {
+		t.Fatalf("Expected the retried rotation to make 1 backup, got %v", backups)
+	}
+	sink.Close()
+	if backup, _ := os.ReadFile(backups[0]); string(backup) != "first line 12345\nsecond line 1234\n" {
+		t.Errorf("Expected the backup to hold the first two lines, got %q", backup)
+	}
+	if current, _ := os.ReadFile(path); string(current) != "third line 12345\n" {
+		t.Errorf("Expected the current file to hold the last line, got %q", current)
+	}
+}
+
+func TestFileSinkAgeRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvs.log")
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxAge: time.Millisecond})
+	if err != nil {
+		t.Fatalf("NewFileSink returned err %v", err)
+	}
+	defer sink.Close()
+
+	sink.Write([]byte("old\n"))
+	time.Sleep(5 * time.Millisecond)
+	sink.Write([]byte("new\n"))
+
+	if backups, _ := sink.Backups(); len(backups) != 1 {
+		t.Errorf("Expected 1 backup after age rotation, got %v", backups)
+	}
+}
+
+func TestMultiSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvs.log")
+	file, err := NewFileSink(FileSinkOptions{Path: path})
+	if err != nil {
+		t.Fatalf("NewFileSink returned err %v", err)
+	}
+	buf := &bytes.Buffer{}
+	sinks := multiSink{file, nopCloser{buf}}
+
+	sinks.Write([]byte("fan out\n"))
+	sinks.Close()
+
+	fromFile, _ := os.ReadFile(path)
+	if string(fromFile) != "fan out\n" || buf.String() != "fan out\n" {
+		t.Errorf("Expected entry in every sink, got file %q buffer %q", fromFile, buf.String())
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+func readGzip(t *testing.T, path string) string {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Open returned err %v", err)
+	}
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatalf("gzip.NewReader returned err %v", err)
+	}
+	contents, _ := io.ReadAll(gz)
+	return string(contents)
+}
+
+func TestFileSinkBackupsOnlyMatchRotatedNames(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "app.log")
+	others := []string{"app-debug.log", "app-2026-10-19T13-00-00.000-old.log", "app-2026-10-19T13-00-00.000.x.log"}
+	for _, name := range others {
+		os.WriteFile(filepath.Join(dir, name), []byte("other sink\n"), 0644)
+	}
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxSize: 16, MaxBackups: 1})
+	if err != nil {
+		t.Fatalf("NewFileSink returned err %v", err)
+	}
+	for _, line := range []string{"first line 12345\n", "second line 1234\n", "third line 12345\n"} {
+		sink.Write([]byte(line))
+	}
+	sink.Close()
+
+	backups, _ := sink.Backups()
+	if len(backups) != 1 || filepath.Base(backups[0]) == "app-debug.log" {
+		t.Errorf("Expected only the rotated backup to be listed, got %v", backups)
+	}
+	for _, name := range others {
+		if !fileExists(filepath.Join(dir, name)) {
+			t.Errorf("Expected %s to survive pruning", name)
+		}
+	}
+}
+
+func TestFileSinkAgeFromExistingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kvs.log")
+	os.WriteFile(path, []byte("before restart\n"), 0644)
+	old := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(path, old, old)
+
+	sink, err := NewFileSink(FileSinkOptions{Path: path, MaxAge: time.Hour})
+	if err != nil {
+		t.Fatalf("NewFileSink returned err %v", err)
+	}
+	defer sink.Close()
+	sink.Write([]byte("after restart\n"))
+
+	if backups, _ := sink.Backups(); len(backups) != 1 {
+		t.Errorf("Expected a file older than MaxAge to be rotated after a restart, got %v", backups)
+	}
+}
@@ -0,0 +1,396 @@
+package kvsMetrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *	A minimal Prometheus registry. Metrics are registered once at package init
+ *	and rendered in the text exposition format by Handler.
+ */
+type collector interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var registry = map[string]collector{}
+var registryMutex sync.Mutex
+
+var DefaultBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+func register(c collector) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if _, ok := registry[c.name()]; ok {
+		panic(fmt.Sprintf("Metric %s registered twice", c.name()))
+	}
+	registry[c.name()] = c
+}
+
+type metricFamily struct {
+	metricName string
+	help       string
+	metricType string
+	labelNames []string
+}
+
+func (f metricFamily) name() string {
+	return f.metricName
+}
+
+func (f metricFamily) writeHeader(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n", f.metricName, escapeHelp(f.help))
+	fmt.Fprintf(w, "# TYPE %s %s\n", f.metricName, f.metricType)
+}
+
+func (f metricFamily) checkLabels(labelValues []string) {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("Metric %s expects labels %v, got %v", f.metricName, f.labelNames, labelValues))
+	}
+}
+
+/*
+ *	Counters
+ */
+type CounterVec struct {
+	metricFamily
+	mutex  sync.Mutex
+	values map[string]*labelledValue
+}
+
+type labelledValue struct {
+	labelValues []string
+	value       float64
+}
+
+func NewCounterVec(name, help string, labelNames ...string) *CounterVec {
+	c := &CounterVec{
+		metricFamily: metricFamily{name, help, "counter", labelNames},
+		values:       map[string]*labelledValue{},
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	c.checkLabels(labelValues)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	v, ok := c.values[key]
+	if !ok {
+		v = &labelledValue{labelValues: append([]string{}, labelValues...)}
+		c.values[key] = v
+	}
+	v.value += delta
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if v, ok := c.values[strings.Join(labelValues, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, key := range sortedKeys(c.values) {
+		v := c.values[key]
+		writeSample(w, c.metricName, c.labelNames, v.labelValues, v.value)
+	}
+}
+
+/*
+ *	Gauges read their value when scraped, so they never go stale.
+ */
+type GaugeFunc struct {
+	metricFamily
+	fn func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{
+		metricFamily: metricFamily{name, help, "gauge", nil},
+		fn:           fn,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	writeSample(w, g.metricName, nil, nil, g.fn())
+}
+
+// A value for one combination of label values, as returned by a GaugeVecFunc.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// Like GaugeFunc, with fn returning a sample for each combination of label values.
+type GaugeVecFunc struct {
+	metricFamily
+	fn func() []Sample
+}
+
+func NewGaugeVecFunc(name, help string, fn func() []Sample, labelNames ...string) *GaugeVecFunc {
+	g := &GaugeVecFunc{
+		metricFamily: metricFamily{name, help, "gauge", labelNames},
+		fn:           fn,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeVecFunc) write(w *bufio.Writer) {
+	g.writeHeader(w)
+	samples := g.fn()
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, "\xff") < strings.Join(samples[j].LabelValues, "\xff")
+	})
+	for _, sample := range samples {
+		g.checkLabels(sample.LabelValues)
+		writeSample(w, g.metricName, g.labelNames, sample.LabelValues, sample.Value)
+	}
+}
+
+// A counter whose value is read from elsewhere when scraped.
+type CounterFunc struct {
+	metricFamily
+	fn func() float64
+}
+
+func NewCounterFunc(name, help string, fn func() float64) *CounterFunc {
+	c := &CounterFunc{
+		metricFamily: metricFamily{name, help, "counter", nil},
+		fn:           fn,
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterFunc) write(w *bufio.Writer) {
+	c.writeHeader(w)
+	writeSample(w, c.metricName, nil, nil, c.fn())
+}
+
+/*
+ *	Histograms
+ */
+type HistogramVec struct {
+	metricFamily
+	buckets []float64
+	mutex   sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+func NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		metricFamily: metricFamily{name, help, "histogram", labelNames},
+		buckets:      buckets,
+		values:       map[string]*histogramValue{},
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	h.checkLabels(labelValues)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	key := strings.Join(labelValues, "\xff")
+	v, ok := h.values[key]
+	if !ok {
+		v = &histogramValue{
+			labelValues: append([]string{}, labelValues...),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = v
+	}
+	for i, upperBound := range h.buckets {
+		if value <= upperBound {
+			v.counts[i]++
+		}
+	}
+	v.count++
+	v.sum += value
+}
+
+func (h *HistogramVec) ObserveDuration(d time.Duration, labelValues ...string) {
+	h.Observe(d.Seconds(), labelValues...)
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.writeHeader(w)
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	bucketLabelNames := append(append([]string{}, h.labelNames...), "le")
+	for _, key := range sortedKeys(h.values) {
+		v := h.values[key]
+		for i, upperBound := range h.buckets {
+			labelValues := append(append([]string{}, v.labelValues...), formatFloat(upperBound))
+			writeSample(w, h.metricName+"_bucket", bucketLabelNames, labelValues, float64(v.counts[i]))
+		}
+		labelValues := append(append([]string{}, v.labelValues...), "+Inf")
+		writeSample(w, h.metricName+"_bucket", bucketLabelNames, labelValues, float64(v.count))
+		writeSample(w, h.metricName+"_sum", h.labelNames, v.labelValues, v.sum)
+		writeSample(w, h.metricName+"_count", h.labelNames, v.labelValues, float64(v.count))
+	}
+}
+
+/*
+ *	Exposition
+ */
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+func WriteTo(w io.Writer) error {
+	registryMutex.Lock()
+	collectors := make([]collector, 0, len(registry))
+	for _, c := range registry {
+		collectors = append(collectors, c)
+	}
+	registryMutex.Unlock()
+	sort.Slice(collectors, func(i, j int) bool {
+		return collectors[i].name() < collectors[j].name()
+	})
+
+	buffered := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(buffered)
+	}
+	return buffered.Flush()
+}
+
+func writeSample(w *bufio.Writer, name string, labelNames, labelValues []string, value float64) {
+	w.WriteString(name)
+	if len(labelNames) > 0 {
+		w.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, "%s=\"%s\"", labelName, escapeLabelValue(labelValues[i]))
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabelValue(s string) string {
+	return labelValueEscaper.Replace(s)
+}
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	switch values := m.(type) {
+	case map[string]*labelledValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	case map[string]*histogramValue:
+		for key := range values {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+/*
+ *	Operation metrics shared by the transports
+ */
+const (
+	OutcomeSuccess  = "success"
+	OutcomeNotFound = "not_found"
+	OutcomeError    = "error"
+)
+
+var Operations = NewCounterVec(
+	"kvs_operations_total",
+	"Store operations handled, by operation, transport and outcome.",
+	"op", "transport", "outcome",
+)
+
+var OperationDuration = NewHistogramVec(
+	"kvs_operation_duration_seconds",
+	"Time taken to handle a store operation, by operation and transport.",
+	DefaultBuckets,
+	"op", "transport",
+)
+
+// Reasons a request is rejected before or by the store for being too large
+const (
+	RejectedRequestTooLarge = "request_too_large"
+	RejectedValueTooLarge   = "value_too_large"
+	RejectedKeyTooLong      = "key_too_long"
+)
+
+var RequestsRejected = NewCounterVec(
+	"kvs_requests_rejected_total",
+	"Requests rejected for exceeding a size limit, by transport and reason.",
+	"transport", "reason",
+)
+
+func ObserveOperation(op, transport, outcome string, start time.Time) {
+	Operations.Inc(op, transport, outcome)
+	OperationDuration.ObserveDuration(time.Since(start), op, transport)
+}
+
+// Picks the outcome label for an operation that returned err.
+func OutcomeOf(err error) string {
+	if err != nil {
+		return OutcomeError
+	}
+	return OutcomeSuccess
+}
@@ -0,0 +1,62 @@
+package kvsMetrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	counter := NewCounterVec("test_requests_total", "Requests.\nBy path.", "path")
+	counter.Inc("/a")
+	counter.Add(2, `/b"\`)
+	gauge := NewGaugeFunc("test_temperature", "Temperature.", func() float64 { return 21.5 })
+	gaugeVec := NewGaugeVecFunc("test_queue_length", "Queue length.", func() []Sample {
+		return []Sample{{[]string{"b", "x"}, 2}, {[]string{"a", "y"}, 1}}
+	}, "queue", "shard")
+	histogram := NewHistogramVec("test_latency_seconds", "Latency.", []float64{0.1, 1}, "op")
+	histogram.Observe(0.05, "get")
+	histogram.Observe(0.5, "get")
+	histogram.Observe(5, "get")
+	defer func() {
+		registryMutex.Lock()
+		defer registryMutex.Unlock()
+		delete(registry, counter.name())
+		delete(registry, gauge.name())
+		delete(registry, gaugeVec.name())
+		delete(registry, histogram.name())
+	}()
+
+	buf := &bytes.Buffer{}
+	if err := WriteTo(buf); err != nil {
+		t.Fatalf("WriteTo returned err %v", err)
+	}
+	output := buf.String()
+
+	for _, want := range []string{
+		"# HELP test_requests_total Requests.\\nBy path.\n# TYPE test_requests_total counter\n",
+		"test_requests_total{path=\"/a\"} 1\n",
+		"test_requests_total{path=\"/b\\\"\\\\\"} 2\n",
+		"# TYPE test_temperature gauge\ntest_temperature 21.5\n",
+		"# TYPE test_queue_length gauge\ntest_queue_length{queue=\"a\",shard=\"y\"} 1\ntest_queue_length{queue=\"b\",shard=\"x\"} 2\n",
+		"# TYPE test_latency_seconds histogram\n",
+		"test_latency_seconds_bucket{op=\"get\",le=\"0.1\"} 1\n",
+		"test_latency_seconds_bucket{op=\"get\",le=\"1\"} 2\n",
+		"test_latency_seconds_bucket{op=\"get\",le=\"+Inf\"} 3\n",
+		"test_latency_seconds_sum{op=\"get\"} 5.55\n",
+		"test_latency_seconds_count{op=\"get\"} 3\n",
+	} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Expected output to contain %q, got\n%s", want, output)
+		}
+	}
+}
+
+func TestDuplicateRegistrationPanics(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Expected registering kvs_operations_total twice to panic")
+		}
+	}()
+	NewCounterVec("kvs_operations_total", "Duplicate.")
+}
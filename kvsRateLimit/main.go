@@ -0,0 +1,218 @@
+package kvsRateLimit
+
+import (
+	"context"
+	"errors"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsMetrics"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrRateLimited = errors.New("Rate limit exceeded.")
+
+// Buckets untouched for this long are full again, and forgotten
+const sweepInterval = time.Minute
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+/*
+ *	Token buckets by client, refilled at rate tokens a second up to burst.
+ *	Full buckets are dropped every sweepInterval, so clients that have gone
+ *	quiet cost nothing.
+ */
+type Limiter struct {
+	mutex     sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{rate: rate, burst: float64(burst), buckets: map[string]*bucket{}, now: time.Now}
+}
+
+// Changes the rate and burst, keeping the clients' buckets.
+func (l *Limiter) SetLimits(rate float64, burst int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+}
+
+/*
+ *	Takes a token from the bucket of client, returning 0, or how long until
+ *	one is available if the bucket is empty. A zero rate allows everything.
+ */
+func (l *Limiter) Take(client string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	b := l.refill(client)
+	if b.tokens < 1 {
+		return l.waitFor(b)
+	}
+	b.tokens--
+	return 0
+}
+
+// Like Take, but only checks for a token without taking it.
+func (l *Limiter) Wait(client string) time.Duration {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.rate <= 0 {
+		return 0
+	}
+	if b := l.refill(client); b.tokens < 1 {
+		return l.waitFor(b)
+	}
+	return 0
+}
+
+// Tops up the bucket of client for the time since it was last used, under mutex.
+func (l *Limiter) refill(client string) *bucket {
+	now := l.now()
+	if now.Sub(l.lastSweep) >= sweepInterval {
+		l.sweep(now)
+	}
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+	return b
+}
+
+func (l *Limiter) waitFor(b *bucket) time.Duration {
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	for client, b := range l.buckets {
+		if b.tokens+now.Sub(b.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+	l.lastSweep = now
+}
+
+// Clients with a bucket, for kvs_ratelimit_clients.
+func (l *Limiter) Clients() int {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return len(l.buckets)
+}
+
+/*
+ *	The limiter shared by the HTTP and TCP servers, configured from
+ *	kvsConfig.RateLimitConfig at startup and on reload.
+ */
+var limiter = NewLimiter(0, 0)
+
+// Failed authentications by remote address, see AllowAuthentication.
+var authLimiter = NewLimiter(0, 0)
+var disconnectAfter int
+var settingsMutex sync.RWMutex
+
+var throttled = kvsMetrics.NewCounterVec(
+	"kvs_ratelimit_throttled_total",
+	"Requests and operations refused for exceeding the rate limit, by transport.",
+	"transport",
+)
+
+var authThrottled = kvsMetrics.NewCounterVec(
+	"kvs_ratelimit_auth_throttled_total",
+	"Authentication attempts refused for too many recent failures from the address, by transport.",
+	"transport",
+)
+
+var _ = kvsMetrics.NewGaugeFunc(
+	"kvs_ratelimit_clients",
+	"Clients with a partly used rate limit bucket.",
+	func() float64 { return float64(limiter.Clients()) },
+)
+
+func Configure(cfg kvsConfig.RateLimitConfig) {
+	PrepareConfig(cfg)()
+}
+
+// Returns a function applying cfg, for reloads that build every package's settings first.
+func PrepareConfig(cfg kvsConfig.RateLimitConfig) func() {
+	return func() {
+		limiter.SetLimits(cfg.RequestsPerSecond, cfg.Burst)
+		authLimiter.SetLimits(cfg.AuthFailuresPerSecond, cfg.AuthFailureBurst)
+		settingsMutex.Lock()
+		defer settingsMutex.Unlock()
+		disconnectAfter = cfg.DisconnectAfter
+	}
+}
+
+// Throttled operations in a row after which a TCP connection is closed, 0 for never.
+func DisconnectAfter() int {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return disconnectAfter
+}
+
+/*
+ *	The client a request is limited as: its identity when authenticated, so
+ *	a key is limited however many addresses use it, and otherwise the host
+ *	part of remoteAddr.
+ */
+func Client(ctx context.Context, remoteAddr string) string {
+	if identity, ok := kvsAuth.IdentityFrom(ctx); ok {
+		return "identity:" + identity.Name
+	}
+	return addressClient(remoteAddr)
+}
+
+func addressClient(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return "addr:" + host
+	}
+	return "addr:" + remoteAddr
+}
+
+/*
+ *	Takes a token for the client of ctx and remoteAddr, returning
+ *	ErrRateLimited and how long to wait when there is none.
+ */
+func Allow(ctx context.Context, transport, remoteAddr string) (time.Duration, error) {
+	if wait := limiter.Take(Client(ctx, remoteAddr)); wait > 0 {
+		throttled.Inc(transport)
+		return wait, ErrRateLimited
+	}
+	return 0, nil
+}
+
+/*
+ *	Checked before a credential from remoteAddr is looked at, whatever
+ *	identity it claims, returning ErrRateLimited and how long to wait once
+ *	the address has used up its allowance of failed authentications. Only
+ *	failures, recorded with RegisterAuthFailure, draw on the allowance, so
+ *	clients with valid credentials are never held up.
+ */
+func AllowAuthentication(transport, remoteAddr string) (time.Duration, error) {
+	if wait := authLimiter.Wait(addressClient(remoteAddr)); wait > 0 {
+		authThrottled.Inc(transport)
+		return wait, ErrRateLimited
+	}
+	return 0, nil
+}
+
+// Draws a failed authentication from the allowance of remoteAddr.
+func RegisterAuthFailure(remoteAddr string) {
+	authLimiter.Take(addressClient(remoteAddr))
+}
@@ -0,0 +1,102 @@
+package kvsRateLimit
+
+import (
+	"context"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	t.Run("Burst", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			if wait := l.Take("a"); wait != 0 {
+				t.Fatalf("Expected request %d to be allowed, got wait %v", i, wait)
+			}
+		}
+		if wait := l.Take("a"); wait != 500*time.Millisecond {
+			t.Errorf("Expected to wait 500ms for the next token, got %v", wait)
+		}
+		if wait := l.Take("b"); wait != 0 {
+			t.Errorf("Expected another client to have its own bucket, got wait %v", wait)
+		}
+	})
+
+	t.Run("Refill", func(t *testing.T) {
+		now = now.Add(250 * time.Millisecond)
+		if wait := l.Take("a"); wait != 250*time.Millisecond {
+			t.Errorf("Expected to wait 250ms, got %v", wait)
+		}
+		now = now.Add(250 * time.Millisecond)
+		if wait := l.Take("a"); wait != 0 {
+			t.Errorf("Expected a refilled token, got wait %v", wait)
+		}
+	})
+
+	t.Run("Full buckets are swept", func(t *testing.T) {
+		now = now.Add(sweepInterval)
+		l.Take("c")
+		if clients := l.Clients(); clients != 1 {
+			t.Errorf("Expected only the new client to have a bucket, got %d", clients)
+		}
+	})
+
+	t.Run("Zero rate allows everything", func(t *testing.T) {
+		l.SetLimits(0, 0)
+		for i := 0; i < 10; i++ {
+			if wait := l.Take("c"); wait != 0 {
+				t.Fatalf("Expected no limit, got wait %v", wait)
+			}
+		}
+	})
+}
+
+func TestAllow(t *testing.T) {
+	Configure(kvsConfig.RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1, DisconnectAfter: 5})
+	defer Configure(kvsConfig.RateLimitConfig{})
+	if DisconnectAfter() != 5 {
+		t.Errorf("Expected DisconnectAfter 5, got %d", DisconnectAfter())
+	}
+
+	alice := kvsAuth.WithIdentity(context.Background(), kvsAuth.Identity{Name: "alice"})
+	if _, err := Allow(alice, "http", "10.0.0.1:1234"); err != nil {
+		t.Errorf("Expected the first request to be allowed, got %v", err)
+	}
+	if _, err := Allow(alice, "http", "10.0.0.2:1234"); err != ErrRateLimited {
+		t.Errorf("Expected an identity to be limited across addresses, got %v", err)
+	}
+	if _, err := Allow(context.Background(), "tcp", "10.0.0.1:1234"); err != nil {
+		t.Errorf("Expected an anonymous client to be limited by address, got %v", err)
+	}
+	if _, err := Allow(context.Background(), "tcp", "10.0.0.1:5678"); err != ErrRateLimited {
+		t.Errorf("Expected every port of an address to share a bucket, got %v", err)
+	}
+}
+
+func TestAllowAuthentication(t *testing.T) {
+	Configure(kvsConfig.RateLimitConfig{AuthFailuresPerSecond: 0.001, AuthFailureBurst: 2})
+	defer Configure(kvsConfig.RateLimitConfig{})
+
+	for i := 0; i < 2; i++ {
+		if _, err := AllowAuthentication("http", "10.0.0.1:1234"); err != nil {
+			t.Fatalf("Expected attempt %d within the burst to be allowed, got %v", i, err)
+		}
+		RegisterAuthFailure("10.0.0.1:1234")
+	}
+	if _, err := AllowAuthentication("tcp", "10.0.0.1:5678"); err != ErrRateLimited {
+		t.Errorf("Expected an address out of failures to be refused on every port and transport, got %v", err)
+	}
+	if _, err := AllowAuthentication("http", "10.0.0.2:1234"); err != nil {
+		t.Errorf("Expected another address to be unaffected, got %v", err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, err := AllowAuthentication("http", "10.0.0.2:1234"); err != nil {
+			t.Fatalf("Expected attempts without failures never to be refused, got %v", err)
+		}
+	}
+}
@@ -1,16 +1,32 @@
 package kvsTcpServer
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"gokvs/kvs"
+	"gokvs/kvsAudit"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsDocument"
 	"gokvs/kvsLogger"
+	"gokvs/kvsMetrics"
+	"gokvs/kvsRateLimit"
+	"gokvs/kvsTls"
+	"gokvs/kvsTracing"
 	"io"
-	"log"
+	"mime"
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Operation struct {
@@ -18,29 +34,381 @@ type Operation struct {
 	Value     interface{} `json:"val"`
 	Id        string      `json:"id"`
 	RequestId string      `json:"reqId"`
+
+	// Namespace the operation applies to, the default namespace if empty
+	Namespace string `json:"ns,omitempty"`
+
+	// Optional JSONPath for FETCH, returning only the selected part of the value
+	Path string `json:"path,omitempty"`
+
+	// Filter, page size and cursor from the previous page for QUERY
+	Filter string `json:"filter,omitempty"`
+	Limit  int    `json:"limit,omitempty"`
+	Cursor string `json:"cursor,omitempty"`
+
+	// Optional expiry in seconds for STORE and UPDATE
+	TTL float64 `json:"ttl,omitempty"`
+
+	// With Encoding "base64", val is a base64 string of raw bytes stored with ContentType
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// Optional W3C trace context, continued by the span for this operation
+	Traceparent string `json:"traceparent,omitempty"`
 }
 
 type Response struct {
 	RequestId string      `json:"reqId"`
 	Response  interface{} `json:"res"`
 	Success   bool        `json:"success"`
+
+	// Set when res is a base64 string of a raw value
+	Encoding    string `json:"encoding,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+
+	// Seconds until the client may try again, set when throttled
+	RetryAfter float64 `json:"retryAfter,omitempty"`
+}
+
+const base64Encoding = "base64"
+
+// Returns the value carried by op, decoding base64 values to a kvs.Blob.
+func operationValue(op Operation) (interface{}, error) {
+	switch op.Encoding {
+	case "":
+		return op.Value, nil
+	case base64Encoding:
+		encoded, ok := op.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("Base64 value must be a string")
+		}
+		data, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid base64 value: %v", err)
+		}
+		contentType := op.ContentType
+		if contentType == "" {
+			contentType = kvs.DefaultBinaryContentType
+		}
+		return kvs.Blob{ContentType: contentType, Data: data}, nil
+	}
+	return nil, fmt.Errorf("Unknown encoding %q", op.Encoding)
+}
+
+/*
+ *	The patch of a PATCH operation. contentType picks JSON Patch or JSON Merge
+ *	Patch; without it an array val is a JSON Patch and anything else a merge
+ *	patch.
+ */
+func operationPatch(op Operation) (kvsDocument.Patch, error) {
+	_, isArray := op.Value.([]interface{})
+	// Parameters such as charset are ignored, as they are over HTTP
+	var mediaType string
+	if op.ContentType != "" {
+		var err error
+		if mediaType, _, err = mime.ParseMediaType(op.ContentType); err != nil {
+			return nil, fmt.Errorf("Unknown patch content type %q", op.ContentType)
+		}
+	}
+	switch {
+	case mediaType == kvsDocument.JsonPatchContentType || (mediaType == "" && isArray):
+		data, err := json.Marshal(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		return kvsDocument.ParseJsonPatch(data)
+	case mediaType == kvsDocument.MergePatchContentType || mediaType == "":
+		return kvsDocument.NewMergePatch(op.Value), nil
+	}
+	return nil, fmt.Errorf("Unknown patch content type %q", op.ContentType)
+}
+
+/*
+ *	The delta of an INCR operation, 1 when val is omitted. Only JSON numbers
+ *	are accepted, so a numeric string such as "5" is an error.
+ */
+func incrementDelta(value interface{}) (json.Number, error) {
+	switch v := value.(type) {
+	case nil:
+		return json.Number("1"), nil
+	case json.Number:
+		return v, nil
+	}
+	return "", fmt.Errorf("Invalid INCR val of type %T, expected a number", value)
+}
+
+// Fills in res, base64 encoding raw values.
+func setResponseValue(response *Response, val interface{}) {
+	if blob, ok := val.(kvs.Blob); ok {
+		response.Response = base64.StdEncoding.EncodeToString(blob.Data)
+		response.Encoding = base64Encoding
+		response.ContentType = blob.ContentType
+		return
+	}
+	response.Response = val
 }
 
 var shuttingDown bool
 
-func processOperation(op Operation) (interface{}, error) {
+var activeConnections int64
+
+// Set by StartTcpServer and SetMaxRequestBytes, 0 means no limit
+var maxRequestBytes int64
+
+// Changes the line length limit of operations read from now on, for config reloads.
+func SetMaxRequestBytes(limit int64) {
+	atomic.StoreInt64(&maxRequestBytes, limit)
+}
+
+// 1 while the listener is accepting connections
+var accepting int32
+
+/*
+ *	Open connections, listed by the admin server. Operations is updated by the
+ *	connection's goroutine and read atomically.
+ */
+type ConnectionInfo struct {
+	Id         int64     `json:"id"`
+	RemoteAddr string    `json:"remoteAddr"`
+	OpenedAt   time.Time `json:"openedAt"`
+	Operations int64     `json:"operations"`
+	Identity   string    `json:"identity,omitempty"` // Set by AUTH or a client certificate, under connectionsMutex
+}
+
+var connections = map[int64]*ConnectionInfo{}
+var connectionsMutex sync.Mutex
+var lastConnectionId int64
+
+func trackConnection(conn net.Conn) *ConnectionInfo {
+	info := &ConnectionInfo{
+		Id:         atomic.AddInt64(&lastConnectionId, 1),
+		RemoteAddr: conn.RemoteAddr().String(),
+		OpenedAt:   time.Now(),
+	}
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	connections[info.Id] = info
+	return info
+}
+
+func untrackConnection(info *ConnectionInfo) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	delete(connections, info.Id)
+}
+
+// Returns a snapshot of the open connections, oldest first.
+func Connections() []ConnectionInfo {
+	connectionsMutex.Lock()
+	list := make([]ConnectionInfo, 0, len(connections))
+	for _, info := range connections {
+		list = append(list, ConnectionInfo{
+			Id:         info.Id,
+			RemoteAddr: info.RemoteAddr,
+			OpenedAt:   info.OpenedAt,
+			Operations: atomic.LoadInt64(&info.Operations),
+			Identity:   info.Identity,
+		})
+	}
+	connectionsMutex.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Id < list[j].Id })
+	return list
+}
+
+// Reasons for kvs_tcp_connections_refused_total
+const (
+	closedMaxConnections = "max_connections"
+	closedRateLimited    = "rate_limited"
+)
+
+var connectionsClosed = kvsMetrics.NewCounterVec(
+	"kvs_tcp_connections_refused_total",
+	"TCP connections refused at accept or closed by the server for exceeding a limit, by reason.",
+	"reason",
+)
+
+var _ = kvsMetrics.NewGaugeFunc(
+	"kvs_tcp_active_connections",
+	"TCP connections currently open.",
+	func() float64 { return float64(atomic.LoadInt64(&activeConnections)) },
+)
+
+type operationPermission struct {
+	permissions []string
+	keyed       bool // Applies to the op's id, rather than every key
+}
+
+/*
+ *	Permissions needed for each TCP operation. STORE and QUERY cover no
+ *	particular key, so they need a grant on every key in the namespace. INCR
+ *	and PATCH reply with the new value, so they need read as well as write.
+ */
+var operationPermissions = map[string]operationPermission{
+	"STORE":   {[]string{kvsAuth.WritePermission}, false},
+	"FETCH":   {[]string{kvsAuth.ReadPermission}, true},
+	"UPDATE":  {[]string{kvsAuth.WritePermission}, true},
+	"DELETE":  {[]string{kvsAuth.DeletePermission}, true},
+	"INCR":    {[]string{kvsAuth.WritePermission, kvsAuth.ReadPermission}, true},
+	"PATCH":   {[]string{kvsAuth.WritePermission, kvsAuth.ReadPermission}, true},
+	"QUERY":   {[]string{kvsAuth.ReadPermission}, false},
+	"SLOWLOG": {[]string{kvsAuth.AdminPermission}, false},
+}
+
+// Metric label for each TCP operation
+var operationLabels = map[string]string{
+	"STORE":  "set",
+	"FETCH":  "get",
+	"UPDATE": "update",
+	"DELETE": "delete",
+	"INCR":   "increment",
+	"PATCH":  "patch",
+	"QUERY":  "scan",
+}
+
+/*
+ *	ctx carries the logger for this operation, tagged with the client's reqId.
+ */
+func processOperation(ctx context.Context, op Operation) (interface{}, error) {
+	ctx, span := kvsTracing.StartSpan(
+		kvsTracing.Extract(ctx, op.Traceparent),
+		"TCP "+op.Operation,
+		kvsTracing.KindServer,
+		kvsTracing.Attribute{Key: "kvs.tcp.op", Value: op.Operation},
+		kvsTracing.Attribute{Key: "kvs.tcp.reqId", Value: op.RequestId},
+	)
+	defer span.End()
+	ctx = kvs.WithNamespace(ctx, op.Namespace)
+
+	logger := kvsLogger.FromContext(ctx)
+	if sc := span.SpanContext(); sc.IsValid() {
+		logger = logger.With("traceId", sc.TraceID, "spanId", sc.SpanID)
+		ctx = kvsLogger.NewContext(ctx, logger)
+	}
+	logger.Debug("TCP operation", "op", op.Operation, "id", op.Id)
+	required := operationPermissions[op.Operation]
+	for _, permission := range required.permissions {
+		request := kvsAuth.Request{Permission: permission, Namespace: kvs.NamespaceFrom(ctx)}
+		if required.keyed {
+			request.Key = op.Id
+		}
+		if err := kvsAuth.Authorize(ctx, request); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+	if op.Operation == "SLOWLOG" {
+		return kvs.SlowLog(), nil
+	}
+	var ttl time.Duration
+	if op.TTL != 0 {
+		var err error
+		if ttl, err = kvs.TTLFromSeconds(op.TTL); err != nil {
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+	value, err := operationValue(op)
+	if err != nil {
+		span.RecordError(err)
+		return nil, err
+	}
+	start := time.Now()
+	var result interface{}
 	switch op.Operation {
 	case "STORE":
-		return kvs.Set(op.Value)
+		result, err = kvs.SetWithTTLContext(ctx, value, ttl)
 	case "FETCH":
-		return kvs.Get(op.Id)
+		if op.Path == "" {
+			result, err = kvs.GetContext(ctx, op.Id)
+			break
+		}
+		var path kvsDocument.Path
+		path, err = kvsDocument.ParsePath(op.Path)
+		if err == nil {
+			result, _, err = kvs.GetPathContext(ctx, op.Id, path)
+		}
 	case "UPDATE":
-		return nil, kvs.Update(op.Id, op.Value)
+		err = kvs.UpdateWithTTLContext(ctx, op.Id, value, ttl)
 	case "DELETE":
-		return nil, kvs.Delete(op.Id)
+		err = kvs.DeleteContext(ctx, op.Id)
+	case "INCR":
+		var delta json.Number
+		if delta, err = incrementDelta(op.Value); err == nil {
+			result, err = kvs.IncrementContext(ctx, op.Id, delta)
+		}
+	case "QUERY":
+		result, err = queryPage(ctx, op)
+	case "PATCH":
+		var patch kvsDocument.Patch
+		patch, err = operationPatch(op)
+		if err == nil {
+			result, err = kvs.PatchContext(ctx, op.Id, patch)
+		}
 	default:
-		return nil, fmt.Errorf("Invalid operation")
+		logger.Warn("Invalid TCP operation", "op", op.Operation)
+		err = fmt.Errorf("Invalid operation")
+		span.RecordError(err)
+		return nil, err
 	}
+	span.RecordError(err)
+	switch err {
+	case kvs.ErrValueTooLarge:
+		kvsMetrics.RequestsRejected.Inc("tcp", kvsMetrics.RejectedValueTooLarge)
+	case kvs.ErrKeyTooLong:
+		kvsMetrics.RequestsRejected.Inc("tcp", kvsMetrics.RejectedKeyTooLong)
+	}
+
+	outcome := kvsMetrics.OutcomeOf(err)
+	if (op.Operation == "FETCH" || op.Operation == "PATCH") && err == nil && result == nil || err == kvs.ErrPathNotFound {
+		outcome = kvsMetrics.OutcomeNotFound
+	}
+	kvsMetrics.ObserveOperation(operationLabels[op.Operation], "tcp", outcome, start)
+	return result, err
+}
+
+/*
+ *	A QUERY response, like a kvs.ScanPage with raw values base64 encoded the
+ *	way FETCH returns them.
+ */
+type queryResult struct {
+	Items  []queryItem `json:"items"`
+	Cursor string      `json:"cursor,omitempty"`
+}
+
+type queryItem struct {
+	Id          string      `json:"id"`
+	Value       interface{} `json:"value"`
+	Encoding    string      `json:"encoding,omitempty"`
+	ContentType string      `json:"contentType,omitempty"`
+}
+
+func queryPage(ctx context.Context, op Operation) (queryResult, error) {
+	var filter kvsDocument.Filter
+	if op.Filter != "" {
+		var err error
+		if filter, err = kvsDocument.ParseFilter(op.Filter); err != nil {
+			return queryResult{}, err
+		}
+	}
+	if op.Limit < 0 || op.Limit > kvs.MaxScanLimit {
+		return queryResult{}, fmt.Errorf("Invalid limit %d, expected 1 to %d", op.Limit, kvs.MaxScanLimit)
+	}
+	page, err := kvs.ScanContext(ctx, filter, op.Cursor, op.Limit)
+	if err != nil {
+		return queryResult{}, err
+	}
+	result := queryResult{Items: make([]queryItem, 0, len(page.Items)), Cursor: page.Cursor}
+	for _, item := range page.Items {
+		response := Response{}
+		setResponseValue(&response, item.Value)
+		result.Items = append(result.Items, queryItem{
+			Id:          item.Id,
+			Value:       response.Response,
+			Encoding:    response.Encoding,
+			ContentType: response.ContentType,
+		})
+	}
+	return result, nil
 }
 
 func filterEmptyStrings(s []string) []string {
@@ -55,16 +423,18 @@ func filterEmptyStrings(s []string) []string {
 	return s[:n]
 }
 
-func separateOperations(buf []byte) []Operation {
+func separateOperations(logger *kvsLogger.Logger, buf []byte) []Operation {
 	opStrings := strings.Split(string(buf), "\n")
 	opStrings = filterEmptyStrings(opStrings)
 
 	opSlice := []Operation{}
 	for _, opString := range opStrings {
 		var operation Operation
-		err := json.Unmarshal([]byte(opString), &operation)
+		decoder := json.NewDecoder(strings.NewReader(opString))
+		decoder.UseNumber()
+		err := decoder.Decode(&operation)
 		if err != nil {
-			kvsLogger.Error(fmt.Sprintf("Operation decoding error : %v", err.Error()))
+			logger.Warn("Operation decoding error", "err", err)
 		} else {
 			opSlice = append(opSlice, operation)
 		}
@@ -75,93 +445,314 @@ func separateOperations(buf []byte) []Operation {
 /*
  *	Messages expected to be JSON objects with the following fields;
  *		reqId 	- for the client to be able to link requests and response
- *		op		- One of the following strings: "STORE", "GET", "UPDATE", "DELETE", "STOP"
- *		val		- Value to be stored (if relevant)
+ *		op		- One of the following strings: "AUTH", "STORE", "GET", "UPDATE", "DELETE", "INCR", "PATCH", "QUERY", "SLOWLOG", "STOP"
+ *		val		- Value to be stored (if relevant), the delta for INCR (default 1), the patch for PATCH or the API key or token for AUTH
  *		id		- Id to be operated on (if relevant)
+ *		ns		- Namespace to operate in (optional, the default namespace if empty)
+ *		path	- JSONPath selecting part of the value for FETCH (optional)
+ *		filter, limit, cursor	- Filter expression, page size and cursor of the previous page for QUERY (optional)
+ *		ttl		- Seconds until a stored value expires (optional)
+ *		encoding	- "base64" if val is base64 encoded raw bytes (optional)
+ *		contentType	- Content type of a base64 value, application/octet-stream by default, or the patch type for PATCH
+ *	Raw values are fetched base64 encoded, with encoding and contentType set
+ *	on the response.
+ *		traceparent	- W3C trace context to continue (optional)
+ *	When authentication is enabled, every operation before a successful AUTH
+ *	is refused, and the connection is closed after maxAuthFailures failed
+ *	AUTH operations, or straight away when its address has failed
+ *	authentication too often recently, across connections. Operations over the client's rate limit get an error
+ *	response with retryAfter, and the connection is closed after
+ *	rateLimit.disconnectAfter of them in a row. Connections presenting a TLS client certificate mapped
+ *	to an identity are authenticated from the start.
  *	Input must be delimited by a newline char ('\n')
  *	Responses will be delimieted by newline char ('\n)
  */
 func handleConnection(wg *sync.WaitGroup, conn net.Conn) {
 	defer conn.Close()
-	buffer := make([]byte, 1024)
-	fmt.Println("New connection from : ", conn.LocalAddr())
+	reader := bufio.NewReader(conn)
+	connLogger := kvsLogger.With("remoteAddr", conn.RemoteAddr().String())
+	connLogger.Info("New TCP connection")
 	wg.Add(1)
 	defer wg.Done()
-	for {
-		n, err := conn.Read(buffer)
-		if err != nil && err != io.EOF {
-			log.Println("Read err", err)
-		}
-		if n == 0 {
+	defer atomic.AddInt64(&activeConnections, -1)
+	info := trackConnection(conn)
+	defer untrackConnection(info)
+	var identity *kvsAuth.Identity
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		var err error
+		if identity, err = handshake(tlsConn, connLogger); err != nil {
+			connLogger.Warn("TLS handshake failed", "err", err)
 			return
 		}
+		if identity != nil {
+			setConnectionIdentity(info, *identity)
+			connLogger = connLogger.With("identity", identity.Name)
+		}
+	}
+	authFailures := 0
+	throttledInRow := 0
+	for {
+		limit := atomic.LoadInt64(&maxRequestBytes)
+		line, err := readRequest(reader, limit)
+		if err == errRequestTooLarge {
+			connLogger.Warn("TCP request too large", "maxBytes", limit)
+			kvsMetrics.RequestsRejected.Inc("tcp", kvsMetrics.RejectedRequestTooLarge)
+			writeResponse(conn, connLogger, Response{Response: err.Error()})
+			continue
+		}
 
-		receivedOperations := separateOperations(buffer[:n])
+		receivedOperations := separateOperations(connLogger, line)
 		for _, operation := range receivedOperations {
+			opLogger := connLogger.With("reqId", operation.RequestId)
+			ctx := kvsLogger.NewContext(kvsAudit.WithSource(context.Background(), "tcp", info.RemoteAddr), opLogger)
 
 			if operation.Operation == "STOP" {
 				return
 			}
+			atomic.AddInt64(&info.Operations, 1)
 			responseObject := Response{
 				RequestId: operation.RequestId,
 				Response:  nil,
 				Success:   false,
 			}
-			valToReturn, err := processOperation(operation)
+			if operation.Operation == "AUTH" {
+				if wait, err := kvsRateLimit.AllowAuthentication("tcp", info.RemoteAddr); err != nil {
+					opLogger.Warn("TCP authentication throttled", "retryAfter", wait)
+					responseObject.Response = err.Error()
+					responseObject.RetryAfter = wait.Seconds()
+					writeResponse(conn, opLogger, responseObject)
+					connLogger.Warn("Closing TCP connection after throttled authentication")
+					connectionsClosed.Inc(closedRateLimited)
+					return
+				}
+				authenticated, err := authenticateConnection(info, operation)
+				if err != nil {
+					opLogger.Warn("TCP authentication failed", "err", err)
+					kvsAuth.RegisterFailure("tcp", err)
+					kvsRateLimit.RegisterAuthFailure(info.RemoteAddr)
+					responseObject.Response = err.Error()
+					writeResponse(conn, opLogger, responseObject)
+					if authFailures++; authFailures >= maxAuthFailures {
+						connLogger.Warn("Closing TCP connection after failed authentication", "attempts", authFailures)
+						return
+					}
+					continue
+				}
+				identity = &authenticated
+				connLogger = connLogger.With("identity", identity.Name)
+				responseObject.Response = identity
+				responseObject.Success = true
+				writeResponse(conn, opLogger, responseObject)
+				continue
+			}
+			if identity == nil && kvsAuth.Required() {
+				kvsAuth.RegisterFailure("tcp", kvsAuth.ErrMissingCredentials)
+				responseObject.Response = kvsAuth.ErrMissingCredentials.Error()
+				writeResponse(conn, opLogger, responseObject)
+				continue
+			}
+			if identity != nil {
+				ctx = kvsAuth.WithIdentity(ctx, *identity)
+			}
+			if wait, err := kvsRateLimit.Allow(ctx, "tcp", info.RemoteAddr); err != nil {
+				opLogger.Debug("TCP operation throttled", "retryAfter", wait)
+				responseObject.Response = err.Error()
+				responseObject.RetryAfter = wait.Seconds()
+				writeResponse(conn, opLogger, responseObject)
+				if throttledInRow++; kvsRateLimit.DisconnectAfter() > 0 && throttledInRow >= kvsRateLimit.DisconnectAfter() {
+					connLogger.Warn("Closing TCP connection after repeated throttling", "operations", throttledInRow)
+					connectionsClosed.Inc(closedRateLimited)
+					return
+				}
+				continue
+			}
+			throttledInRow = 0
+			valToReturn, err := processOperation(ctx, operation)
 			if err != nil {
 				responseObject.Response = err.Error()
 			} else {
-				responseObject.Response = valToReturn
+				setResponseValue(&responseObject, valToReturn)
 				responseObject.Success = true
 			}
-			jsonResponse, err := json.Marshal(responseObject)
+			writeResponse(conn, opLogger, responseObject)
+		}
 
-			if err != nil {
-				kvsLogger.Error(fmt.Sprintf("TCP encoding error %v", err.Error()))
-				_, writeError := conn.Write([]byte("Error encoding response.\n"))
-				if writeError != nil {
-					kvsLogger.Error(fmt.Sprintf("Write error %v", err.Error()))
-				}
-			} else {
-				response := append(jsonResponse, []byte("\n")...)
-				_, writeError := conn.Write(response)
-				if writeError != nil {
-					kvsLogger.Error(fmt.Sprintf("Write error %v", err.Error()))
-				}
+		if err != nil {
+			if err != io.EOF {
+				connLogger.Error("TCP read error", "err", err)
 			}
+			return
 		}
-
 		if shuttingDown {
 			return
 		}
 	}
 }
 
-func StartTcpServer(rootCtx context.Context, rootWg *sync.WaitGroup, portNumber int) {
+var errTooManyConnections = errors.New("Too many connections.")
+
+/*
+ *	Answers a connection over tcp.maxConnections with an error response and
+ *	closes it. Runs in its own goroutine, as a TLS connection handshakes on
+ *	its first write.
+ */
+func refuseConnection(conn net.Conn) {
+	defer conn.Close()
+	logger := kvsLogger.With("remoteAddr", conn.RemoteAddr().String())
+	logger.Warn("Refusing TCP connection, too many open")
+	connectionsClosed.Inc(closedMaxConnections)
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	writeResponse(conn, logger, Response{Response: errTooManyConnections.Error()})
+}
+
+// Failed AUTH operations after which a connection is closed
+const maxAuthFailures = 3
+
+// Checks the credential in the val of an AUTH operation, recording the identity on the connection.
+func authenticateConnection(info *ConnectionInfo, op Operation) (kvsAuth.Identity, error) {
+	credential, _ := op.Value.(string)
+	identity, err := kvsAuth.Authenticate(credential)
+	if err != nil {
+		return identity, err
+	}
+	setConnectionIdentity(info, identity)
+	return identity, nil
+}
+
+func setConnectionIdentity(info *ConnectionInfo, identity kvsAuth.Identity) {
+	connectionsMutex.Lock()
+	defer connectionsMutex.Unlock()
+	info.Identity = identity.Name
+}
+
+// Time allowed for a client to complete the TLS handshake
+const handshakeTimeout = 10 * time.Second
+
+/*
+ *	Completes the TLS handshake of conn, returning the identity of the
+ *	client certificate it presented, if any. A certificate with no
+ *	configured identity leaves the connection anonymous, to AUTH as usual.
+ */
+func handshake(conn *tls.Conn, logger *kvsLogger.Logger) (*kvsAuth.Identity, error) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	defer conn.SetDeadline(time.Time{})
+	if err := conn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := conn.ConnectionState()
+	certificate := kvsTls.ClientCertificate(&state)
+	if certificate == nil {
+		return nil, nil
+	}
+	identity, err := kvsAuth.AuthenticateCertificate(certificate)
+	if err != nil {
+		logger.Warn("TCP client certificate has no identity", "subject", certificate.Subject.String())
+		return nil, nil
+	}
+	return &identity, nil
+}
+
+func writeResponse(conn net.Conn, logger *kvsLogger.Logger, responseObject Response) {
+	jsonResponse, err := json.Marshal(responseObject)
+	if err != nil {
+		logger.Error("TCP encoding error", "err", err)
+		_, writeError := conn.Write([]byte("Error encoding response.\n"))
+		if writeError != nil {
+			logger.Error("TCP write error", "err", writeError)
+		}
+		return
+	}
+	response := append(jsonResponse, []byte("\n")...)
+	_, writeError := conn.Write(response)
+	if writeError != nil {
+		logger.Error("TCP write error", "err", writeError)
+	}
+}
+
+var errRequestTooLarge = errors.New("Request too large")
+
+/*
+ *	Reads the next newline delimited operation. A line longer than maxBytes
+ *	(0 means no limit) is read to its end and dropped, and errRequestTooLarge
+ *	returned so the connection can carry on with the next one. A final line
+ *	without a newline is returned along with io.EOF.
+ */
+func readRequest(reader *bufio.Reader, maxBytes int64) ([]byte, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLarge {
+			line = append(line, chunk...)
+			if maxBytes > 0 && int64(len(bytes.TrimRight(line, "\r\n"))) > maxBytes {
+				tooLarge = true
+				line = nil
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if tooLarge {
+			return nil, errRequestTooLarge
+		}
+		return line, err
+	}
+}
+
+// Used as a readiness check, fails unless the listener is accepting connections.
+func ReadinessCheck() error {
+	if atomic.LoadInt32(&accepting) != 1 {
+		return errors.New("TCP listener is not accepting connections")
+	}
+	return nil
+}
+
+func StartTcpServer(rootCtx context.Context, rootWg *sync.WaitGroup, cfg kvsConfig.TcpConfig) {
 	rootWg.Add(1)
 	var wg sync.WaitGroup
+	portNumber := cfg.Port
 	PORT := fmt.Sprintf(":%d", portNumber)
 	listener, err := net.Listen("tcp4", PORT)
 	if err != nil {
-		log.Panic(err)
-		return
+		kvsLogger.Panic("TCP listen failed", "port", portNumber, "err", err)
 	}
 	shuttingDown = false
+	SetMaxRequestBytes(cfg.MaxRequestBytes)
+
+	if cfg.Tls.Enabled() {
+		reloader, err := kvsTls.NewReloader("tcp", cfg.Tls)
+		if err != nil {
+			kvsLogger.Panic("TCP TLS setup failed", "err", err)
+		}
+		listener = tls.NewListener(listener, reloader.ServerConfig())
+		go reloader.Watch(rootCtx)
+	}
 
-	kvsLogger.Log(fmt.Sprintf("TCP listening on port %s", PORT))
+	kvsLogger.Info("TCP listening", "port", portNumber, "tls", cfg.Tls.Enabled())
+	atomic.StoreInt32(&accepting, 1)
 	go func() {
 		for {
 			connection, err := listener.Accept()
 			if err != nil {
-				log.Panic(err)
-				return
+				if atomic.LoadInt32(&accepting) == 0 {
+					// Listener closed during shutdown
+					return
+				}
+				kvsLogger.Panic("TCP accept failed", "err", err)
+			}
+			if active := atomic.AddInt64(&activeConnections, 1); cfg.MaxConnections > 0 && active > int64(cfg.MaxConnections) {
+				atomic.AddInt64(&activeConnections, -1)
+				go refuseConnection(connection)
+				continue
 			}
 			go handleConnection(&wg, connection)
 		}
 	}()
 
 	<-rootCtx.Done()
-	kvsLogger.Log("Closing TCP connection")
+	kvsLogger.Info("Closing TCP connection")
+	atomic.StoreInt32(&accepting, 0)
+	listener.Close()
 	shuttingDown = true
 
 	wg.Wait()
@@ -0,0 +1,134 @@
+package kvsTcpServer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"gokvs/kvs"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"gokvs/kvsDocument"
+	"gokvs/kvsRateLimit"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestIncrementDelta(t *testing.T) {
+	decode := func(op string) Operation {
+		var decoded Operation
+		decoder := json.NewDecoder(strings.NewReader(op))
+		decoder.UseNumber()
+		if err := decoder.Decode(&decoded); err != nil {
+			t.Fatalf("Could not decode %s: %v", op, err)
+		}
+		return decoded
+	}
+
+	for op, want := range map[string]json.Number{
+		`{"op": "INCR", "id": "a"}`:              "1",
+		`{"op": "INCR", "id": "a", "val": 5}`:    "5",
+		`{"op": "INCR", "id": "a", "val": -2.5}`: "-2.5",
+	} {
+		if delta, err := incrementDelta(decode(op).Value); err != nil || delta != want {
+			t.Errorf("Expected delta %s from %s, got %s, %v", want, op, delta, err)
+		}
+	}
+
+	for _, op := range []string{
+		`{"op": "INCR", "id": "a", "val": "5"}`,
+		`{"op": "INCR", "id": "a", "val": true}`,
+		`{"op": "INCR", "id": "a", "val": [1]}`,
+		`{"op": "INCR", "id": "a", "val": {"delta": 1}}`,
+	} {
+		if delta, err := incrementDelta(decode(op).Value); err == nil {
+			t.Errorf("Expected %s to be rejected, got %s", op, delta)
+		}
+	}
+}
+
+func TestQueryUnknownNamespace(t *testing.T) {
+	kvs.Start()
+	defer kvs.Stop()
+	result, err := processOperation(context.Background(), Operation{Operation: "QUERY", Namespace: "nope"})
+	if err != kvs.ErrUnknownNamespace {
+		t.Errorf("Expected ErrUnknownNamespace from QUERY in an unknown namespace, got %v, %v", result, err)
+	}
+}
+
+func TestAuthenticationRateLimit(t *testing.T) {
+	kvsAuth.Configure(kvsConfig.AuthConfig{
+		Enabled: true,
+		ApiKeys: []kvsConfig.ApiKeyConfig{{Identity: "ci", Key: "ci-key-0123456789"}},
+	})
+	defer kvsAuth.Configure(kvsConfig.AuthConfig{})
+	kvsRateLimit.Configure(kvsConfig.RateLimitConfig{AuthFailuresPerSecond: 0.001, AuthFailureBurst: 2})
+	defer kvsRateLimit.Configure(kvsConfig.RateLimitConfig{})
+
+	// Each AUTH is sent on a new connection, as reconnecting must not reset the limit
+	auth := func(key string) Response {
+		client, server := net.Pipe()
+		defer client.Close()
+		var wg sync.WaitGroup
+		go handleConnection(&wg, server)
+		fmt.Fprintf(client, `{"op": "AUTH", "val": %q}`+"\n", key)
+		var response Response
+		if err := json.NewDecoder(client).Decode(&response); err != nil {
+			t.Fatalf("Could not read AUTH response: %v", err)
+		}
+		return response
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := auth("guess"); response.Success || response.RetryAfter != 0 {
+			t.Fatalf("Expected failure %d within the burst to be checked, got %+v", i, response)
+		}
+	}
+	if response := auth("ci-key-0123456789"); response.Success || response.RetryAfter == 0 {
+		t.Errorf("Expected AUTH to be throttled once the failures are used, got %+v", response)
+	}
+}
+
+func TestOperationPatchContentType(t *testing.T) {
+	for contentType, want := range map[string]string{
+		kvsDocument.JsonPatchContentType + "; charset=utf-8": "kvsDocument.JsonPatch",
+		"Application/Merge-Patch+JSON; charset=utf-8":        "kvsDocument.MergePatch",
+		"": "kvsDocument.JsonPatch",
+	} {
+		op := Operation{Operation: "PATCH", Value: []interface{}{}, ContentType: contentType}
+		if patch, err := operationPatch(op); err != nil || fmt.Sprintf("%T", patch) != want {
+			t.Errorf("Expected a %s from content type %q, got %T, %v", want, contentType, patch, err)
+		}
+	}
+	for _, contentType := range []string{"application/json", "application/json-patch+json; =bad"} {
+		if _, err := operationPatch(Operation{Operation: "PATCH", Value: []interface{}{}, ContentType: contentType}); err == nil {
+			t.Errorf("Expected content type %q to be rejected", contentType)
+		}
+	}
+}
+
+func TestWriteOnlyAuthorization(t *testing.T) {
+	kvsAuth.Configure(kvsConfig.AuthConfig{
+		Enabled:  true,
+		Roles:    []kvsConfig.RoleConfig{{Name: "write-only", Grants: []kvsConfig.GrantConfig{{Namespace: "*", Permissions: []string{"write"}}}}},
+		Bindings: []kvsConfig.BindingConfig{{Identity: "writer", Roles: []string{"write-only"}}},
+	})
+	defer kvsAuth.Configure(kvsConfig.AuthConfig{})
+	kvs.Start()
+	defer kvs.Stop()
+	id, _ := kvs.Set(map[string]interface{}{"n": json.Number("1")})
+	ctx := kvsAuth.WithIdentity(context.Background(), kvsAuth.Identity{Name: "writer"})
+
+	for _, op := range []Operation{
+		{Operation: "PATCH", Id: id, Value: map[string]interface{}{}},
+		{Operation: "INCR", Id: id, Value: json.Number("0")},
+	} {
+		if result, err := processOperation(ctx, op); err != kvsAuth.ErrPermissionDenied {
+			t.Errorf("Expected %s to be denied without read, got %v, %v", op.Operation, result, err)
+		}
+	}
+	if _, err := processOperation(ctx, Operation{Operation: "UPDATE", Id: id, Value: 2}); err != nil {
+		t.Errorf("Expected UPDATE to be allowed with write, got %v", err)
+	}
+}
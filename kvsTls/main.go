@@ -0,0 +1,204 @@
+package kvsTls
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"gokvs/kvsConfig"
+	"gokvs/kvsLogger"
+	"gokvs/kvsMetrics"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// How often the certificate, key and CA files are checked for changes
+const ReloadInterval = 10 * time.Second
+
+/*
+ *	Holds the certificate and client CAs of a listener, loaded from the files
+ *	named in its TlsConfig. Handshakes always see the latest files that
+ *	loaded successfully: a renewal that fails to load is logged and the
+ *	previous certificate kept.
+ */
+type Reloader struct {
+	listener string
+	cfg      kvsConfig.TlsConfig
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	clientCAs   *x509.CertPool
+	modTimes    map[string]time.Time
+}
+
+// Reloaders by listener, for kvs_tls_certificate_expiry_timestamp_seconds
+var reloaders = map[string]*Reloader{}
+var reloadersMutex sync.Mutex
+
+var certificateReloads = kvsMetrics.NewCounterVec(
+	"kvs_tls_certificate_reloads_total",
+	"Reloads of changed certificate files, by listener and outcome.",
+	"listener", "outcome",
+)
+
+var _ = kvsMetrics.NewGaugeVecFunc(
+	"kvs_tls_certificate_expiry_timestamp_seconds",
+	"Expiry of the certificate served by each listener, in Unix seconds.",
+	func() []kvsMetrics.Sample {
+		reloadersMutex.Lock()
+		defer reloadersMutex.Unlock()
+		samples := make([]kvsMetrics.Sample, 0, len(reloaders))
+		for listener, r := range reloaders {
+			samples = append(samples, kvsMetrics.Sample{
+				LabelValues: []string{listener},
+				Value:       float64(r.NotAfter().Unix()),
+			})
+		}
+		sort.Slice(samples, func(i, j int) bool { return samples[i].LabelValues[0] < samples[j].LabelValues[0] })
+		return samples
+	},
+	"listener",
+)
+
+// Loads the files of cfg for listener ("http" or "tcp"), failing if any of them is unusable.
+func NewReloader(listener string, cfg kvsConfig.TlsConfig) (*Reloader, error) {
+	r := &Reloader{listener: listener, cfg: cfg}
+	if _, err := r.Reload(); err != nil {
+		return nil, err
+	}
+	reloadersMutex.Lock()
+	defer reloadersMutex.Unlock()
+	reloaders[listener] = r
+	return r, nil
+}
+
+func (r *Reloader) files() []string {
+	files := []string{r.cfg.CertFile, r.cfg.KeyFile}
+	if r.cfg.ClientCAFile != "" {
+		files = append(files, r.cfg.ClientCAFile)
+	}
+	return files
+}
+
+/*
+ *	Re-reads the files if any of them changed since they were last loaded,
+ *	returning whether they were.
+ */
+func (r *Reloader) Reload() (bool, error) {
+	modTimes := map[string]time.Time{}
+	changed := false
+	r.mutex.RLock()
+	for _, file := range r.files() {
+		stat, err := os.Stat(file)
+		if err != nil {
+			r.mutex.RUnlock()
+			return false, err
+		}
+		modTimes[file] = stat.ModTime()
+		if !stat.ModTime().Equal(r.modTimes[file]) {
+			changed = true
+		}
+	}
+	r.mutex.RUnlock()
+	if !changed {
+		return false, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(r.cfg.CertFile, r.cfg.KeyFile)
+	if err != nil {
+		return false, fmt.Errorf("Failed to load %s: %v", r.cfg.CertFile, err)
+	}
+	if certificate.Leaf == nil {
+		if certificate.Leaf, err = x509.ParseCertificate(certificate.Certificate[0]); err != nil {
+			return false, fmt.Errorf("Failed to parse %s: %v", r.cfg.CertFile, err)
+		}
+	}
+	var clientCAs *x509.CertPool
+	if r.cfg.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAFile)
+		if err != nil {
+			return false, err
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return false, fmt.Errorf("No certificates found in %s", r.cfg.ClientCAFile)
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certificate = &certificate
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return true, nil
+}
+
+// Expiry of the certificate currently served.
+func (r *Reloader) NotAfter() time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate.Leaf.NotAfter
+}
+
+/*
+ *	The config for the listener. Each handshake picks up the current
+ *	certificate and client CAs, and negotiates one of nextProtos by ALPN
+ *	("h2" and "http/1.1" for HTTP, none for TCP).
+ */
+func (r *Reloader) ServerConfig(nextProtos ...string) *tls.Config {
+	clientAuth := tls.NoClientCert
+	if r.cfg.RequireClientCert {
+		clientAuth = tls.RequireAndVerifyClientCert
+	} else if r.cfg.ClientCAFile != "" {
+		clientAuth = tls.VerifyClientCertIfGiven
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		NextProtos: nextProtos,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			r.mutex.RLock()
+			defer r.mutex.RUnlock()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*r.certificate},
+				ClientAuth:   clientAuth,
+				ClientCAs:    r.clientCAs,
+				NextProtos:   nextProtos,
+			}, nil
+		},
+	}
+}
+
+// Checks the files for changes every ReloadInterval until ctx is done.
+func (r *Reloader) Watch(ctx context.Context) {
+	ticker := time.NewTicker(ReloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			reloaded, err := r.Reload()
+			if err != nil {
+				kvsLogger.Error("TLS certificate reload failed, keeping the current certificate", "listener", r.listener, "err", err)
+				certificateReloads.Inc(r.listener, "failure")
+			} else if reloaded {
+				kvsLogger.Info("TLS certificate reloaded", "listener", r.listener, "notAfter", r.NotAfter())
+				certificateReloads.Inc(r.listener, "success")
+			}
+		}
+	}
+}
+
+/*
+ *	The client certificate verified during the handshake of state, nil if the
+ *	client presented none.
+ */
+func ClientCertificate(state *tls.ConnectionState) *x509.Certificate {
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0][0]
+}
@@ -0,0 +1,218 @@
+package kvsTls
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"gokvs/kvsConfig"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCertificate struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// Issues a certificate for commonName, signed by issuer or self-signed when issuer is nil.
+func issue(t *testing.T, commonName string, serial int64, issuer *testCertificate) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Duration(serial) * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+	}
+	parent, signer := template, key
+	if issuer == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		parent, signer = issuer.certificate, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := x509.ParseCertificate(der)
+	return &testCertificate{certificate: certificate, key: key}
+}
+
+func (c *testCertificate) write(t *testing.T, certFile, keyFile string, modTime time.Time) {
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.certificate.Raw}), 0600)
+	os.Chtimes(certFile, modTime, modTime)
+	if keyFile != "" {
+		der, _ := x509.MarshalECPrivateKey(c.key)
+		os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+		os.Chtimes(keyFile, modTime, modTime)
+	}
+}
+
+func (c *testCertificate) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.certificate.Raw}, PrivateKey: c.key}
+}
+
+/*
+ *	Serves one handshake on a local listener with config, returning the
+ *	client certificate the server saw, and the serial of the server
+ *	certificate the client saw.
+ */
+func handshake(t *testing.T, config *tls.Config, clientConfig *tls.Config) (*x509.Certificate, int64, error) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	serverSaw := make(chan *x509.Certificate, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			serverSaw <- nil
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if tlsConn.Handshake() != nil {
+			serverSaw <- nil
+			return
+		}
+		state := tlsConn.ConnectionState()
+		serverSaw <- ClientCertificate(&state)
+	}()
+
+	conn, err := tls.Dial("tcp", listener.Addr().String(), clientConfig)
+	if err != nil {
+		<-serverSaw
+		return nil, 0, err
+	}
+	defer conn.Close()
+	serial := conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	client := <-serverSaw
+	return client, serial, nil
+}
+
+func TestReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile, caFile := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key"), filepath.Join(dir, "ca.pem")
+	ca := issue(t, "Test CA", 1, nil)
+	ca.write(t, caFile, "", time.Now())
+	issue(t, "localhost", 2, ca).write(t, certFile, keyFile, time.Now().Add(-time.Hour))
+	client := issue(t, "billing", 3, ca)
+	stranger := issue(t, "billing", 4, issue(t, "Other CA", 5, nil))
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.certificate)
+	clientConfig := func(certificate *testCertificate) *tls.Config {
+		config := &tls.Config{RootCAs: roots, ServerName: "localhost"}
+		if certificate != nil {
+			config.Certificates = []tls.Certificate{certificate.tlsCertificate()}
+		}
+		return config
+	}
+
+	r, err := NewReloader("test", kvsConfig.TlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile})
+	if err != nil {
+		t.Fatalf("NewReloader returned err %v", err)
+	}
+	config := r.ServerConfig()
+
+	t.Run("Verified client certificate", func(t *testing.T) {
+		seen, serial, err := handshake(t, config, clientConfig(client))
+		if err != nil || seen == nil || seen.Subject.CommonName != "billing" || serial != 2 {
+			t.Errorf("Expected the client certificate and server serial 2, got %v, %d, %v", seen, serial, err)
+		}
+	})
+
+	t.Run("No client certificate", func(t *testing.T) {
+		seen, _, err := handshake(t, config, clientConfig(nil))
+		if err != nil || seen != nil {
+			t.Errorf("Expected an anonymous handshake, got %v, %v", seen, err)
+		}
+	})
+
+	t.Run("Client certificate from another CA", func(t *testing.T) {
+		if seen, _, err := handshake(t, config, clientConfig(stranger)); err == nil && seen != nil {
+			t.Errorf("Expected the certificate to be refused")
+		}
+	})
+
+	t.Run("Changed files are reloaded", func(t *testing.T) {
+		if reloaded, err := r.Reload(); reloaded || err != nil {
+			t.Errorf("Expected unchanged files not to be reloaded, got %v, %v", reloaded, err)
+		}
+		issue(t, "localhost", 6, ca).write(t, certFile, keyFile, time.Now())
+		if reloaded, err := r.Reload(); !reloaded || err != nil {
+			t.Fatalf("Expected changed files to be reloaded, got %v, %v", reloaded, err)
+		}
+		if _, serial, err := handshake(t, config, clientConfig(client)); err != nil || serial != 6 {
+			t.Errorf("Expected the renewed certificate, got serial %d, %v", serial, err)
+		}
+		if !r.NotAfter().Equal(r.certificate.Leaf.NotAfter) || r.NotAfter().Before(time.Now().Add(5*time.Hour)) {
+			t.Errorf("Unexpected expiry %v", r.NotAfter())
+		}
+	})
+
+	t.Run("Broken files keep the current certificate", func(t *testing.T) {
+		os.WriteFile(keyFile, []byte("not a key"), 0600)
+		if _, err := r.Reload(); err == nil {
+			t.Errorf("Expected a broken key to fail to load")
+		}
+		if _, serial, err := handshake(t, config, clientConfig(client)); err != nil || serial != 6 {
+			t.Errorf("Expected the previous certificate, got serial %d, %v", serial, err)
+		}
+	})
+
+	t.Run("Required client certificate", func(t *testing.T) {
+		issue(t, "localhost", 7, ca).write(t, certFile, keyFile, time.Now().Add(time.Hour))
+		required, err := NewReloader("required", kvsConfig.TlsConfig{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, RequireClientCert: true})
+		if err != nil {
+			t.Fatalf("NewReloader returned err %v", err)
+		}
+		if seen, _, err := handshake(t, required.ServerConfig(), clientConfig(nil)); err == nil && seen != nil {
+			t.Errorf("Expected a handshake without a client certificate to fail")
+		}
+	})
+
+	t.Run("Protocols are negotiated", func(t *testing.T) {
+		listener, err := tls.Listen("tcp", "127.0.0.1:0", r.ServerConfig("h2", "http/1.1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				conn.(*tls.Conn).Handshake()
+				conn.Close()
+			}
+		}()
+		config := clientConfig(nil)
+		config.NextProtos = []string{"h2"}
+		conn, err := tls.Dial("tcp", listener.Addr().String(), config)
+		if err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		defer conn.Close()
+		if protocol := conn.ConnectionState().NegotiatedProtocol; protocol != "h2" {
+			t.Errorf("Expected h2 to be negotiated, got %q", protocol)
+		}
+	})
+
+	t.Run("Missing files", func(t *testing.T) {
+		if _, err := NewReloader("missing", kvsConfig.TlsConfig{CertFile: filepath.Join(dir, "none.pem"), KeyFile: keyFile}); err == nil {
+			t.Errorf("Expected missing files to fail")
+		}
+	})
+}
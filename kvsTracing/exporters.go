@@ -0,0 +1,348 @@
+package kvsTracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"gokvs/kvsConfig"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	queueSize      = 2048
+	maxBatchSize   = 512
+	exportInterval = 2 * time.Second
+	exportTimeout  = 10 * time.Second
+)
+
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+var exporter Exporter
+var serviceName = "gokvs"
+var ratio = 1.0
+var settingsMutex sync.RWMutex
+
+var spanChannel chan *Span
+var processorDone chan struct{}
+var droppedSpans uint64
+
+func Enabled() bool {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return exporter != nil
+}
+
+func sampleRatio() float64 {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	return ratio
+}
+
+// Number of finished spans dropped because the export queue was full.
+func DroppedSpans() uint64 {
+	return atomic.LoadUint64(&droppedSpans)
+}
+
+/*
+ *	Sets up the configured exporter and starts the batching goroutine. With the
+ *	"none" exporter tracing is off: StartSpan returns a nil span and no trace
+ *	context is passed on, though an incoming traceparent is still extracted so
+ *	the access log can show the client's trace id.
+ */
+func Start(cfg kvsConfig.TracingConfig) error {
+	var newExporter Exporter
+	switch cfg.Exporter {
+	case "", "none":
+		return nil
+	case "otlp":
+		newExporter = NewOtlpHttpExporter(cfg.Endpoint)
+	case "file":
+		fileExporter, err := NewFileExporter(cfg.FilePath)
+		if err != nil {
+			return err
+		}
+		newExporter = fileExporter
+	default:
+		return fmt.Errorf("Unknown trace exporter %q", cfg.Exporter)
+	}
+	startWithExporter(newExporter, cfg.ServiceName, cfg.SampleRatio)
+	return nil
+}
+
+func startWithExporter(newExporter Exporter, service string, sampleRatio float64) {
+	settingsMutex.Lock()
+	defer settingsMutex.Unlock()
+	exporter = newExporter
+	if service != "" {
+		serviceName = service
+	}
+	ratio = sampleRatio
+	spanChannel = make(chan *Span, queueSize)
+	processorDone = make(chan struct{})
+	go processSpans(spanChannel, processorDone, newExporter)
+}
+
+/*
+ *	Exports any queued spans and shuts the exporter down. Spans ended afterwards
+ *	are discarded.
+ */
+func Shutdown(ctx context.Context) error {
+	settingsMutex.Lock()
+	if exporter == nil {
+		settingsMutex.Unlock()
+		return nil
+	}
+	currentExporter := exporter
+	exporter = nil
+	close(spanChannel)
+	spanChannel = nil
+	done := processorDone
+	settingsMutex.Unlock()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return currentExporter.Shutdown(ctx)
+}
+
+func enqueue(span *Span) {
+	settingsMutex.RLock()
+	defer settingsMutex.RUnlock()
+	if spanChannel == nil {
+		return
+	}
+	select {
+	case spanChannel <- span:
+	default:
+		atomic.AddUint64(&droppedSpans, 1)
+	}
+}
+
+func processSpans(spans <-chan *Span, done chan struct{}, spanExporter Exporter) {
+	defer close(done)
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, maxBatchSize)
+	export := func() {
+		if len(batch) == 0 {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+		if err := spanExporter.Export(ctx, batch); err != nil {
+			fmt.Fprintf(os.Stderr, "Trace export error: %v\n", err)
+		}
+		cancel()
+		batch = make([]*Span, 0, maxBatchSize)
+	}
+
+	for {
+		select {
+		case span, ok := <-spans:
+			if !ok {
+				export()
+				return
+			}
+			batch = append(batch, span)
+			if len(batch) >= maxBatchSize {
+				export()
+			}
+		case <-ticker.C:
+			export()
+		}
+	}
+}
+
+/*
+ *	OTLP JSON encoding, see opentelemetry-proto ExportTraceServiceRequest.
+ *	Ids are hex encoded and timestamps are decimal strings, as the OTLP JSON
+ *	mapping requires.
+ */
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    StatusCode `json:"code,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceId           string         `json:"traceId"`
+	SpanId            string         `json:"spanId"`
+	ParentSpanId      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              SpanKind       `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func otlpValue(value interface{}) otlpAnyValue {
+	switch v := value.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &v}
+	case bool:
+		return otlpAnyValue{BoolValue: &v}
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		return otlpAnyValue{IntValue: &s}
+	case float64:
+		return otlpAnyValue{DoubleValue: &v}
+	default:
+		s := fmt.Sprintf("%v", v)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func encodeOtlp(spans []*Span) ([]byte, error) {
+	settingsMutex.RLock()
+	service := serviceName
+	settingsMutex.RUnlock()
+
+	var resourceSpans otlpResourceSpans
+	resourceSpans.Resource.Attributes = []otlpKeyValue{{Key: "service.name", Value: otlpValue(service)}}
+	var scopeSpans otlpScopeSpans
+	scopeSpans.Scope.Name = "gokvs/kvsTracing"
+
+	for _, span := range spans {
+		span.mutex.Lock()
+		encoded := otlpSpan{
+			TraceId:           span.spanContext.TraceID.String(),
+			SpanId:            span.spanContext.SpanID.String(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: span.statusCode, Message: span.statusMessage},
+		}
+		if span.parentSpanID.IsValid() {
+			encoded.ParentSpanId = span.parentSpanID.String()
+		}
+		for _, attribute := range span.attributes {
+			encoded.Attributes = append(encoded.Attributes, otlpKeyValue{Key: attribute.Key, Value: otlpValue(attribute.Value)})
+		}
+		span.mutex.Unlock()
+		scopeSpans.Spans = append(scopeSpans.Spans, encoded)
+	}
+	resourceSpans.ScopeSpans = []otlpScopeSpans{scopeSpans}
+	return json.Marshal(otlpExportRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}})
+}
+
+/*
+ *	Sends spans to an OTLP/HTTP collector using the JSON encoding.
+ */
+type OtlpHttpExporter struct {
+	url    string
+	client *http.Client
+}
+
+func NewOtlpHttpExporter(endpoint string) *OtlpHttpExporter {
+	url := strings.TrimSuffix(endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+	return &OtlpHttpExporter{url: url, client: &http.Client{}}
+}
+
+func (e *OtlpHttpExporter) Export(ctx context.Context, spans []*Span) error {
+	body, err := encodeOtlp(spans)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("OTLP endpoint %s returned %s", e.url, res.Status)
+	}
+	return nil
+}
+
+func (e *OtlpHttpExporter) Shutdown(ctx context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+/*
+ *	Appends each batch to a file as one OTLP JSON document per line, the same
+ *	layout the collector's file exporter writes. Meant for local testing.
+ */
+type FileExporter struct {
+	mutex sync.Mutex
+	file  *os.File
+}
+
+func NewFileExporter(path string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileExporter{file: file}, nil
+}
+
+func (e *FileExporter) Export(ctx context.Context, spans []*Span) error {
+	line, err := encodeOtlp(spans)
+	if err != nil {
+		return err
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	_, err = e.file.Write(append(line, '\n'))
+	return err
+}
+
+func (e *FileExporter) Shutdown(ctx context.Context) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.file.Close()
+}
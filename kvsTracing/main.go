@@ -0,0 +1,291 @@
+package kvsTracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+ *	A small tracer producing OpenTelemetry compatible spans. Span contexts are
+ *	propagated with the W3C traceparent format and finished spans are handed to
+ *	the configured exporter in batches. The OpenTelemetry SDK and its OTLP
+ *	exporter need a far newer Go than this module targets and bring gRPC and
+ *	protobuf with them, so spans are encoded with the OTLP JSON mapping here
+ *	instead; TestOtlpEncoding checks the output against that schema.
+ */
+type TraceID [16]byte
+type SpanID [8]byte
+
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id TraceID) IsValid() bool {
+	return id != TraceID{}
+}
+
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+func (id SpanID) IsValid() bool {
+	return id != SpanID{}
+}
+
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+	Remote  bool
+}
+
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID.IsValid() && sc.SpanID.IsValid()
+}
+
+type SpanKind int
+
+// Values match the OTLP SpanKind enum
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+type StatusCode int
+
+// Values match the OTLP Status.StatusCode enum
+const (
+	StatusUnset StatusCode = 0
+	StatusOk    StatusCode = 1
+	StatusError StatusCode = 2
+)
+
+type Attribute struct {
+	Key   string
+	Value interface{}
+}
+
+/*
+ *	A Span is safe to use from several goroutines. Spans that are not sampled
+ *	still carry a span context for propagation but are never exported.
+ */
+type Span struct {
+	mutex         sync.Mutex
+	name          string
+	kind          SpanKind
+	spanContext   SpanContext
+	parentSpanID  SpanID
+	start         time.Time
+	end           time.Time
+	attributes    []Attribute
+	statusCode    StatusCode
+	statusMessage string
+	ended         bool
+}
+
+type contextKey struct{}
+
+/*
+ *	Starts a span as a child of the span (or remote span context) in ctx and
+ *	returns a context carrying it. When tracing is disabled ctx is returned as
+ *	is with a nil span, which is safe to call methods on.
+ */
+func StartSpan(ctx context.Context, name string, kind SpanKind, attributes ...Attribute) (context.Context, *Span) {
+	if !Enabled() {
+		return ctx, nil
+	}
+	parent := SpanContextFromContext(ctx)
+	span := &Span{
+		name:       name,
+		kind:       kind,
+		start:      time.Now(),
+		attributes: attributes,
+	}
+	if parent.IsValid() {
+		span.spanContext.TraceID = parent.TraceID
+		span.spanContext.Sampled = parent.Sampled
+		span.parentSpanID = parent.SpanID
+	} else {
+		span.spanContext.TraceID = newTraceID()
+		span.spanContext.Sampled = shouldSample(span.spanContext.TraceID)
+	}
+	span.spanContext.SpanID = newSpanID()
+	return context.WithValue(ctx, contextKey{}, span), span
+}
+
+// Returns the span stored in ctx, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(contextKey{}).(*Span)
+	return span
+}
+
+/*
+ *	Returns the span context of the current span in ctx, or of the remote parent
+ *	stored by ContextWithRemoteSpanContext.
+ */
+func SpanContextFromContext(ctx context.Context) SpanContext {
+	switch v := ctx.Value(contextKey{}).(type) {
+	case *Span:
+		return v.SpanContext()
+	case SpanContext:
+		return v
+	}
+	return SpanContext{}
+}
+
+func ContextWithRemoteSpanContext(ctx context.Context, sc SpanContext) context.Context {
+	sc.Remote = true
+	return context.WithValue(ctx, contextKey{}, sc)
+}
+
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.spanContext
+}
+
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil || !s.spanContext.Sampled {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.attributes = append(s.attributes, attributes...)
+}
+
+func (s *Span) SetStatus(code StatusCode, message string) {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statusCode = code
+	s.statusMessage = message
+}
+
+// Marks the span as failed with err. A nil err is ignored.
+func (s *Span) RecordError(err error) {
+	if err == nil {
+		return
+	}
+	s.SetStatus(StatusError, err.Error())
+}
+
+// Ends the span and queues it for export. Later calls are ignored.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mutex.Lock()
+	if s.ended {
+		s.mutex.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mutex.Unlock()
+
+	if s.spanContext.Sampled {
+		enqueue(s)
+	}
+}
+
+/*
+ *	W3C trace context propagation
+ */
+const TraceparentHeader = "traceparent"
+
+// Parses a W3C traceparent value, e.g. 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01
+func ParseTraceparent(traceparent string) (SpanContext, error) {
+	parts := strings.Split(strings.TrimSpace(traceparent), "-")
+	if len(parts) < 4 {
+		return SpanContext{}, fmt.Errorf("Malformed traceparent %q", traceparent)
+	}
+	version, traceIdHex, spanIdHex, flagsHex := parts[0], parts[1], parts[2], parts[3]
+	if len(version) != 2 || version == "ff" || (version == "00" && len(parts) != 4) {
+		return SpanContext{}, fmt.Errorf("Unsupported traceparent version in %q", traceparent)
+	}
+	var sc SpanContext
+	if len(traceIdHex) != 32 || len(spanIdHex) != 16 || len(flagsHex) != 2 {
+		return SpanContext{}, fmt.Errorf("Malformed traceparent %q", traceparent)
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(traceIdHex)); err != nil {
+		return SpanContext{}, fmt.Errorf("Malformed trace id in %q", traceparent)
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(spanIdHex)); err != nil {
+		return SpanContext{}, fmt.Errorf("Malformed span id in %q", traceparent)
+	}
+	flags, err := hex.DecodeString(flagsHex)
+	if err != nil {
+		return SpanContext{}, fmt.Errorf("Malformed trace flags in %q", traceparent)
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("All zero trace or span id in %q", traceparent)
+	}
+	sc.Sampled = flags[0]&1 == 1
+	sc.Remote = true
+	return sc, nil
+}
+
+func FormatTraceparent(sc SpanContext) string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+/*
+ *	Returns ctx with the remote parent described by traceparent, or ctx itself
+ *	if traceparent is empty or invalid.
+ */
+func Extract(ctx context.Context, traceparent string) context.Context {
+	if traceparent == "" {
+		return ctx
+	}
+	sc, err := ParseTraceparent(traceparent)
+	if err != nil {
+		return ctx
+	}
+	return ContextWithRemoteSpanContext(ctx, sc)
+}
+
+/*
+ *	Id generation and sampling
+ */
+func newTraceID() TraceID {
+	var id TraceID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+func newSpanID() SpanID {
+	var id SpanID
+	for !id.IsValid() {
+		rand.Read(id[:])
+	}
+	return id
+}
+
+// Root spans are sampled when the low 8 bytes of the trace id fall under the ratio.
+func shouldSample(id TraceID) bool {
+	samplingRatio := sampleRatio()
+	if samplingRatio >= 1 {
+		return true
+	}
+	if samplingRatio <= 0 {
+		return false
+	}
+	bound := uint64(samplingRatio * (1 << 63))
+	return binary.BigEndian.Uint64(id[8:])>>1 < bound
+}
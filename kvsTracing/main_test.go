@@ -0,0 +1,259 @@
+package kvsTracing
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTraceparent(t *testing.T) {
+	const header = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	sc, err := ParseTraceparent(header)
+	if err != nil {
+		t.Fatalf("ParseTraceparent returned err %v", err)
+	}
+	if sc.TraceID.String() != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanID.String() != "00f067aa0ba902b7" || !sc.Sampled {
+		t.Errorf("Unexpected span context %+v", sc)
+	}
+	if got := FormatTraceparent(sc); got != header {
+		t.Errorf("Expected round trip to give %q, got %q", header, got)
+	}
+
+	for _, invalid := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473z-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		if _, err := ParseTraceparent(invalid); err == nil {
+			t.Errorf("Expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestSpansAreExportedWithParents(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewFileExporter(path)
+	if err != nil {
+		t.Fatalf("NewFileExporter returned err %v", err)
+	}
+	startWithExporter(exporter, "test-service", 1)
+
+	remote, _ := ParseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := ContextWithRemoteSpanContext(context.Background(), remote)
+	ctx, parent := StartSpan(ctx, "parent", KindServer, Attribute{Key: "answer", Value: 42})
+	_, child := StartSpan(ctx, "child", KindInternal)
+	child.End()
+	parent.End()
+
+	if err := Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown returned err %v", err)
+	}
+
+	contents, _ := os.ReadFile(path)
+	var request otlpExportRequest
+	if err := json.Unmarshal(contents, &request); err != nil {
+		t.Fatalf("Exported file is not an OTLP JSON document: %v\n%s", err, contents)
+	}
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatalf("Expected 2 spans, got %d", len(spans))
+	}
+	exportedChild, exportedParent := spans[0], spans[1]
+	if exportedParent.TraceId != remote.TraceID.String() || exportedParent.ParentSpanId != remote.SpanID.String() {
+		t.Errorf("Expected parent to continue the remote trace, got %+v", exportedParent)
+	}
+	if exportedChild.TraceId != remote.TraceID.String() || exportedChild.ParentSpanId != exportedParent.SpanId {
+		t.Errorf("Expected child to be parented to %s, got %+v", exportedParent.SpanId, exportedChild)
+	}
+	if *exportedParent.Attributes[0].Value.IntValue != "42" {
+		t.Errorf("Expected int attribute to be exported, got %+v", exportedParent.Attributes)
+	}
+	if name := *request.ResourceSpans[0].Resource.Attributes[0].Value.StringValue; name != "test-service" {
+		t.Errorf("Expected service.name test-service, got %s", name)
+	}
+}
+
+func TestDisabledTracingIsNoop(t *testing.T) {
+	ctx, span := StartSpan(context.Background(), "ignored", KindInternal)
+	span.SetAttributes(Attribute{Key: "k", Value: "v"})
+	span.RecordError(os.ErrNotExist)
+	span.End()
+	if span != nil || SpanContextFromContext(ctx).IsValid() {
+		t.Errorf("Expected no span while tracing is disabled")
+	}
+}
+
+/*
+ *	The messages of opentelemetry-proto's ExportTraceServiceRequest as they
+ *	appear in the OTLP JSON mapping: lowerCamelCase field names, trace and span
+ *	ids as hex, 64 bit integers as decimal strings and enums as numbers.
+ */
+var otlpSchema = map[string]map[string]string{
+	"ExportTraceServiceRequest": {"resourceSpans": "[]ResourceSpans"},
+	"ResourceSpans":             {"resource": "Resource", "scopeSpans": "[]ScopeSpans", "schemaUrl": "string"},
+	"Resource":                  {"attributes": "[]KeyValue", "droppedAttributesCount": "uint32"},
+	"ScopeSpans":                {"scope": "InstrumentationScope", "spans": "[]Span", "schemaUrl": "string"},
+	"InstrumentationScope":      {"name": "string", "version": "string", "attributes": "[]KeyValue", "droppedAttributesCount": "uint32"},
+	"Span": {
+		"traceId": "traceId", "spanId": "spanId", "traceState": "string", "parentSpanId": "spanId",
+		"flags": "uint32", "name": "string", "kind": "SpanKind", "startTimeUnixNano": "fixed64",
+		"endTimeUnixNano": "fixed64", "attributes": "[]KeyValue", "droppedAttributesCount": "uint32",
+		"droppedEventsCount": "uint32", "droppedLinksCount": "uint32", "status": "Status",
+	},
+	"Status":   {"message": "string", "code": "StatusCode"},
+	"KeyValue": {"key": "string", "value": "AnyValue"},
+	"AnyValue": {"stringValue": "string", "boolValue": "bool", "intValue": "int64", "doubleValue": "double"},
+}
+
+// Required fields of the messages above, and enum ranges.
+var otlpRequired = map[string][]string{
+	"Span":     {"traceId", "spanId", "name", "kind", "startTimeUnixNano", "endTimeUnixNano"},
+	"KeyValue": {"key", "value"},
+}
+var otlpEnums = map[string][2]float64{"SpanKind": {0, 5}, "StatusCode": {0, 2}}
+
+// Checks that value is an OTLP JSON encoding of kind, naming the first field that is not.
+func checkOtlp(path, kind string, value interface{}) error {
+	if strings.HasPrefix(kind, "[]") {
+		items, ok := value.([]interface{})
+		if !ok {
+			return errors.New(path + ": expected an array")
+		}
+		for i, item := range items {
+			if err := checkOtlp(path+"["+strconv.Itoa(i)+"]", kind[2:], item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if fields, ok := otlpSchema[kind]; ok {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return errors.New(path + ": expected a " + kind + " object")
+		}
+		for _, name := range otlpRequired[kind] {
+			if _, ok := object[name]; !ok {
+				return errors.New(path + ": missing " + name)
+			}
+		}
+		if kind == "AnyValue" && len(object) != 1 {
+			return errors.New(path + ": expected exactly one value")
+		}
+		for name, field := range object {
+			fieldKind, ok := fields[name]
+			if !ok {
+				return errors.New(path + ": unknown field " + name)
+			}
+			if err := checkOtlp(path+"."+name, fieldKind, field); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if bounds, ok := otlpEnums[kind]; ok {
+		number, ok := value.(float64)
+		if !ok || number != float64(int(number)) || number < bounds[0] || number > bounds[1] {
+			return errors.New(path + ": expected a " + kind + " number")
+		}
+		return nil
+	}
+	var valid bool
+	switch kind {
+	case "string":
+		_, valid = value.(string)
+	case "bool":
+		_, valid = value.(bool)
+	case "double":
+		_, valid = value.(float64)
+	case "uint32":
+		number, ok := value.(float64)
+		valid = ok && number >= 0 && number == float64(uint32(number))
+	case "int64", "fixed64":
+		text, ok := value.(string)
+		if kind == "int64" {
+			_, err := strconv.ParseInt(text, 10, 64)
+			valid = ok && err == nil
+		} else {
+			_, err := strconv.ParseUint(text, 10, 64)
+			valid = ok && err == nil
+		}
+	case "traceId", "spanId":
+		text, _ := value.(string)
+		decoded, err := hex.DecodeString(text)
+		valid = err == nil && text == strings.ToLower(text) && (len(decoded) == 16 && kind == "traceId" || len(decoded) == 8 && kind == "spanId")
+	}
+	if !valid {
+		return errors.New(path + ": expected a " + kind)
+	}
+	return nil
+}
+
+func TestOtlpEncoding(t *testing.T) {
+	exporter, err := NewFileExporter(filepath.Join(t.TempDir(), "spans.json"))
+	if err != nil {
+		t.Fatalf("NewFileExporter returned err %v", err)
+	}
+	startWithExporter(exporter, "schema-test", 1)
+	ctx, parent := StartSpan(context.Background(), "parent", KindServer)
+	_, child := StartSpan(ctx, "child", KindInternal,
+		Attribute{Key: "string", Value: "v"},
+		Attribute{Key: "bool", Value: true},
+		Attribute{Key: "int", Value: 7},
+		Attribute{Key: "int64", Value: int64(-1) << 62},
+		Attribute{Key: "double", Value: 0.5},
+		Attribute{Key: "other", Value: time.Second},
+	)
+	child.RecordError(os.ErrNotExist)
+	child.End()
+	parent.End()
+	Shutdown(context.Background())
+
+	encoded, err := encodeOtlp([]*Span{child, parent})
+	if err != nil {
+		t.Fatalf("encodeOtlp returned err %v", err)
+	}
+	var document interface{}
+	if err := json.Unmarshal(encoded, &document); err != nil {
+		t.Fatalf("Encoding is not JSON: %v", err)
+	}
+	if err := checkOtlp("request", "ExportTraceServiceRequest", document); err != nil {
+		t.Errorf("Encoding does not match the OTLP schema: %v\n%s", err, encoded)
+	}
+
+	var request otlpExportRequest
+	json.Unmarshal(encoded, &request)
+	spans := request.ResourceSpans[0].ScopeSpans[0].Spans
+	if spans[0].Kind != KindInternal || spans[1].Kind != KindServer || spans[0].Status.Code != StatusError || spans[1].Status.Code != StatusUnset {
+		t.Errorf("Unexpected kinds or statuses %+v", spans)
+	}
+	if start, _ := strconv.ParseInt(spans[0].StartTimeUnixNano, 10, 64); start != child.start.UnixNano() {
+		t.Errorf("Expected start time %d, got %s", child.start.UnixNano(), spans[0].StartTimeUnixNano)
+	}
+
+	t.Run("Schema violations are caught", func(t *testing.T) {
+		for _, invalid := range []string{
+			`{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "4BF92F3577B34DA6A3CE929D0E0E4736", "spanId": "00f067aa0ba902b7", "name": "s", "kind": 1, "startTimeUnixNano": "1", "endTimeUnixNano": "2"}]}]}]}`,
+			`{"resourceSpans": [{"scopeSpans": [{"spans": [{"traceId": "4bf92f3577b34da6a3ce929d0e0e4736", "spanId": "00f067aa0ba902b7", "name": "s", "kind": 1, "startTimeUnixNano": 1, "endTimeUnixNano": "2"}]}]}]}`,
+			`{"resourceSpans": [{"scopeSpans": [{"spans": [{"trace_id": "4bf92f3577b34da6a3ce929d0e0e4736"}]}]}]}`,
+			`{"resourceSpans": [{"resource": {"attributes": [{"key": "k", "value": {"intValue": 1}}]}}]}`,
+			`{"resourceSpans": [{"resource": {"attributes": [{"key": "k", "value": {"stringValue": "a", "boolValue": true}}]}}]}`,
+		} {
+			var document interface{}
+			json.Unmarshal([]byte(invalid), &document)
+			if checkOtlp("request", "ExportTraceServiceRequest", document) == nil {
+				t.Errorf("Expected %s to be rejected", invalid)
+			}
+		}
+	})
+}
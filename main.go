@@ -2,39 +2,174 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"gokvs/kvs"
+	"gokvs/kvsAdminServer"
+	"gokvs/kvsAudit"
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
 	"gokvs/kvsHttpServer"
 	"gokvs/kvsLogger"
+	"gokvs/kvsRateLimit"
 	"gokvs/kvsTcpServer"
+	"gokvs/kvsTracing"
+	"log"
 	"os"
 	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 )
 
+/*
+ *	Re-reads the config file and applies its reloadable settings. Invalid configs
+ *	are rejected as a whole and the running config is left as it was: every
+ *	package checks and builds its new settings before any of them are applied.
+ */
+func reloadConfig(configPath string) {
+	newConfig, err := kvsConfig.Load(configPath)
+	if err != nil {
+		kvsLogger.Error("Config reload rejected", "err", err)
+		return
+	}
+	runningConfig := kvsConfig.Current()
+	changes := kvsConfig.Diff(runningConfig, newConfig)
+	if len(changes) == 0 {
+		kvsLogger.Info("Config reloaded: no changes")
+		return
+	}
+	for _, change := range changes {
+		if change.Reloadable {
+			kvsLogger.Info("Config setting changed", "setting", change.Setting, "old", change.Old, "new", change.New)
+		} else {
+			kvsLogger.Warn("Config setting requires a restart, ignoring", "setting", change.Setting, "old", change.Old, "new", change.New)
+		}
+	}
+
+	// Everything is checked and built before anything is applied, so a reload never half applies
+	appliedConfig := kvsConfig.Reloadable(runningConfig, newConfig)
+	applyLogger, err := kvsLogger.PrepareConfig(appliedConfig.Logger)
+	if err != nil {
+		kvsLogger.Error("Config reload rejected", "err", err)
+		return
+	}
+	applyStore, err := kvs.PrepareConfig(appliedConfig.Store)
+	if err != nil {
+		kvsLogger.Error("Config reload rejected", "err", err)
+		return
+	}
+	applyAuth := kvsAuth.PrepareConfig(appliedConfig.Auth)
+	applyRateLimit := kvsRateLimit.PrepareConfig(appliedConfig.RateLimit)
+
+	applyLogger()
+	applyStore()
+	applyAuth()
+	applyRateLimit()
+	kvsHttpServer.SetMaxRequestBytes(appliedConfig.Http.MaxRequestBytes)
+	kvsTcpServer.SetMaxRequestBytes(appliedConfig.Tcp.MaxRequestBytes)
+	kvsConfig.SetCurrent(appliedConfig)
+}
+
+/*
+ *	Checks the audit log at path, printing the number of entries and the hash
+ *	of the last one, or the first broken entry. Returns the exit code.
+ */
+func verifyAuditLog(path string) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	defer file.Close()
+	last, err := kvsAudit.Verify(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: chain broken after %d intact entries: %v\n", path, last.Seq, err)
+		return 1
+	}
+	fmt.Printf("%s: %d entries intact, last hash %s\n", path, last.Seq, last.Hash)
+	return 0
+}
+
 func main() {
 	var rootWg sync.WaitGroup
 
+	configPath := flag.String("config", "", "Path to a JSON config file")
+	issueToken := flag.String("issue-token", "", "Print a token for this identity, signed with the first auth.tokenSecrets entry, and exit")
+	tokenTTL := flag.Duration("token-ttl", 24*time.Hour, "Lifetime of the token printed by -issue-token, 0 for no expiry")
+	verifyAudit := flag.String("verify-audit", "", "Check the hash chain of this audit log and exit")
+	flag.Parse()
+
+	if *verifyAudit != "" {
+		os.Exit(verifyAuditLog(*verifyAudit))
+	}
+
+	config, err := kvsConfig.Load(*configPath)
+	if err != nil {
+		log.Fatalf("Config error: %v", err)
+	}
+	if *issueToken != "" {
+		if len(config.Auth.TokenSecrets) == 0 {
+			log.Fatalf("Config error: -issue-token requires auth.tokenSecrets")
+		}
+		fmt.Println(kvsAuth.IssueToken(config.Auth.TokenSecrets[0], *issueToken, *tokenTTL))
+		return
+	}
+	kvsConfig.SetCurrent(config)
+	kvsAuth.Configure(config.Auth)
+	kvsRateLimit.Configure(config.RateLimit)
+
+	if err := kvsLogger.ConfigureOutputs(config.Logger.Outputs); err != nil {
+		log.Fatalf("Log output error: %v", err)
+	}
+	kvsLogger.StartLogger(config.Logger)
+	defer kvsLogger.Close()
+	// Closed after the store stops, so every change is written
+	if err := kvsAudit.Start(config.Audit); err != nil {
+		kvsLogger.Fatal("Audit log setup failed", "err", err)
+	}
+	defer kvsAudit.Close()
+	kvs.ApplyConfig(config.Store)
 	kvs.Start()
 	defer kvs.Stop()
-	kvsLogger.StartLogger(&rootWg)
-	defer kvsLogger.WaitForLoggerToComplete()
+	if err := kvsTracing.Start(config.Tracing); err != nil {
+		kvsLogger.Fatal("Tracing setup failed", "err", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := kvsTracing.Shutdown(ctx); err != nil {
+			kvsLogger.Error("Tracing shutdown failed", "err", err)
+		}
+	}()
 
 	rootContext, cancel := context.WithCancel(context.Background())
 
-	go kvsHttpServer.StartHttpServer(rootContext, &rootWg, 8080)
+	kvsHttpServer.RegisterReadinessCheck("store", kvs.ReadinessCheck)
+	kvsHttpServer.RegisterReadinessCheck("tcp", kvsTcpServer.ReadinessCheck)
+
+	go kvsHttpServer.StartHttpServer(rootContext, &rootWg, config.Http)
+
+	go kvsTcpServer.StartTcpServer(rootContext, &rootWg, config.Tcp)
 
-	go kvsTcpServer.StartTcpServer(rootContext, &rootWg, 8081)
+	go kvsAdminServer.StartAdminServer(rootContext, &rootWg, config.Admin)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGHUP)
 	defer signal.Stop(c)
 
-	interrupt := <-c
-	kvsLogger.Log(fmt.Sprintf("Signal '%v' received. Stopping child processes", interrupt))
+	var interrupt os.Signal
+	for interrupt = range c {
+		if interrupt != syscall.SIGHUP {
+			break
+		}
+		kvsLogger.Info("SIGHUP received. Reloading config")
+		reloadConfig(*configPath)
+	}
+	kvsLogger.Info("Signal received. Stopping child processes", "signal", interrupt)
 	cancel()
 
 	rootWg.Wait()
 
-	kvsLogger.Log("Main: Exited")
+	kvsLogger.Info("Main: Exited")
 }
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"gokvs/kvsAuth"
+	"gokvs/kvsConfig"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	writeConfig := func(key string) {
+		os.WriteFile(path, []byte(`{"auth": {"enabled": true, "apiKeys": [{"identity": "ci", "key": "`+key+`"}]}}`), 0600)
+	}
+	writeConfig("revoked-key-0123456789")
+	config, err := kvsConfig.Load(path)
+	if err != nil {
+		t.Fatalf("Load returned err %v", err)
+	}
+	kvsConfig.SetCurrent(config)
+	kvsAuth.Configure(config.Auth)
+	defer kvsAuth.Configure(kvsConfig.AuthConfig{})
+
+	t.Run("Changing only a secret", func(t *testing.T) {
+		writeConfig("rotated-key-0123456789")
+		reloadConfig(path)
+		if _, err := kvsAuth.Authenticate("revoked-key-0123456789"); err != kvsAuth.ErrInvalidCredentials {
+			t.Errorf("Expected the revoked key to be refused, got %v", err)
+		}
+		if identity, err := kvsAuth.Authenticate("rotated-key-0123456789"); err != nil || identity.Name != "ci" {
+			t.Errorf("Expected the rotated key to be accepted, got %+v, %v", identity, err)
+		}
+		if key := kvsConfig.Current().Auth.ApiKeys[0].Key; key != "rotated-key-0123456789" {
+			t.Errorf("Expected the running config to hold the rotated key, got %q", key)
+		}
+	})
+
+	t.Run("Request size limits", func(t *testing.T) {
+		os.WriteFile(path, []byte(`{"http": {"maxRequestBytes": 1024}, "tcp": {"maxRequestBytes": 2048}, "auth": {"enabled": true, "apiKeys": [{"identity": "ci", "key": "rotated-key-0123456789"}]}}`), 0600)
+		reloadConfig(path)
+		if current := kvsConfig.Current(); current.Http.MaxRequestBytes != 1024 || current.Tcp.MaxRequestBytes != 2048 {
+			t.Errorf("Expected the request size limits to be reloaded, got %d and %d", current.Http.MaxRequestBytes, current.Tcp.MaxRequestBytes)
+		}
+	})
+}